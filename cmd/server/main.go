@@ -1,29 +1,57 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/xHacka/nginx-log-analyzer/internal/alerts"
+	"github.com/xHacka/nginx-log-analyzer/internal/archive"
+	"github.com/xHacka/nginx-log-analyzer/internal/blocklist"
 	"github.com/xHacka/nginx-log-analyzer/internal/config"
 	"github.com/xHacka/nginx-log-analyzer/internal/csrf"
+	"github.com/xHacka/nginx-log-analyzer/internal/geoip"
 	"github.com/xHacka/nginx-log-analyzer/internal/handlers"
+	"github.com/xHacka/nginx-log-analyzer/internal/incidents"
 	"github.com/xHacka/nginx-log-analyzer/internal/ingest"
+	"github.com/xHacka/nginx-log-analyzer/internal/live"
+	"github.com/xHacka/nginx-log-analyzer/internal/mailer"
+	"github.com/xHacka/nginx-log-analyzer/internal/metrics"
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/privacy"
+	"github.com/xHacka/nginx-log-analyzer/internal/reports"
 	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+	"github.com/xHacka/nginx-log-analyzer/internal/routes"
+	"github.com/xHacka/nginx-log-analyzer/internal/sessions"
+	"github.com/xHacka/nginx-log-analyzer/internal/threats"
 	"html/template"
 )
 
+const configPath = "config.yaml"
+
 func main() {
-	cfg, err := config.Load("config.yaml")
+	rebuildRollups := flag.Bool("rebuild-rollups", false, "recompute the dashboard rollup tables from stored rows and exit")
+	importArchive := flag.String("import-archive", "", "restore rows from an archive file or directory and exit")
+	rescanThreats := flag.Bool("rescan-threats", false, "re-run attack detection over stored rows with the current rules and exit")
+	sendReport := flag.String("send-report", "", "mail the named report now, covering the last full day or week, and exit")
+	flag.Parse()
+
+	cfg, err := config.Load(configPath)
 	if err != nil {
 		log.Fatalf("config: %v", err)
 	}
+	liveCfg := config.NewLive(cfg)
 
 	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0700); err != nil {
 		log.Fatalf("mkdir: %v", err)
@@ -34,14 +62,78 @@ func main() {
 		log.Fatalf("db: %v", err)
 	}
 	defer sqliteRepo.Close()
-	var repo repository.LogRepository = sqliteRepo
-	rules := ingest.NewFilterRules(
-		cfg.Ignore.WhitelistedIPs,
-		cfg.Ignore.SkipExtensions,
-		cfg.Ignore.SkipMethods,
-		cfg.Ignore.SkipStatusCodes,
-		cfg.Ignore.SkipPathPrefixes,
-	)
+	if *rebuildRollups {
+		if err := sqliteRepo.RebuildRollups(); err != nil {
+			log.Fatalf("rebuild rollups: %v", err)
+		}
+		log.Printf("rebuild rollups: done")
+		return
+	}
+	if *rescanThreats {
+		detector, err := threatDetector(cfg)
+		if err != nil {
+			log.Fatalf("rescan threats: %v", err)
+		}
+		if detector == nil {
+			log.Fatalf("rescan threats: detection is turned off (threats.enabled)")
+		}
+		n, err := sqliteRepo.RescanThreats(detector.Match)
+		if err != nil {
+			log.Fatalf("rescan threats: %v", err)
+		}
+		log.Printf("rescan threats: updated %d rows", n)
+		return
+	}
+	if *importArchive != "" {
+		n, err := restoreArchive(sqliteRepo, *importArchive)
+		if err != nil {
+			log.Fatalf("import archive: %v", err)
+		}
+		log.Printf("import archive: restored %d rows", n)
+		return
+	}
+	tmplReport, err := template.ParseFiles("web/templates/report_email.html")
+	if err != nil {
+		log.Fatalf("templates (report_email.html): %v", err)
+	}
+	if *sendReport != "" {
+		var report *reports.Report
+		for _, r := range reportList(cfg) {
+			if r.Name == *sendReport {
+				report = &r
+			}
+		}
+		if report == nil {
+			log.Fatalf("send report: no report named %q", *sendReport)
+		}
+		if err := reports.Send(sqliteRepo, tmplReport, mailerFor(cfg), *report, time.Now()); err != nil {
+			log.Fatalf("send report: %v", err)
+		}
+		log.Printf("send report: sent %s to %v", report.Name, report.To)
+		return
+	}
+	var stored repository.LogRepository = sqliteRepo
+	var reg *metrics.Registry
+	if cfg.Metrics.Enabled {
+		reg = metrics.New(cfg.DBPath, cfg.Metrics.MaxHosts)
+		stored = &metrics.Repository{LogRepository: sqliteRepo, Metrics: reg}
+	}
+	// Wrapped so live pages hear about every stored batch, whether it
+	// came from tailing or an upload.
+	hub := live.NewHub()
+	var repo repository.LogRepository = &live.Repository{LogRepository: stored, Hub: hub}
+	geo := &geoip.DB{}
+	if err := geo.SetPaths(cfg.GeoIP.CityDB, cfg.GeoIP.ASNDB); err != nil {
+		log.Fatalf("geoip: %v", err)
+	}
+	tracker := sessions.New(time.Duration(cfg.Sessions.TimeoutMinutes) * time.Minute)
+	watcher := incidents.New(repo, incidentRules(cfg))
+	opts, err := ingestOptions(cfg, geo, tracker, watcher, reg)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	liveIngest := ingest.NewLiveOptions(opts)
+	banned := blocklist.New(repo, autoBan(cfg), blocklist.Output{Dir: cfg.Blocklist.Dir, ReloadCommand: cfg.Blocklist.ReloadCommand})
 
 	funcMap := template.FuncMap{
 		"formatTime": func(t float64) string {
@@ -70,16 +162,75 @@ func main() {
 	}
 	tmplDashboard := parseTmpl("dashboard.html")
 	tmplQuery := parseTmpl("query.html")
+	tmplRoutes := parseTmpl("routes.html")
+	tmplSources := parseTmpl("sources.html")
+	tmplParams := parseTmpl("params.html")
+	tmplSessions := parseTmpl("sessions.html")
+	tmplIP := parseTmpl("ip.html")
+	tmplDrilldown := parseTmpl("drilldown.html")
+	tmplAlerts := parseTmpl("alerts.html")
+	tmplSecurity := parseTmpl("security.html")
+	tmplBlocklist := parseTmpl("blocklist.html")
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
 	dh := &handlers.DashboardHandler{Repo: repo, Template: tmplDashboard, UploadEnabled: cfg.UploadEnabled}
-	qh := &handlers.QueryHandler{Repo: repo, Template: tmplQuery, UploadEnabled: cfg.UploadEnabled, DefaultPageSize: cfg.PageSize}
-	uh := &handlers.UploadHandler{Repo: repo, Rules: rules}
+	qh := &handlers.QueryHandler{Repo: repo, Template: tmplQuery, UploadEnabled: cfg.UploadEnabled, Config: liveCfg}
+	rh := &handlers.RoutesHandler{Repo: repo, Template: tmplRoutes, UploadEnabled: cfg.UploadEnabled}
+	sh := &handlers.SourcesHandler{Repo: repo, Template: tmplSources, UploadEnabled: cfg.UploadEnabled}
+	sech := &handlers.SecurityHandler{Repo: repo, Template: tmplSecurity, UploadEnabled: cfg.UploadEnabled, Ingest: liveIngest}
+	ph := &handlers.ParamsHandler{Repo: repo, Template: tmplParams, UploadEnabled: cfg.UploadEnabled}
+	seh := &handlers.SessionsHandler{Repo: repo, Template: tmplSessions, UploadEnabled: cfg.UploadEnabled}
+	ih := &handlers.IPHandler{Repo: repo, Template: tmplIP, UploadEnabled: cfg.UploadEnabled}
+	pah := &handlers.PathHandler{Repo: repo, Template: tmplDrilldown, UploadEnabled: cfg.UploadEnabled}
+	hh := &handlers.HostHandler{Repo: repo, Template: tmplDrilldown, UploadEnabled: cfg.UploadEnabled}
+	eh := &handlers.EventsHandler{Repo: repo, Hub: hub, Template: tmplQuery}
+	xh := &handlers.ExportHandler{Repo: repo}
+	ah := &handlers.APIHandler{Repo: repo}
+	uh := &handlers.UploadHandler{Repo: repo, Ingest: liveIngest}
+	alh := &handlers.AlertsHandler{Repo: repo, Template: tmplAlerts, UploadEnabled: cfg.UploadEnabled, Config: liveCfg}
+	blh := &handlers.BlocklistHandler{List: banned, Repo: repo, Template: tmplBlocklist, UploadEnabled: cfg.UploadEnabled}
 	r.Get("/", dh.ServeHTTP)
 	r.Get("/query", qh.ServeHTTP)
+	r.Get("/routes", rh.ServeHTTP)
+	r.Get("/sources", sh.ServeHTTP)
+	r.Get("/security", sech.ServeHTTP)
+	r.Get("/params", ph.ServeHTTP)
+	r.Get("/sessions", seh.ServeHTTP)
+	r.Get("/ip/{addr}", ih.ServeHTTP)
+	r.Get("/path", pah.ServeHTTP)
+	r.Get("/host/{host}", hh.ServeHTTP)
+	r.Get("/events", eh.ServeHTTP)
+	r.Get("/export", xh.ServeHTTP)
+	if reg != nil {
+		r.Get("/metrics", reg.ServeHTTP)
+	}
+	r.Route("/api/v1", func(api chi.Router) {
+		api.NotFound(ah.NotFound)
+		api.MethodNotAllowed(ah.MethodNotAllowed)
+		api.Get("/entries", ah.Entries)
+		api.Get("/stats", ah.Stats)
+		api.Get("/aggregate", ah.Aggregate)
+		api.Get("/openapi.json", ah.OpenAPI)
+	})
+	r.Route("/alerts", func(sub chi.Router) {
+		sub.Use(csrf.Protect)
+		sub.Get("/", alh.ServeHTTP)
+		sub.Post("/silences", alh.CreateSilence)
+		sub.Post("/silences/{id}/expire", alh.ExpireSilence)
+	})
+	r.Route("/blocklist", func(sub chi.Router) {
+		sub.Use(csrf.Protect)
+		sub.Get("/", blh.ServeHTTP)
+		sub.Post("/bans", blh.CreateBan)
+		sub.Post("/bans/{id}/lift", blh.LiftBan)
+		sub.Get("/"+blocklist.DenyFile, blh.Feed("deny"))
+		sub.Get("/"+blocklist.GeoFile, blh.Feed("geo"))
+		sub.Get("/"+blocklist.TextFile, blh.Feed("text"))
+		sub.Get("/"+blocklist.Fail2banLog, blh.Fail2banLog)
+	})
 	if cfg.UploadEnabled {
 		r.Route("/upload", func(sub chi.Router) {
 			sub.Use(csrf.Protect)
@@ -92,46 +243,452 @@ func main() {
 
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("web/static"))))
 
-	// Retention job
-	stopRetention := make(chan struct{})
+	// Retention job. retentionNow lets a config reload apply changed
+	// retention settings without waiting for the next tick.
+	stopJobs := make(chan struct{})
+	retentionNow := make(chan struct{}, 1)
 	go func() {
 		ticker := time.NewTicker(6 * time.Hour)
 		defer ticker.Stop()
 		for {
 			select {
-			case <-stopRetention:
+			case <-stopJobs:
+				return
+			case <-ticker.C:
+			case <-retentionNow:
+			}
+			cfg := liveCfg.Get()
+			var archiver repository.Archiver
+			if cfg.Archive.Dir != "" {
+				w := archive.NewWriter(cfg.Archive.Dir)
+				w.Scrub = privacyScrub(cfg.Privacy, tracker)
+				archiver = w
+			}
+			if n, err := repo.ApplyRetention(retentionPolicy(cfg), archiver); err != nil {
+				log.Printf("retention: %v", err)
+			} else {
+				log.Printf("retention: deleted %d entries", n)
+			}
+			if cfg.Archive.Dir != "" && cfg.Archive.KeepDays > 0 {
+				cutoff := time.Now().Add(-time.Duration(cfg.Archive.KeepDays) * 24 * time.Hour)
+				if n, err := archive.Prune(cfg.Archive.Dir, cutoff); err != nil {
+					log.Printf("archive: %v", err)
+				} else if n > 0 {
+					log.Printf("archive: removed %d files older than %v", n, cutoff)
+				}
+			}
+		}
+	}()
+
+	go geo.Watch(stopJobs)
+
+	// Alert rules are checked against the rows of the last few minutes;
+	// the interval is re-read each round so reloads apply to the next one.
+	alerter, err := alerts.NewManager(repo)
+	if err != nil {
+		log.Fatalf("alerts: %v", err)
+	}
+	alerter.SetRules(alertRules(cfg))
+	go func() {
+		for {
+			select {
+			case <-stopJobs:
+				return
+			case <-time.After(time.Duration(liveCfg.Get().Alerts.IntervalSeconds) * time.Second):
+			}
+			alerter.Evaluate(time.Now())
+		}
+	}()
+
+	// Scheduled reports, checked every minute.
+	reporter := reports.NewScheduler(repo, tmplReport)
+	reporter.Set(reportList(cfg), mailerFor(cfg), time.Now())
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopJobs:
+				return
+			case now := <-ticker.C:
+				reporter.Run(now)
+			}
+		}
+	}()
+
+	// Blocklist: ban the sources of recent detections and rewrite the list
+	// files when bans start or expire.
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			if n, err := banned.AutoBan(now); err != nil {
+				log.Printf("blocklist: %v", err)
+			} else if n > 0 {
+				log.Printf("blocklist: banned or extended %d addresses", n)
+			}
+			if err := banned.Refresh(now); err != nil {
+				log.Printf("blocklist: %v", err)
+			}
+			select {
+			case <-stopJobs:
 				return
 			case <-ticker.C:
-				cutoff := time.Now().Add(-time.Duration(cfg.RetentionDays) * 24 * time.Hour)
-				if err := repo.DeleteOlderThan(cutoff); err != nil {
-					log.Printf("retention: %v", err)
-				} else {
-					log.Printf("retention: deleted entries older than %v", cutoff)
+			}
+		}
+	}()
+
+	// Delayed anonymization: rows are kept raw for anonymize_after_days and
+	// then rewritten in place.
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			p := liveCfg.Get().Privacy
+			if p.AnonymizeAfterDays > 0 {
+				if scrub := privacyScrub(p, tracker); scrub != nil {
+					cutoff := time.Now().Add(-time.Duration(p.AnonymizeAfterDays) * 24 * time.Hour)
+					if n, err := repo.AnonymizeOlderThan(cutoff, scrub); err != nil {
+						log.Printf("anonymize: %v", err)
+					} else if n > 0 {
+						log.Printf("anonymize: rewrote %d entries older than %v", n, cutoff)
+					}
 				}
 			}
+			select {
+			case <-stopJobs:
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
+	// Config reload: validate the new file first and keep the running
+	// config if it is invalid. Settings bound at startup (listen, db_path,
+	// log_path, upload_enabled, metrics) still require a restart.
+	var reloadMu sync.Mutex
+	reload := func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		next, err := config.Load(configPath)
+		if err != nil {
+			log.Printf("config reload: keeping current config: %v", err)
+			return
+		}
+		prev := liveCfg.Get()
+		if next.Listen != prev.Listen || next.DBPath != prev.DBPath || next.LogPath != prev.LogPath || next.UploadEnabled != prev.UploadEnabled || next.Metrics != prev.Metrics {
+			log.Printf("config reload: listen, db_path, log_path, upload_enabled and metrics changes need a restart")
+		}
+		opts, err := ingestOptions(next, geo, tracker, watcher, reg)
+		if err != nil {
+			log.Printf("config reload: keeping current config: %v", err)
+			return
+		}
+		if err := geo.SetPaths(next.GeoIP.CityDB, next.GeoIP.ASNDB); err != nil {
+			log.Printf("config reload: keeping current config: geoip: %v", err)
+			return
+		}
+		tracker.SetTimeout(time.Duration(next.Sessions.TimeoutMinutes) * time.Minute)
+		watcher.SetRules(incidentRules(next))
+		liveIngest.Set(opts)
+		liveCfg.Set(next)
+		alerter.SetRules(alertRules(next))
+		reporter.Set(reportList(next), mailerFor(next), time.Now())
+		banned.Set(autoBan(next), blocklist.Output{Dir: next.Blocklist.Dir, ReloadCommand: next.Blocklist.ReloadCommand})
+		if err := banned.Refresh(time.Now()); err != nil {
+			log.Printf("blocklist: %v", err)
+		}
+		if next.RetentionDays != prev.RetentionDays || !reflect.DeepEqual(next.Retention, prev.Retention) || next.Archive != prev.Archive {
+			select {
+			case retentionNow <- struct{}{}:
+			default:
+			}
+		}
+		log.Printf("config reload: applied %s", configPath)
+	}
+
 	// Local file tailing
 	if cfg.LogPath != "" {
 		stopTail := make(chan struct{})
 		go func() {
-			if err := ingest.ReadFullFileAndTail(cfg.LogPath, repo, rules, stopTail); err != nil {
+			if err := ingest.ReadFullFileAndTail(cfg.LogPath, repo, liveIngest, stopTail); err != nil {
 				log.Printf("tail: %v", err)
 			}
 		}()
 		defer close(stopTail)
 	}
 
+	stopWatch := make(chan struct{})
+	if cfg.WatchConfig {
+		go func() {
+			if err := config.Watch(configPath, stopWatch, reload); err != nil {
+				log.Printf("config watch: %v", err)
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: r}
+	srv.RegisterOnShutdown(hub.Close)
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-sigCh
-		close(stopRetention)
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			close(stopJobs)
+			close(stopWatch)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+			return
+		}
 	}()
 
 	log.Printf("Listening on %s", cfg.Listen)
-	if err := http.ListenAndServe(cfg.Listen, r); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("server: %v", err)
 	}
 }
+
+func ingestOptions(cfg *config.Config, geo *geoip.DB, tracker *sessions.Tracker, watcher *incidents.Detector, reg *metrics.Registry) (*ingest.Options, error) {
+	sampling := make([]ingest.SamplingRule, len(cfg.Sampling))
+	for i, s := range cfg.Sampling {
+		sampling[i] = ingest.SamplingRule{Host: s.Host, PathPrefix: s.PathPrefix, KeepOneIn: s.KeepOneIn, KeepErrors: s.KeepErrors}
+	}
+	normalizer, err := routes.New(cfg.Routes.Templates, cfg.Routes.AutoNormalize)
+	if err != nil {
+		return nil, err
+	}
+	detector, err := threatDetector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := &ingest.Options{
+		Rules: ingest.NewFilterRules(
+			cfg.Ignore.WhitelistedIPs,
+			cfg.Ignore.SkipExtensions,
+			cfg.Ignore.SkipMethods,
+			cfg.Ignore.SkipStatusCodes,
+			cfg.Ignore.SkipPathPrefixes,
+		),
+		Sampling:  ingest.NewSampler(sampling),
+		GeoIP:     geo,
+		Routes:    normalizer,
+		Threats:   detector,
+		Sessions:  tracker,
+		Incidents: watcher,
+		Metrics:   reg,
+	}
+	anon, err := privacy.New(cfg.Privacy.IPMode, cfg.Privacy.HMACKey, cfg.Privacy.StripQueryParams)
+	if err != nil {
+		return nil, err
+	}
+	opts.Privacy = anon
+	opts.PrivacyDelay = time.Duration(cfg.Privacy.AnonymizeAfterDays) * 24 * time.Hour
+	return opts, nil
+}
+
+// threatDetector loads the attack rules, or returns nil if detection is off.
+func threatDetector(cfg *config.Config) (*threats.Detector, error) {
+	if !cfg.Threats.Enabled {
+		return nil, nil
+	}
+	d, err := threats.Load(cfg.Threats.RulesFile, cfg.Threats.DisabledRules)
+	if err != nil {
+		return nil, fmt.Errorf("threats: %w", err)
+	}
+	return d, nil
+}
+
+// incidentRules converts the enabled behaviour detectors.
+func incidentRules(cfg *config.Config) []incidents.Rule {
+	if !cfg.Incidents.Enabled {
+		return nil
+	}
+	var rules []incidents.Rule
+	for _, d := range []struct {
+		kind string
+		cfg  config.DetectorConfig
+	}{
+		{incidents.NotFound, cfg.Incidents.NotFound},
+		{incidents.LoginFailures, cfg.Incidents.LoginFailures},
+		{incidents.RequestRate, cfg.Incidents.RequestRate},
+		{incidents.ErrorRatio, cfg.Incidents.ErrorRatio},
+	} {
+		if d.cfg.Threshold <= 0 {
+			continue
+		}
+		rules = append(rules, incidents.Rule{
+			Kind:        d.kind,
+			Window:      time.Duration(d.cfg.WindowMinutes) * time.Minute,
+			Threshold:   d.cfg.Threshold,
+			MinRequests: d.cfg.MinRequests,
+			Paths:       d.cfg.Paths,
+		})
+	}
+	return rules
+}
+
+// privacyScrub returns what the delayed anonymization job does to a row, or
+// nil if the privacy settings change nothing. Session ids are rehashed so
+// they cannot be matched against those of rows not scrubbed yet.
+func privacyScrub(p config.PrivacyConfig, tracker *sessions.Tracker) func(e *models.LogEntry) {
+	anon, err := privacy.New(p.IPMode, p.HMACKey, p.StripQueryParams)
+	if err != nil || !anon.Enabled() {
+		return nil
+	}
+	return func(e *models.LogEntry) {
+		anon.Apply(e)
+		e.SessionID = tracker.Rekey(e.SessionID)
+	}
+}
+
+// autoBan converts the automatic ban policy; exempt ranges are already
+// validated by config.Load.
+func autoBan(cfg *config.Config) blocklist.Auto {
+	a := cfg.Blocklist.Auto
+	auto := blocklist.Auto{
+		Incidents:   a.Incidents,
+		Threats:     a.Threats,
+		MinRequests: a.MinRequests,
+		Window:      time.Duration(a.WindowMinutes) * time.Minute,
+		Duration:    time.Duration(a.DurationHours) * time.Hour,
+	}
+	for _, e := range a.Exempt {
+		if p, err := blocklist.ParsePrefix(e); err == nil {
+			auto.Exempt = append(auto.Exempt, p)
+		}
+	}
+	// Detections only see addresses as stored, which are anonymized at
+	// ingest unless anonymization is delayed.
+	if cfg.Privacy.AnonymizeAfterDays == 0 {
+		switch cfg.Privacy.IPMode {
+		case privacy.IPModeTruncate:
+			auto.Truncated = true
+		case privacy.IPModeHMAC:
+			if len(auto.Incidents) > 0 || auto.Threats != "" {
+				log.Printf("blocklist: automatic bans are off: privacy.ip_mode hmac stores pseudonyms, not addresses")
+				auto.Incidents, auto.Threats = nil, ""
+			}
+		}
+	}
+	return auto
+}
+
+func retentionPolicy(cfg *config.Config) repository.RetentionPolicy {
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	p := repository.RetentionPolicy{
+		Raw:           days(cfg.RetentionDays),
+		HourlyRollups: days(cfg.Retention.HourlyRollupDays),
+		DailyRollups:  days(cfg.Retention.DailyRollupDays),
+	}
+	for _, o := range cfg.Retention.Overrides {
+		// Already validated by config.Load.
+		lo, hi, _ := o.StatusRange()
+		p.Overrides = append(p.Overrides, repository.RetentionOverride{Host: o.Host, StatusMin: lo, StatusMax: hi, Keep: days(o.Days)})
+	}
+	return p
+}
+
+func alertRules(cfg *config.Config) []alerts.Rule {
+	notifiers := make(map[string]alerts.Notifier)
+	var all []alerts.Notifier
+	for _, n := range cfg.Alerts.Notifiers {
+		var notifier alerts.Notifier = &alerts.Webhook{ID: n.Name, Format: n.Type, URL: n.URL}
+		if n.Type == "email" {
+			notifier = &alerts.Email{ID: n.Name, Mailer: mailerFor(cfg), To: n.To}
+		}
+		notifiers[n.Name] = notifier
+		all = append(all, notifier)
+	}
+	rules := make([]alerts.Rule, len(cfg.Alerts.Rules))
+	for i, a := range cfg.Alerts.Rules {
+		// Already validated by config.Load.
+		lo, hi, _ := a.StatusRange()
+		rules[i] = alerts.Rule{
+			Name:        a.Name,
+			Metric:      a.Metric,
+			Host:        a.Host,
+			StatusMin:   lo,
+			StatusMax:   hi,
+			Window:      time.Duration(a.WindowMinutes) * time.Minute,
+			Above:       a.Above,
+			Below:       a.Below,
+			Change:      a.Change,
+			MinRequests: a.MinRequests,
+			Notify:      all,
+		}
+		if len(a.Notify) > 0 {
+			rules[i].Notify = nil
+			for _, name := range a.Notify {
+				rules[i].Notify = append(rules[i].Notify, notifiers[name])
+			}
+		}
+	}
+	return rules
+}
+
+// mailerFor returns the configured SMTP server, or nil if there is none.
+func mailerFor(cfg *config.Config) *mailer.Mailer {
+	if cfg.SMTP.Host == "" {
+		return nil
+	}
+	return &mailer.Mailer{
+		Host:     cfg.SMTP.Host,
+		Port:     cfg.SMTP.Port,
+		Username: cfg.SMTP.Username,
+		Password: cfg.SMTP.Password,
+		From:     cfg.SMTP.From,
+		TLS:      cfg.SMTP.TLS,
+	}
+}
+
+func reportList(cfg *config.Config) []reports.Report {
+	list := make([]reports.Report, len(cfg.Reports))
+	for i, r := range cfg.Reports {
+		// Already validated by config.Load.
+		weekday, _ := r.ReportWeekday()
+		list[i] = reports.Report{Name: r.Name, Weekly: r.Period == "weekly", Weekday: weekday, Hour: r.Hour, Host: r.Host, To: r.To}
+	}
+	return list
+}
+
+// restoreArchive loads every row of the archive file, or of the daily
+// archives in the directory, at path and returns how many were new.
+func restoreArchive(repo repository.LogRepository, path string) (int, error) {
+	files, err := archive.Files(path)
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	batch := make([]models.LogEntry, 0, 1000)
+	flush := func() error {
+		if err := repo.RestoreBatch(batch); err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if e.ID != 0 {
+				restored++
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for _, f := range files {
+		err := archive.Read(f, func(e models.LogEntry) error {
+			batch = append(batch, e)
+			if len(batch) == cap(batch) {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return restored, err
+		}
+	}
+	return restored, flush()
+}
@@ -0,0 +1,446 @@
+package alerts
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// ipLimit caps how many client addresses an ip_requests rule looks at per
+// evaluation; only the busiest can be above the threshold anyway.
+const ipLimit = 100
+
+// Rule is one alert condition. See config.AlertRule for the meaning of the
+// fields.
+type Rule struct {
+	Name        string
+	Metric      string // "requests", "error_rate" or "ip_requests"
+	Host        string
+	StatusMin   int // 0 = all statuses
+	StatusMax   int
+	Window      time.Duration
+	Above       *float64
+	Below       *float64
+	Change      bool
+	MinRequests int64
+	Notify      []Notifier
+}
+
+// Alert is a notification about one rule, and for ip_requests one address,
+// starting or stopping to fire.
+type Alert struct {
+	Rule     string     `json:"rule"`
+	Status   string     `json:"status"` // "firing" or "resolved"
+	Host     string     `json:"host,omitempty"`
+	Subject  string     `json:"subject,omitempty"` // client address for ip_requests
+	Metric   string     `json:"metric"`
+	Value    float64    `json:"value"`
+	Summary  string     `json:"summary"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"` // nil while firing
+}
+
+// Manager evaluates rules against the repository and records each episode
+// of a rule firing as an alert event. Every episode is announced once when
+// it starts, or when a silence covering it ends, and once when it resolves.
+type Manager struct {
+	Repo repository.LogRepository
+
+	mu      sync.Mutex
+	rules   []Rule
+	firing  map[string]*repository.AlertEvent // by rule name and subject
+	senders map[string]*sender                // by rule name
+}
+
+// NewManager returns a Manager that carries on with the alerts left firing
+// by a previous run.
+func NewManager(repo repository.LogRepository) (*Manager, error) {
+	m := &Manager{Repo: repo, firing: make(map[string]*repository.AlertEvent), senders: make(map[string]*sender)}
+	open, err := repo.AlertEvents(true, 100000)
+	if err != nil {
+		return nil, err
+	}
+	for i := range open {
+		m.firing[alertKey(open[i].Rule, open[i].Subject)] = &open[i]
+	}
+	return m, nil
+}
+
+func alertKey(rule, subject string) string {
+	return rule + "\x00" + subject
+}
+
+// SetRules replaces the rules. Alerts of rules that still exist keep firing
+// without being announced again; those of removed rules are closed quietly.
+func (m *Manager) SetRules(rules []Rule) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		names[r.Name] = true
+	}
+	now := epoch(time.Now())
+	for key, e := range m.firing {
+		if !names[e.Rule] {
+			e.ResolvedAt = now
+			if err := m.Repo.UpdateAlert(*e); err != nil {
+				log.Printf("alerts: %s: %v", e.Rule, err)
+			}
+			delete(m.firing, key)
+		}
+	}
+	m.rules = rules
+}
+
+// Evaluate checks every rule for the window ending at now, records alerts
+// that started or stopped firing and notifies about those not silenced. A
+// rule whose query fails keeps its previous state.
+func (m *Manager) Evaluate(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	silences, err := m.Repo.Silences(now)
+	if err != nil {
+		log.Printf("alerts: silences: %v", err)
+	}
+	for _, rule := range m.rules {
+		values, err := m.measure(rule, now)
+		if err != nil {
+			log.Printf("alerts: %s: %v", rule.Name, err)
+			continue
+		}
+		for subject, v := range values {
+			e := m.firing[alertKey(rule.Name, subject)]
+			switch {
+			case rule.breached(v) && e == nil:
+				m.open(rule, subject, v, now)
+			case !rule.breached(v) && e != nil:
+				m.resolve(rule, e, v, rule.describe(subject, v), now)
+			}
+		}
+		// Addresses missing from the busiest list made no requests, or
+		// too few to be listed. A change rule with nothing to compare
+		// against has no value at all.
+		if values != nil {
+			for _, e := range m.firing {
+				if _, ok := values[e.Subject]; e.Rule == rule.Name && !ok {
+					summary := rule.describe(e.Subject, 0)
+					switch {
+					case rule.Change:
+						summary = fmt.Sprintf("no requests on %s in the %s before the last %s to compare with", rule.hostLabel(), formatWindow(rule.Window), formatWindow(rule.Window))
+					case len(values) == ipLimit:
+						summary = fmt.Sprintf("%s is no longer among the %d busiest addresses on %s over %s", e.Subject, ipLimit, rule.hostLabel(), formatWindow(rule.Window))
+					}
+					m.resolve(rule, e, 0, summary, now)
+				}
+			}
+		}
+		for _, e := range m.firing {
+			if e.Rule != rule.Name || e.Notified || Silenced(silences, e, now) {
+				continue
+			}
+			e.Notified = true
+			if err := m.Repo.UpdateAlert(*e); err != nil {
+				log.Printf("alerts: %s: %v", rule.Name, err)
+			}
+			m.send(rule, Alert{Rule: e.Rule, Status: "firing", Host: e.Host, Subject: e.Subject, Metric: e.Metric,
+				Value: e.Value, Summary: e.Summary, StartsAt: fromEpoch(e.StartedAt)})
+		}
+	}
+}
+
+func (m *Manager) open(rule Rule, subject string, v float64, now time.Time) {
+	e := &repository.AlertEvent{
+		Rule:      rule.Name,
+		Host:      rule.Host,
+		Subject:   subject,
+		Metric:    rule.Metric,
+		Value:     v,
+		Summary:   rule.describe(subject, v),
+		Query:     rule.queryLink(subject, now.Add(-rule.Window), now),
+		StartedAt: epoch(now),
+	}
+	// Not tracked if it cannot be stored, so the next round tries again.
+	if err := m.Repo.OpenAlert(e); err != nil {
+		log.Printf("alerts: %s: %v", rule.Name, err)
+		return
+	}
+	log.Printf("alerts: firing %s: %s", e.Rule, e.Summary)
+	m.firing[alertKey(rule.Name, subject)] = e
+}
+
+// resolve closes e. Its resolution is only announced if its start was.
+func (m *Manager) resolve(rule Rule, e *repository.AlertEvent, v float64, summary string, now time.Time) {
+	e.ResolvedAt, e.ResolvedValue = epoch(now), v
+	e.Query = rule.queryLink(e.Subject, fromEpoch(e.StartedAt).Add(-rule.Window), now)
+	if err := m.Repo.UpdateAlert(*e); err != nil {
+		log.Printf("alerts: %s: %v", rule.Name, err)
+	}
+	delete(m.firing, alertKey(e.Rule, e.Subject))
+	log.Printf("alerts: resolved %s: %s", e.Rule, summary)
+	if e.Notified {
+		end := now
+		m.send(rule, Alert{Rule: e.Rule, Status: "resolved", Host: e.Host, Subject: e.Subject, Metric: e.Metric,
+			Value: v, Summary: summary, StartsAt: fromEpoch(e.StartedAt), EndsAt: &end})
+	}
+}
+
+// Silenced reports whether a silence active at now matches e. A host
+// silence matches rules whose host filter includes that host; rules without
+// one sum up all hosts, so it never matches those, and the silence form
+// rejects host silences no rule could match.
+func Silenced(silences []repository.Silence, e *repository.AlertEvent, now time.Time) bool {
+	t := epoch(now)
+	for _, s := range silences {
+		if s.StartsAt > t || s.EndsAt <= t {
+			continue
+		}
+		if s.Rule != "" && s.Rule != e.Rule {
+			continue
+		}
+		if s.Host != "" && !hostIncluded(e.Host, s.Host) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func hostIncluded(filter, host string) bool {
+	for _, h := range strings.Split(filter, ",") {
+		if strings.EqualFold(strings.TrimSpace(h), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryLink returns a /query link to the rows the rule looked at between
+// from and to, widened to whole minutes.
+func (r Rule) queryLink(subject string, from, to time.Time) string {
+	end := to.UTC().Truncate(time.Minute)
+	if end.Before(to) {
+		end = end.Add(time.Minute)
+	}
+	q := url.Values{}
+	q.Set("time_from", from.UTC().Truncate(time.Minute).Format("2006-01-02T15:04"))
+	q.Set("time_to", end.Format("2006-01-02T15:04"))
+	if r.Host != "" {
+		q.Set("host", r.Host)
+	}
+	if r.StatusMin != 0 && r.Metric != "ip_requests" {
+		q.Set("status", statusLabel(r.StatusMin, r.StatusMax))
+	}
+	if subject != "" {
+		q.Set("ip", subject)
+	}
+	return "/query?" + q.Encode()
+}
+
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func fromEpoch(f float64) time.Time {
+	return time.Unix(0, int64(f*1e9))
+}
+
+// measure returns the rule's value per subject, "" for host-wide metrics.
+// It returns nil when there is not enough traffic to judge, and an empty map
+// when a change rule's previous window had no matching requests, since no
+// change can be computed and an alert left firing should resolve.
+func (m *Manager) measure(rule Rule, now time.Time) (map[string]float64, error) {
+	if rule.Metric == "ip_requests" {
+		from := now.Add(-rule.Window)
+		groups, err := m.Repo.Aggregate(repository.QueryFilters{TimeFrom: &from, TimeTo: &now, Host: rule.Host}, "remote_addr", ipLimit)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]float64, len(groups))
+		for _, g := range groups {
+			values[g.Key] = float64(g.Requests)
+		}
+		return values, nil
+	}
+	v, ok, err := m.windowValue(rule, now.Add(-rule.Window), now)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if rule.Change {
+		prev, ok, err := m.windowValue(rule, now.Add(-2*rule.Window), now.Add(-rule.Window))
+		if err != nil || !ok {
+			return nil, err
+		}
+		if prev == 0 {
+			return map[string]float64{}, nil
+		}
+		v = (v - prev) / prev * 100
+	}
+	return map[string]float64{"": v}, nil
+}
+
+// windowValue returns a requests or error_rate rule's value between from and
+// to, and false if the window has fewer than MinRequests requests.
+func (m *Manager) windowValue(rule Rule, from, to time.Time) (float64, bool, error) {
+	groups, err := m.Repo.Aggregate(repository.QueryFilters{TimeFrom: &from, TimeTo: &to, Host: rule.Host}, "status", 1000)
+	if err != nil {
+		return 0, false, err
+	}
+	var total, matched int64
+	for _, g := range groups {
+		total += g.Requests
+		status, _ := strconv.Atoi(g.Key)
+		if rule.StatusMin == 0 || (status >= rule.StatusMin && status <= rule.StatusMax) {
+			matched += g.Requests
+		}
+	}
+	if total < rule.MinRequests {
+		return 0, false, nil
+	}
+	if rule.Metric == "error_rate" {
+		if total == 0 {
+			return 0, true, nil
+		}
+		return float64(matched) / float64(total) * 100, true, nil
+	}
+	return float64(matched), true, nil
+}
+
+func (r Rule) breached(v float64) bool {
+	return (r.Above != nil && v > *r.Above) || (r.Below != nil && v < *r.Below)
+}
+
+// describe returns a one-line summary such as
+// "5xx rate on api.example.com is 3.1% over 5m (alert when above 2%)".
+func (r Rule) describe(subject string, v float64) string {
+	host := r.hostLabel()
+	statuses := "requests"
+	if r.StatusMin != 0 {
+		statuses = statusLabel(r.StatusMin, r.StatusMax) + " requests"
+	}
+	unit := ""
+	what := statuses + " on " + host
+	switch {
+	case r.Metric == "ip_requests":
+		what = "requests from " + subject + " to " + host
+	case r.Metric == "error_rate":
+		what = statusLabel(r.StatusMin, r.StatusMax) + " rate on " + host
+		unit = "%"
+	}
+	verb := "are"
+	if r.Metric == "error_rate" {
+		verb = "is"
+	}
+	if r.Change {
+		verb, unit = "changed by", "%"
+	}
+	var limits []string
+	if r.Above != nil {
+		limits = append(limits, "above "+formatValue(*r.Above)+unit)
+	}
+	if r.Below != nil {
+		limits = append(limits, "below "+formatValue(*r.Below)+unit)
+	}
+	window := "over " + formatWindow(r.Window)
+	if r.Change {
+		window += " vs the " + formatWindow(r.Window) + " before"
+	}
+	cond := limits[0]
+	if len(limits) == 2 {
+		cond += " or " + limits[1]
+	}
+	return fmt.Sprintf("%s %s %s%s %s (alert when %s)", what, verb, formatValue(v), unit, window, cond)
+}
+
+func (r Rule) hostLabel() string {
+	if r.Host == "" {
+		return "all hosts"
+	}
+	return r.Host
+}
+
+func statusLabel(lo, hi int) string {
+	if lo == hi {
+		return strconv.Itoa(lo)
+	}
+	if lo%100 == 0 && hi == lo+99 {
+		return strconv.Itoa(lo/100) + "xx"
+	}
+	return strconv.Itoa(lo) + "-" + strconv.Itoa(hi)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(math.Round(v*10)/10, 'f', -1, 64)
+}
+
+func formatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
+
+// sender delivers one rule's notifications in the order they were sent, so
+// a resolution retried quickly cannot overtake the start it ends.
+type sender struct {
+	mu      sync.Mutex
+	queue   []queued
+	running bool
+}
+
+type queued struct {
+	alert  Alert
+	notify []Notifier
+}
+
+// send queues a for every notifier of the rule and delivers it in the
+// background, so a slow endpoint does not hold up evaluation. The caller
+// holds mu.
+func (m *Manager) send(rule Rule, a Alert) {
+	s := m.senders[rule.Name]
+	if s == nil {
+		s = &sender{}
+		m.senders[rule.Name] = s
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, queued{alert: a, notify: rule.Notify})
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+}
+
+// run delivers queued alerts until the queue is empty. The notifiers of one
+// alert are called in parallel; the next alert waits for all of them.
+func (s *sender) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		q := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, n := range q.notify {
+			wg.Add(1)
+			go func(n Notifier) {
+				defer wg.Done()
+				if err := n.Notify(q.alert); err != nil {
+					log.Printf("alerts: notify %s: %v", n.Name(), err)
+				}
+			}(n)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,129 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/mailer"
+)
+
+// Notifier delivers alerts somewhere.
+type Notifier interface {
+	Name() string
+	Notify(a Alert) error
+}
+
+// Webhook posts alerts as JSON to a URL. Format "webhook" sends the Alert
+// itself; "slack" and "teams" send the message shapes their incoming
+// webhooks expect.
+type Webhook struct {
+	ID     string
+	Format string // "webhook", "slack" or "teams"
+	URL    string
+	Client *http.Client // nil uses a client with a 10 second timeout
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (w *Webhook) Name() string {
+	return w.ID
+}
+
+// Notify posts a, retrying twice on network errors and 5xx responses.
+func (w *Webhook) Notify(a Alert) error {
+	body, err := json.Marshal(w.payload(a))
+	if err != nil {
+		return err
+	}
+	client := w.Client
+	if client == nil {
+		client = defaultClient
+	}
+	for attempt := 1; ; attempt++ {
+		err = post(client, w.URL, body)
+		if err == nil || attempt == 3 {
+			return err
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+}
+
+type permanentError struct{ error }
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	case resp.StatusCode >= 300:
+		return permanentError{fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))}
+	}
+	return nil
+}
+
+func (w *Webhook) payload(a Alert) interface{} {
+	switch w.Format {
+	case "slack":
+		return map[string]string{"text": title(a) + "\n" + a.Summary}
+	case "teams":
+		color := "D63333"
+		if a.Status == "resolved" {
+			color = "2EB67D"
+		}
+		return map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": color,
+			"summary":    title(a),
+			"title":      title(a),
+			"text":       a.Summary,
+		}
+	}
+	return a
+}
+
+func title(a Alert) string {
+	return "[" + strings.ToUpper(a.Status) + "] " + a.Rule
+}
+
+// Email sends alerts as plain text mail.
+type Email struct {
+	ID     string
+	Mailer *mailer.Mailer
+	To     []string
+}
+
+func (e *Email) Name() string {
+	return e.ID
+}
+
+func (e *Email) Notify(a Alert) error {
+	var b strings.Builder
+	b.WriteString(a.Summary + "\n\n")
+	fmt.Fprintf(&b, "Rule:    %s\n", a.Rule)
+	fmt.Fprintf(&b, "Status:  %s\n", a.Status)
+	if a.Host != "" {
+		fmt.Fprintf(&b, "Host:    %s\n", a.Host)
+	}
+	if a.Subject != "" {
+		fmt.Fprintf(&b, "Client:  %s\n", a.Subject)
+	}
+	fmt.Fprintf(&b, "Started: %s\n", a.StartsAt.Format(time.RFC1123))
+	if a.EndsAt != nil {
+		fmt.Fprintf(&b, "Ended:   %s\n", a.EndsAt.Format(time.RFC1123))
+	}
+	return e.Mailer.Send(mailer.Message{To: e.To, Subject: title(a) + ": " + a.Summary, Text: b.String()})
+}
@@ -0,0 +1,234 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+const (
+	prefix = "access-"
+	suffix = ".ndjson.gz"
+	layout = "2006-01-02"
+)
+
+// Writer appends rows to one gzip-compressed NDJSON file per UTC day
+// (access-2006-01-02.ndjson.gz). Each Commit adds a new gzip member to the
+// files it touched, so a day that expires in several runs still ends up in
+// one file that any gzip reader can stream.
+type Writer struct {
+	// Scrub, if set, anonymizes rows that were not anonymized yet before
+	// they are written, so an archive never holds what the database would
+	// no longer keep.
+	Scrub func(e *models.LogEntry)
+
+	dir   string
+	parts map[string]*part
+}
+
+type part struct {
+	path   string
+	offset int64 // file size before this run
+	f      *os.File
+	gz     *gzip.Writer
+	enc    *json.Encoder
+	rows   int64
+}
+
+func NewWriter(dir string) *Writer {
+	return &Writer{dir: dir, parts: make(map[string]*part)}
+}
+
+// Add writes e to the file of its day.
+func (w *Writer) Add(e models.LogEntry) error {
+	day := time.Unix(int64(e.Time), 0).UTC().Format(layout)
+	p := w.parts[day]
+	if p == nil {
+		var err error
+		if p, err = w.open(day); err != nil {
+			return err
+		}
+		w.parts[day] = p
+	}
+	e.ID = 0
+	if w.Scrub != nil && !e.Anonymized {
+		w.Scrub(&e)
+	}
+	if err := p.enc.Encode(e); err != nil {
+		return err
+	}
+	p.rows++
+	return nil
+}
+
+func (w *Writer) open(day string) (*part, error) {
+	if err := os.MkdirAll(w.dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(w.dir, prefix+day+suffix)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &part{path: path, offset: info.Size(), f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Commit flushes and syncs every file, then reads back what this run
+// appended and checks that it holds rows lines in total. On any failure the
+// files are cut back to their previous size.
+func (w *Writer) Commit(rows int64) error {
+	var written int64
+	for _, p := range w.parts {
+		if err := p.gz.Close(); err != nil {
+			w.Abort()
+			return err
+		}
+		if err := p.f.Sync(); err != nil {
+			w.Abort()
+			return err
+		}
+		n, err := countLines(p.path, p.offset)
+		if err != nil {
+			w.Abort()
+			return fmt.Errorf("verify %s: %w", p.path, err)
+		}
+		if n != p.rows {
+			w.Abort()
+			return fmt.Errorf("verify %s: wrote %d rows, read back %d", p.path, p.rows, n)
+		}
+		written += n
+	}
+	if written != rows {
+		w.Abort()
+		return fmt.Errorf("archived %d rows, expected %d", written, rows)
+	}
+	for _, p := range w.parts {
+		p.f.Close()
+	}
+	w.parts = make(map[string]*part)
+	return nil
+}
+
+// Abort drops everything written since the last Commit.
+func (w *Writer) Abort() {
+	for _, p := range w.parts {
+		p.f.Close()
+		if p.offset == 0 {
+			os.Remove(p.path)
+		} else {
+			os.Truncate(p.path, p.offset)
+		}
+	}
+	w.parts = make(map[string]*part)
+}
+
+func countLines(path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	var n int64
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// Read calls fn for every row in the archive file at path, which may be
+// gzip-compressed or plain NDJSON.
+func Read(path string, fn func(models.LogEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var e models.LogEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: row %d: %w", path, line, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// Files returns the archive files under path: path itself if it is a file,
+// otherwise the daily archives in the directory, oldest first.
+func Files(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(filepath.Join(path, prefix+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Prune deletes daily archives of days before t and returns how many were
+// removed.
+func Prune(dir string, t time.Time) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"*"+suffix))
+	if err != nil {
+		return 0, err
+	}
+	cutoff := t.UTC().Format(layout)
+	removed := 0
+	for _, f := range files {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), prefix), suffix)
+		if _, err := time.Parse(layout, day); err != nil || day >= cutoff {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
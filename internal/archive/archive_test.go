@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+func entryAt(day, path string) models.LogEntry {
+	t, _ := time.Parse(layout, day)
+	return models.LogEntry{ID: 42, Time: float64(t.Add(12 * time.Hour).Unix()), RemoteAddr: "192.0.2.10", Path: path, Status: 200}
+}
+
+func readAll(t *testing.T, dir string) map[string][]string {
+	t.Helper()
+	files, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, f := range files {
+		err := Read(f, func(e models.LogEntry) error {
+			if e.ID != 0 {
+				t.Errorf("%s: row keeps id %d", f, e.ID)
+			}
+			day := filepath.Base(f)
+			got[day] = append(got[day], e.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return got
+}
+
+func TestWriter(t *testing.T) {
+	type run struct {
+		paths  []string // "day path"
+		rows   int64    // passed to Commit; -1 aborts instead
+		commit bool     // whether Commit should succeed
+	}
+	tests := []struct {
+		name string
+		runs []run
+		want map[string][]string
+	}{
+		{
+			name: "one run",
+			runs: []run{{paths: []string{"2024-01-01 /a", "2024-01-02 /b", "2024-01-01 /c"}, rows: 3, commit: true}},
+			want: map[string][]string{"access-2024-01-01.ndjson.gz": {"/a", "/c"}, "access-2024-01-02.ndjson.gz": {"/b"}},
+		},
+		{
+			name: "runs append gzip members",
+			runs: []run{
+				{paths: []string{"2024-01-01 /a"}, rows: 1, commit: true},
+				{paths: []string{"2024-01-01 /b"}, rows: 1, commit: true},
+			},
+			want: map[string][]string{"access-2024-01-01.ndjson.gz": {"/a", "/b"}},
+		},
+		{
+			name: "abort removes new files",
+			runs: []run{{paths: []string{"2024-01-01 /a"}, rows: -1}},
+			want: map[string][]string{},
+		},
+		{
+			name: "abort truncates existing files",
+			runs: []run{
+				{paths: []string{"2024-01-01 /a"}, rows: 1, commit: true},
+				{paths: []string{"2024-01-01 /b", "2024-01-02 /c"}, rows: -1},
+			},
+			want: map[string][]string{"access-2024-01-01.ndjson.gz": {"/a"}},
+		},
+		{
+			name: "row count mismatch rolls back",
+			runs: []run{
+				{paths: []string{"2024-01-01 /a"}, rows: 1, commit: true},
+				{paths: []string{"2024-01-01 /b", "2024-01-02 /c"}, rows: 3, commit: false},
+			},
+			want: map[string][]string{"access-2024-01-01.ndjson.gz": {"/a"}},
+		},
+		{
+			name: "writer is reusable after a failed commit",
+			runs: []run{
+				{paths: []string{"2024-01-01 /a"}, rows: 5, commit: false},
+				{paths: []string{"2024-01-01 /b"}, rows: 1, commit: true},
+			},
+			want: map[string][]string{"access-2024-01-01.ndjson.gz": {"/b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := NewWriter(dir)
+			for i, r := range tt.runs {
+				for _, p := range r.paths {
+					if err := w.Add(entryAt(p[:10], p[11:])); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if r.rows < 0 {
+					w.Abort()
+					continue
+				}
+				if err := w.Commit(r.rows); (err == nil) != r.commit {
+					t.Fatalf("run %d: Commit error = %v, want success %v", i, err, r.commit)
+				}
+			}
+			got := readAll(t, dir)
+			if len(got) != len(tt.want) {
+				t.Fatalf("files = %v, want %v", got, tt.want)
+			}
+			for file, paths := range tt.want {
+				if len(got[file]) != len(paths) {
+					t.Fatalf("%s = %v, want %v", file, got[file], paths)
+				}
+				for i := range paths {
+					if got[file][i] != paths[i] {
+						t.Errorf("%s = %v, want %v", file, got[file], paths)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWriterScrub(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir)
+	w.Scrub = func(e *models.LogEntry) { e.RemoteAddr = "192.0.2.0" }
+	raw := entryAt("2024-01-01", "/raw")
+	done := entryAt("2024-01-01", "/done")
+	done.RemoteAddr, done.Anonymized = "198.51.100.0", true
+	for _, e := range []models.LogEntry{raw, done} {
+		if err := w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/raw": "192.0.2.0", "/done": "198.51.100.0"}
+	err := Read(filepath.Join(dir, "access-2024-01-01.ndjson.gz"), func(e models.LogEntry) error {
+		if e.RemoteAddr != want[e.Path] {
+			t.Errorf("%s: remote_addr %s, want %s", e.Path, e.RemoteAddr, want[e.Path])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"access-2024-01-01.ndjson.gz", "access-2024-01-02.ndjson.gz", "access-2024-01-03.ndjson.gz", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := Prune(dir, time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	files, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || filepath.Base(files[0]) != "access-2024-01-02.ndjson.gz" {
+		t.Errorf("files left = %v", files)
+	}
+}
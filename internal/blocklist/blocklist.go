@@ -0,0 +1,510 @@
+// Package blocklist keeps the list of banned client addresses and ranges
+// and turns it into files other tools read: an nginx deny include, an
+// nginx geo map include, a plain-text feed and a fail2ban-friendly log.
+package blocklist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// Files written to Output.Dir.
+const (
+	DenyFile    = "deny.conf"
+	GeoFile     = "geo.conf"
+	TextFile    = "banned.txt"
+	Fail2banLog = "fail2ban.log"
+)
+
+// Sources of a ban.
+const (
+	Manual   = "manual"
+	Incident = "incident"
+	Threat   = "threat"
+)
+
+// Auto decides which detections ban their address.
+type Auto struct {
+	Incidents   []string       // incident kinds that ban their address
+	Threats     string         // attack rule filter as on /query; empty = none
+	MinRequests int64          // flagged requests within Window needed for a threat ban
+	Window      time.Duration  // how far back detections count
+	Duration    time.Duration  // how long an automatic ban lasts; 0 = never expires
+	Exempt      []netip.Prefix // never banned, automatically or by hand
+	// Truncated says stored addresses were cut to their /24 (IPv4) or /48
+	// (IPv6) at ingest, so a ban covers that range rather than the one
+	// address left in the logs.
+	Truncated bool
+}
+
+// Shortest ranges a ban may cover, so a typo cannot shut out a large part
+// of the internet.
+const (
+	minBits4 = 8
+	minBits6 = 32
+)
+
+// Output is where the list is written.
+type Output struct {
+	Dir           string   // empty = only served over HTTP
+	ReloadCommand []string // run after the files change, e.g. nginx -s reload
+}
+
+// List manages bans and keeps the generated files in step with them. It is
+// safe for concurrent use.
+type List struct {
+	repo repository.LogRepository
+
+	mu      sync.Mutex
+	auto    Auto
+	out     Output
+	written map[string][]byte // file contents last written to out.Dir
+	listed  map[string]bool   // targets in the last written list
+}
+
+func New(repo repository.LogRepository, auto Auto, out Output) *List {
+	l := &List{repo: repo}
+	l.Set(auto, out)
+	return l
+}
+
+// Set replaces the policy and output, e.g. on a config reload.
+func (l *List) Set(auto Auto, out Output) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.auto = auto
+	if out.Dir != l.out.Dir {
+		l.written = make(map[string][]byte)
+		l.listed = readListed(filepath.Join(out.Dir, TextFile))
+	}
+	l.out = out
+}
+
+// Dir returns the directory the files are written to, if any.
+func (l *List) Dir() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Dir
+}
+
+// Active returns the bans in force at now, newest first.
+func (l *List) Active(now time.Time) ([]repository.Ban, error) {
+	bans, err := l.repo.Bans(now)
+	if err != nil {
+		return nil, err
+	}
+	t := float64(now.UnixNano()) / 1e9
+	out := bans[:0]
+	for _, b := range bans {
+		if b.ActiveAt(t) {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+// CheckTarget returns the canonical form of target, or an error if it may
+// not be banned: it is not an address or range, is too wide, or overlaps
+// an exempt range.
+func (l *List) CheckTarget(target string) (string, error) {
+	canon, err := ParseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	l.mu.Lock()
+	auto := l.auto
+	l.mu.Unlock()
+	if exempt(auto.Exempt, canon) {
+		return "", fmt.Errorf("%s overlaps an exempt range (blocklist.auto.exempt)", canon)
+	}
+	return canon, nil
+}
+
+// BanTarget returns what a ban of addr, as stored in the logs, should
+// cover: the range it was truncated from if addresses are truncated,
+// otherwise addr itself.
+func (l *List) BanTarget(addr string) string {
+	l.mu.Lock()
+	auto := l.auto
+	l.mu.Unlock()
+	return banTarget(auto, addr)
+}
+
+func banTarget(auto Auto, addr string) string {
+	a, err := netip.ParseAddr(strings.TrimSpace(addr))
+	if err != nil || !auto.Truncated {
+		return addr
+	}
+	a = a.Unmap()
+	bits := 48
+	if a.Is4() {
+		bits = 24
+	}
+	return netip.PrefixFrom(a, bits).Masked().String()
+}
+
+// Ban bans target (an address or CIDR range) for d, or for good if d is 0,
+// and rewrites the files.
+func (l *List) Ban(target, reason, source string, d time.Duration, now time.Time) (*repository.Ban, error) {
+	canon, err := l.CheckTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	b := &repository.Ban{
+		Target:    canon,
+		Reason:    strings.TrimSpace(reason),
+		Source:    source,
+		CreatedAt: float64(now.UnixNano()) / 1e9,
+	}
+	if d > 0 {
+		b.ExpiresAt = float64(now.Add(d).UnixNano()) / 1e9
+	}
+	if err := l.repo.AddBan(b); err != nil {
+		return nil, err
+	}
+	return b, l.Refresh(now)
+}
+
+// Lift ends a ban now and rewrites the files.
+func (l *List) Lift(id int64, now time.Time) error {
+	if err := l.repo.LiftBan(id, now); err != nil {
+		return err
+	}
+	return l.Refresh(now)
+}
+
+// AutoBan bans the addresses behind recent detections that the policy
+// covers and returns how many bans it added or extended. An address whose
+// ban was lifted by hand is not banned again for detections from before
+// the lift. A ban is only extended once less than half of Duration is
+// left, so the list does not change on every run while an attack goes on.
+func (l *List) AutoBan(now time.Time) (int, error) {
+	l.mu.Lock()
+	auto := l.auto
+	l.mu.Unlock()
+	if (len(auto.Incidents) == 0 && auto.Threats == "") || auto.Window <= 0 {
+		return 0, nil
+	}
+	from := now.Add(-auto.Window)
+	bans, err := l.repo.Bans(from)
+	if err != nil {
+		return 0, err
+	}
+	t := float64(now.UnixNano()) / 1e9
+	lifted := make(map[string]float64)
+	active := make(map[string]repository.Ban)
+	for _, b := range bans {
+		if b.LiftedAt > lifted[b.Target] {
+			lifted[b.Target] = b.LiftedAt
+		}
+		if b.ActiveAt(t) {
+			active[b.Target] = b
+		}
+	}
+
+	type hit struct {
+		reason, source string
+		last           float64
+	}
+	hits := make(map[string]hit)
+	if len(auto.Incidents) > 0 {
+		incs, err := l.repo.Incidents(repository.QueryFilters{TimeFrom: &from}, 1000)
+		if err != nil {
+			return 0, err
+		}
+		for _, inc := range incs {
+			for _, kind := range auto.Incidents {
+				if inc.Kind == kind && hits[inc.RemoteAddr].last < inc.LastSeen {
+					hits[inc.RemoteAddr] = hit{fmt.Sprintf("incident #%d: %s", inc.ID, inc.Summary), Incident, inc.LastSeen}
+				}
+			}
+		}
+	}
+	if auto.Threats != "" {
+		s, err := l.repo.SecuritySummary(repository.QueryFilters{TimeFrom: &from, Threat: auto.Threats}, 1000)
+		if err != nil {
+			return 0, err
+		}
+		for _, ts := range s.TopIPs {
+			if ts.Requests < auto.MinRequests {
+				continue
+			}
+			if _, ok := hits[ts.Addr]; !ok {
+				hits[ts.Addr] = hit{fmt.Sprintf("%d requests matching %s", ts.Requests, strings.Join(ts.Rules, ", ")), Threat, ts.LastSeen}
+			}
+		}
+	}
+
+	addrs := make([]string, 0, len(hits))
+	for addr := range hits {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	n := 0
+	for _, addr := range addrs {
+		h := hits[addr]
+		canon, err := ParseTarget(banTarget(auto, addr))
+		if err != nil || exempt(auto.Exempt, canon) || lifted[canon] >= h.last {
+			continue
+		}
+		if cur, ok := active[canon]; ok && (cur.ExpiresAt == 0 || (auto.Duration > 0 && cur.ExpiresAt-t > auto.Duration.Seconds()/2)) {
+			continue
+		}
+		b := &repository.Ban{Target: canon, Reason: h.reason, Source: h.source, CreatedAt: t}
+		if auto.Duration > 0 {
+			b.ExpiresAt = float64(now.Add(auto.Duration).UnixNano()) / 1e9
+		}
+		if err := l.repo.AddBan(b); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n > 0 {
+		return n, l.Refresh(now)
+	}
+	return 0, nil
+}
+
+// Refresh rewrites the files in the output directory if the list in force
+// at now differs from what they hold. Each file is replaced atomically, so
+// nginx never reads a partial list. Bans entering or leaving the list are
+// appended to the fail2ban log.
+func (l *List) Refresh(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out.Dir == "" {
+		return nil
+	}
+	bans, err := l.Active(now)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.out.Dir, 0755); err != nil {
+		return err
+	}
+	changed := false
+	for _, f := range []struct{ name, format string }{
+		{DenyFile, "deny"},
+		{GeoFile, "geo"},
+		{TextFile, "text"},
+	} {
+		data := Render(f.format, bans)
+		if prev, ok := l.written[f.name]; ok && bytes.Equal(prev, data) {
+			continue
+		}
+		if cur, err := os.ReadFile(filepath.Join(l.out.Dir, f.name)); err == nil && bytes.Equal(cur, data) {
+			l.written[f.name] = data
+			continue
+		}
+		if err := writeAtomic(filepath.Join(l.out.Dir, f.name), data); err != nil {
+			return err
+		}
+		l.written[f.name] = data
+		changed = true
+	}
+	if err := l.logChanges(bans, now); err != nil {
+		return err
+	}
+	if changed && len(l.out.ReloadCommand) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if out, err := exec.CommandContext(ctx, l.out.ReloadCommand[0], l.out.ReloadCommand[1:]...).CombinedOutput(); err != nil {
+			log.Printf("blocklist: reload command: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// logChanges appends Ban and Unban lines for the targets that entered or
+// left the list since the last call.
+func (l *List) logChanges(bans []repository.Ban, now time.Time) error {
+	var buf bytes.Buffer
+	stamp := now.Format("2006-01-02 15:04:05")
+	listed := make(map[string]bool, len(bans))
+	for i := len(bans) - 1; i >= 0; i-- { // oldest first
+		b := bans[i]
+		listed[b.Target] = true
+		if !l.listed[b.Target] {
+			fmt.Fprintf(&buf, "%s nginx-log-analyzer: Ban %s (%s, %s, %s)\n", stamp, b.Target, b.Source, comment(b), until(b))
+		}
+	}
+	var gone []string
+	for target := range l.listed {
+		if !listed[target] {
+			gone = append(gone, target)
+		}
+	}
+	sort.Strings(gone)
+	for _, target := range gone {
+		fmt.Fprintf(&buf, "%s nginx-log-analyzer: Unban %s\n", stamp, target)
+	}
+	if buf.Len() > 0 {
+		f, err := os.OpenFile(filepath.Join(l.out.Dir, Fail2banLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(buf.Bytes())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	l.listed = listed
+	return nil
+}
+
+// Render formats bans as "deny" (nginx deny directives), "geo" (entries
+// for an nginx geo block) or "text" (one target per line). Expiries are
+// left out, so extending a ban does not change the files and reload nginx.
+func Render(format string, bans []repository.Ban) []byte {
+	sorted := append([]repository.Ban(nil), bans...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Target < sorted[j].Target })
+	var buf bytes.Buffer
+	if format != "text" {
+		fmt.Fprintf(&buf, "# Generated by nginx-log-analyzer; do not edit. %d entries.\n", len(sorted))
+	}
+	for _, b := range sorted {
+		switch format {
+		case "deny":
+			fmt.Fprintf(&buf, "deny %s; # %s\n", b.Target, comment(b))
+		case "geo":
+			fmt.Fprintf(&buf, "%s 1; # %s\n", b.Target, comment(b))
+		default:
+			fmt.Fprintln(&buf, b.Target)
+		}
+	}
+	return buf.Bytes()
+}
+
+// comment gives the reason for a ban on one line.
+func comment(b repository.Ban) string {
+	reason := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, b.Reason)
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return reason
+}
+
+// until says when a ban expires.
+func until(b repository.Ban) string {
+	if b.ExpiresAt == 0 {
+		return "never expires"
+	}
+	return "until " + time.Unix(int64(b.ExpiresAt), 0).UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// ParseTarget returns the canonical form of an address or CIDR range:
+// plain addresses without a prefix length, ranges with the host bits
+// cleared. Ranges wider than a /8 of IPv4 or a /32 of IPv6 are refused.
+func ParseTarget(s string) (string, error) {
+	p, err := ParsePrefix(s)
+	if err != nil {
+		return "", err
+	}
+	shortest := minBits6
+	if p.Addr().Is4() {
+		shortest = minBits4
+	}
+	if p.Bits() < shortest {
+		return "", fmt.Errorf("%q is wider than a /%d", strings.TrimSpace(s), shortest)
+	}
+	if p.IsSingleIP() {
+		return p.Addr().String(), nil
+	}
+	return p.String(), nil
+}
+
+// ParsePrefix parses an address or CIDR range. A range must not cover a
+// whole address family.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	if p.Bits() == 0 {
+		return netip.Prefix{}, fmt.Errorf("%q covers every address", s)
+	}
+	return p.Masked(), nil
+}
+
+func exempt(prefixes []netip.Prefix, target string) bool {
+	p, err := ParsePrefix(target)
+	if err != nil {
+		return false
+	}
+	for _, e := range prefixes {
+		if e.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// readListed reads the targets of a previously written text feed, so a
+// restart does not log every ban again.
+func readListed(path string) map[string]bool {
+	listed := make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return listed
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			listed[line] = true
+		}
+	}
+	return listed
+}
+
+// writeAtomic replaces path with data through a temporary file in the same
+// directory.
+func writeAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,120 @@
+package blocklist
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "192.0.2.10", want: "192.0.2.10"},
+		{in: " 192.0.2.10\n", want: "192.0.2.10"},
+		{in: "192.0.2.10/32", want: "192.0.2.10"},
+		{in: "192.0.2.10/24", want: "192.0.2.0/24"},
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "::ffff:192.0.2.10", want: "192.0.2.10"},
+		{in: "2001:DB8::1", want: "2001:db8::1"},
+		{in: "fe80::1%eth0", want: "fe80::1"},
+		{in: "2001:db8::1/128", want: "2001:db8::1"},
+		{in: "2001:db8:1:2::/48", want: "2001:db8:1::/48"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "10.0.0.0/7", wantErr: true},
+		{in: "0.0.0.0/0", wantErr: true},
+		{in: "2001:db8::/31", wantErr: true},
+		{in: "::/0", wantErr: true},
+		{in: "192.0.2.10/33", wantErr: true},
+		{in: "example.com", wantErr: true},
+		{in: "192.0.2", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTarget(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTarget(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExempt(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("198.51.100.7/32"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+	}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"192.0.2.10", true},
+		{"192.0.2.128/25", true},
+		{"192.0.0.0/16", true}, // covers an exempt range
+		{"192.0.3.1", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"198.51.100.0/24", true},
+		{"::ffff:192.0.2.10", true},
+		{"2001:db8:1:ff::1", true},
+		{"2001:db8::/32", true},
+		{"2001:db8:2::1", false},
+		{"not an address", false},
+	}
+	for _, tt := range tests {
+		if got := exempt(prefixes, tt.target); got != tt.want {
+			t.Errorf("exempt(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+	if exempt(nil, "192.0.2.10") {
+		t.Error("exempt with no ranges matched")
+	}
+}
+
+func TestBanTarget(t *testing.T) {
+	tests := []struct {
+		truncated bool
+		addr      string
+		want      string
+	}{
+		{false, "192.0.2.10", "192.0.2.10"},
+		{true, "192.0.2.0", "192.0.2.0/24"},
+		{true, "192.0.2.10", "192.0.2.0/24"},
+		{true, "::ffff:192.0.2.10", "192.0.2.0/24"},
+		{true, "2001:db8:1:2::", "2001:db8:1::/48"},
+		{true, "a1b2c3d4", "a1b2c3d4"}, // not an address, e.g. an hmac pseudonym
+	}
+	for _, tt := range tests {
+		if got := banTarget(Auto{Truncated: tt.truncated}, tt.addr); got != tt.want {
+			t.Errorf("banTarget(truncated %v, %q) = %q, want %q", tt.truncated, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRenderKeepsOneBanPerLine(t *testing.T) {
+	bans := []repository.Ban{
+		{Target: "198.51.100.7", Reason: "scan\nallow all;"},
+		{Target: "192.0.2.0/24"},
+	}
+	got := string(Render("deny", bans))
+	want := "# Generated by nginx-log-analyzer; do not edit. 2 entries.\n" +
+		"deny 192.0.2.0/24; # no reason given\n" +
+		"deny 198.51.100.7; # scan allow all;\n"
+	if got != want {
+		t.Errorf("Render(deny) =\n%s\nwant\n%s", got, want)
+	}
+	if got := string(Render("text", bans)); got != "192.0.2.0/24\n198.51.100.7\n" {
+		t.Errorf("Render(text) = %q", got)
+	}
+	if got := string(Render("geo", bans[1:])); !strings.HasSuffix(got, "192.0.2.0/24 1; # no reason given\n") {
+		t.Errorf("Render(geo) = %q", got)
+	}
+}
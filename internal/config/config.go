@@ -1,9 +1,19 @@
 package config
 
 import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v3"
 )
 
@@ -11,10 +21,25 @@ type Config struct {
 	LogPath      string `yaml:"log_path"`
 	DBPath       string `yaml:"db_path"`
 	RetentionDays int   `yaml:"retention_days"`
+	Retention    RetentionConfig `yaml:"retention"`
+	Archive      ArchiveConfig `yaml:"archive"`
 	Listen       string `yaml:"listen"`
 	UploadEnabled bool  `yaml:"upload_enabled"`
 	PageSize     int    `yaml:"page_size"`
+	WatchConfig  bool   `yaml:"watch_config"`
 	Ignore       IgnoreConfig `yaml:"ignore"`
+	Sampling     []SamplingConfig `yaml:"sampling"`
+	Privacy      PrivacyConfig `yaml:"privacy"`
+	GeoIP        GeoIPConfig `yaml:"geoip"`
+	Routes       RoutesConfig `yaml:"routes"`
+	Sessions     SessionsConfig `yaml:"sessions"`
+	Threats      ThreatsConfig `yaml:"threats"`
+	Incidents    IncidentsConfig `yaml:"incidents"`
+	Blocklist    BlocklistConfig `yaml:"blocklist"`
+	Metrics      MetricsConfig `yaml:"metrics"`
+	Alerts       AlertsConfig `yaml:"alerts"`
+	SMTP         SMTPConfig `yaml:"smtp"`
+	Reports      []ReportConfig `yaml:"reports"`
 }
 
 type IgnoreConfig struct {
@@ -25,12 +50,229 @@ type IgnoreConfig struct {
 	SkipPathPrefixes []string `yaml:"skip_path_prefixes"`
 }
 
+// SamplingConfig keeps one in KeepOneIn requests matching Host and PathPrefix.
+type SamplingConfig struct {
+	Host       string `yaml:"host"`
+	PathPrefix string `yaml:"path_prefix"`
+	KeepOneIn  int    `yaml:"keep_one_in"`
+	KeepErrors bool   `yaml:"keep_errors"`
+}
+
+// PrivacyConfig controls IP anonymization and query-string scrubbing.
+// With AnonymizeAfterDays = 0 entries are scrubbed at ingest; otherwise they
+// are stored raw and rewritten once they are that many days old.
+type PrivacyConfig struct {
+	IPMode             string   `yaml:"ip_mode"` // "", "truncate" or "hmac"
+	HMACKey            string   `yaml:"hmac_key"`
+	StripQueryParams   []string `yaml:"strip_query_params"`
+	AnonymizeAfterDays int      `yaml:"anonymize_after_days"`
+}
+
+// GeoIPConfig points at local MaxMind or DB-IP .mmdb files.
+type GeoIPConfig struct {
+	CityDB string `yaml:"city_db"`
+	ASNDB  string `yaml:"asn_db"`
+}
+
+// RoutesConfig controls how request paths are grouped into routes.
+type RoutesConfig struct {
+	Templates     []string `yaml:"templates"`
+	AutoNormalize bool     `yaml:"auto_normalize"`
+}
+
+// RetentionConfig sets how long aggregates are kept once raw rows (kept for
+// RetentionDays) are gone, and which raw rows are kept longer or shorter.
+type RetentionConfig struct {
+	HourlyRollupDays int                 `yaml:"hourly_rollup_days"` // 0 keeps them forever
+	DailyRollupDays  int                 `yaml:"daily_rollup_days"`  // 0 keeps them forever
+	Overrides        []RetentionOverride `yaml:"overrides"`
+}
+
+// RetentionOverride keeps raw rows matching Host and/or Status for Days.
+type RetentionOverride struct {
+	Host   string `yaml:"host"`
+	Status string `yaml:"status"` // a code like "503" or a class like "5xx"
+	Days   int    `yaml:"days"`
+}
+
+// StatusRange returns the inclusive status range Status selects, or 0, 0
+// if it is empty.
+func (o RetentionOverride) StatusRange() (lo, hi int, err error) {
+	return statusRange(o.Status)
+}
+
+func statusRange(status string) (lo, hi int, err error) {
+	s := strings.ToLower(strings.TrimSpace(status))
+	if s == "" {
+		return 0, 0, nil
+	}
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		lo = int(s[0]-'0') * 100
+		return lo, lo + 99, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 100 || n > 599 {
+		return 0, 0, fmt.Errorf("invalid status %q", status)
+	}
+	return n, n, nil
+}
+
+// ArchiveConfig controls where raw rows are written before retention
+// deletes them.
+type ArchiveConfig struct {
+	Dir      string `yaml:"dir"`       // empty disables archiving
+	KeepDays int    `yaml:"keep_days"` // 0 keeps archives forever
+}
+
+// SessionsConfig controls how requests are grouped into visits.
+type SessionsConfig struct {
+	TimeoutMinutes int `yaml:"timeout_minutes"` // 0 disables sessionization
+}
+
+// ThreatsConfig controls attack pattern detection at ingest, which is off
+// unless Enabled. The bundled rules are extended or overridden by RulesFile.
+type ThreatsConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	RulesFile     string   `yaml:"rules_file"`     // YAML rules; an id already bundled replaces that rule
+	DisabledRules []string `yaml:"disabled_rules"` // rule ids to skip
+}
+
+// IncidentsConfig sets up the per-address behaviour detectors run at
+// ingest, which are off unless Enabled. Each opens an incident when its
+// value over the window reaches the threshold.
+type IncidentsConfig struct {
+	Enabled       bool           `yaml:"enabled"`
+	NotFound      DetectorConfig `yaml:"not_found"`      // distinct paths answered 404
+	LoginFailures DetectorConfig `yaml:"login_failures"` // POSTs to paths answered 401/403
+	RequestRate   DetectorConfig `yaml:"request_rate"`   // requests
+	ErrorRatio    DetectorConfig `yaml:"error_ratio"`    // percent of requests answered 4xx/5xx
+}
+
+type DetectorConfig struct {
+	WindowMinutes int      `yaml:"window_minutes"`
+	Threshold     float64  `yaml:"threshold"`    // 0 disables the detector
+	MinRequests   int64    `yaml:"min_requests"` // error_ratio: skip windows with less traffic
+	Paths         []string `yaml:"paths"`        // login_failures: login endpoint path prefixes
+}
+
+// BlocklistConfig controls where the list of banned addresses is written
+// and which detections ban automatically.
+type BlocklistConfig struct {
+	Dir           string        `yaml:"dir"`            // empty = serve the lists over HTTP only
+	ReloadCommand []string      `yaml:"reload_command"` // run after the files change, e.g. ["nginx", "-s", "reload"]
+	Auto          AutoBanConfig `yaml:"auto"`
+}
+
+// AutoBanConfig bans the addresses behind recent incidents of the listed
+// kinds, or behind at least MinRequests requests matching Threats.
+type AutoBanConfig struct {
+	Incidents     []string `yaml:"incidents"`      // incident kinds, e.g. ["login_failures"]
+	Threats       string   `yaml:"threats"`        // attack rule filter as on /query, e.g. "cmdi,log4shell"
+	MinRequests   int64    `yaml:"min_requests"`   // flagged requests within the window
+	WindowMinutes int      `yaml:"window_minutes"` // how far back detections count
+	DurationHours int      `yaml:"duration_hours"` // 0 = automatic bans never expire
+	Exempt        []string `yaml:"exempt"`         // addresses or CIDR ranges never banned, automatically or by hand
+}
+
+// MetricsConfig controls the Prometheus endpoint at /metrics.
+type MetricsConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	MaxHosts int  `yaml:"max_hosts"` // hosts beyond this are labelled "other"
+}
+
+// AlertsConfig defines rules that are checked against recent rows every
+// IntervalSeconds, and the notifiers that hear when they fire or resolve.
+type AlertsConfig struct {
+	IntervalSeconds int              `yaml:"interval_seconds"`
+	Rules           []AlertRule      `yaml:"rules"`
+	Notifiers       []NotifierConfig `yaml:"notifiers"`
+}
+
+// AlertRule fires when Metric, measured over the last WindowMinutes, is
+// above Above or below Below. With Change set the value compared is the
+// percent change from the window before.
+type AlertRule struct {
+	Name          string   `yaml:"name"`
+	Metric        string   `yaml:"metric"` // "requests", "error_rate" or "ip_requests"
+	Host          string   `yaml:"host"`   // include/exclude list as on /query; empty = all hosts
+	Status        string   `yaml:"status"` // statuses counted, a code or class; error_rate defaults to "5xx"
+	WindowMinutes int      `yaml:"window_minutes"`
+	Above         *float64 `yaml:"above"`
+	Below         *float64 `yaml:"below"`
+	Change        bool     `yaml:"change"`
+	MinRequests   int64    `yaml:"min_requests"` // skip windows with less traffic
+	Notify        []string `yaml:"notify"`       // notifier names; empty = all
+}
+
+// StatusRange returns the inclusive status range Status selects, or 0, 0
+// if it is empty.
+func (a AlertRule) StatusRange() (lo, hi int, err error) {
+	return statusRange(a.Status)
+}
+
+// NotifierConfig is an HTTP endpoint or a list of email addresses that
+// receives alert notifications.
+type NotifierConfig struct {
+	Name string   `yaml:"name"`
+	Type string   `yaml:"type"` // "webhook", "slack", "teams" or "email"
+	URL  string   `yaml:"url"`
+	To   []string `yaml:"to"` // email recipients
+}
+
+// SMTPConfig is the mail server used by email notifiers and reports.
+type SMTPConfig struct {
+	Host     string `yaml:"host"` // empty disables mail
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"` // empty = no authentication
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	TLS      string `yaml:"tls"` // "starttls", "tls" (implicit) or "none"
+}
+
+// ReportConfig mails a traffic summary of the previous day or week to To.
+type ReportConfig struct {
+	Name    string   `yaml:"name"`
+	Period  string   `yaml:"period"`  // "daily" or "weekly"
+	Weekday string   `yaml:"weekday"` // weekly reports, e.g. "monday"
+	Hour    int      `yaml:"hour"`    // server local time, 0-23
+	Host    string   `yaml:"host"`    // include/exclude list as on /query; empty = all hosts
+	To      []string `yaml:"to"`
+}
+
+// ReportWeekday parses Weekday, defaulting to Monday.
+func (r ReportConfig) ReportWeekday() (time.Weekday, error) {
+	if r.Weekday == "" {
+		return time.Monday, nil
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(r.Weekday, d.String()) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", r.Weekday)
+}
+
 func Load(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	cfg := Config{}
+	cfg := Config{
+		Routes:   RoutesConfig{AutoNormalize: true},
+		Retention: RetentionConfig{HourlyRollupDays: 365},
+		Sessions: SessionsConfig{TimeoutMinutes: 30},
+		Incidents: IncidentsConfig{
+			NotFound:      DetectorConfig{WindowMinutes: 5, Threshold: 30},
+			LoginFailures: DetectorConfig{WindowMinutes: 10, Threshold: 10, Paths: []string{
+				"/login", "/signin", "/wp-login.php", "/user/login", "/admin/login", "/api/login", "/api/auth",
+			}},
+			RequestRate:   DetectorConfig{WindowMinutes: 1, Threshold: 1200},
+			ErrorRatio:    DetectorConfig{WindowMinutes: 10, Threshold: 50, MinRequests: 100},
+		},
+		Blocklist: BlocklistConfig{Auto: AutoBanConfig{MinRequests: 3, WindowMinutes: 10, DurationHours: 24}},
+		Metrics:  MetricsConfig{MaxHosts: 100},
+		SMTP:     SMTPConfig{Port: 587, TLS: "starttls"},
+	}
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
@@ -40,8 +282,309 @@ func Load(path string) (*Config, error) {
 			cfg.UploadEnabled = parsed
 		}
 	}
+	// Environment override: PRIVACY_HMAC_KEY keeps the key out of the file
+	if v := os.Getenv("PRIVACY_HMAC_KEY"); v != "" {
+		cfg.Privacy.HMACKey = v
+	}
+	// Environment override: SMTP_PASSWORD
+	if v := os.Getenv("SMTP_PASSWORD"); v != "" {
+		cfg.SMTP.Password = v
+	}
 	if cfg.PageSize <= 0 {
 		cfg.PageSize = 50
 	}
+	if cfg.Alerts.IntervalSeconds <= 0 {
+		cfg.Alerts.IntervalSeconds = 60
+	}
+	for i := range cfg.Alerts.Rules {
+		if cfg.Alerts.Rules[i].WindowMinutes == 0 {
+			cfg.Alerts.Rules[i].WindowMinutes = 5
+		}
+		if cfg.Alerts.Rules[i].Metric == "error_rate" && cfg.Alerts.Rules[i].Status == "" {
+			cfg.Alerts.Rules[i].Status = "5xx"
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+// Validate reports the first setting that would make the server misbehave.
+func (c *Config) Validate() error {
+	if c.DBPath == "" {
+		return fmt.Errorf("db_path must be set")
+	}
+	if c.RetentionDays <= 0 {
+		return fmt.Errorf("retention_days must be positive, got %d", c.RetentionDays)
+	}
+	if c.Retention.HourlyRollupDays < 0 || c.Retention.DailyRollupDays < 0 {
+		return fmt.Errorf("retention: rollup days must not be negative")
+	}
+	if c.Archive.KeepDays < 0 {
+		return fmt.Errorf("archive.keep_days must not be negative")
+	}
+	for i, o := range c.Retention.Overrides {
+		if o.Days <= 0 {
+			return fmt.Errorf("retention.overrides[%d]: days must be positive", i)
+		}
+		if o.Host == "" && o.Status == "" {
+			return fmt.Errorf("retention.overrides[%d]: set host, status or both", i)
+		}
+		if _, _, err := o.StatusRange(); err != nil {
+			return fmt.Errorf("retention.overrides[%d]: %w", i, err)
+		}
+	}
+	for _, ip := range c.Ignore.WhitelistedIPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("ignore.whitelisted_ips: invalid IP %q", ip)
+		}
+	}
+	for _, s := range c.Ignore.SkipStatusCodes {
+		if s < 100 || s > 599 {
+			return fmt.Errorf("ignore.skip_status_codes: invalid status %d", s)
+		}
+	}
+	for i, r := range c.Sampling {
+		if r.KeepOneIn < 1 {
+			return fmt.Errorf("sampling[%d]: keep_one_in must be at least 1", i)
+		}
+	}
+	for _, t := range c.Routes.Templates {
+		if !strings.HasPrefix(t, "/") {
+			return fmt.Errorf("routes.templates: %q must start with /", t)
+		}
+	}
+	switch c.Privacy.IPMode {
+	case "", "truncate":
+	case "hmac":
+		if c.Privacy.HMACKey == "" {
+			return fmt.Errorf("privacy.ip_mode hmac needs privacy.hmac_key or PRIVACY_HMAC_KEY")
+		}
+	default:
+		return fmt.Errorf("privacy.ip_mode: unknown mode %q", c.Privacy.IPMode)
+	}
+	if c.Privacy.AnonymizeAfterDays < 0 {
+		return fmt.Errorf("privacy.anonymize_after_days must not be negative")
+	}
+	if c.Sessions.TimeoutMinutes < 0 {
+		return fmt.Errorf("sessions.timeout_minutes must not be negative")
+	}
+	for _, d := range []struct {
+		name string
+		cfg  DetectorConfig
+	}{
+		{"not_found", c.Incidents.NotFound},
+		{"login_failures", c.Incidents.LoginFailures},
+		{"request_rate", c.Incidents.RequestRate},
+		{"error_ratio", c.Incidents.ErrorRatio},
+	} {
+		if d.cfg.Threshold < 0 {
+			return fmt.Errorf("incidents.%s.threshold must not be negative", d.name)
+		}
+		if d.cfg.Threshold > 0 && d.cfg.WindowMinutes < 1 {
+			return fmt.Errorf("incidents.%s.window_minutes must be positive", d.name)
+		}
+	}
+	if c.Incidents.ErrorRatio.Threshold > 100 {
+		return fmt.Errorf("incidents.error_ratio.threshold is a percentage and must not exceed 100")
+	}
+	if c.Incidents.LoginFailures.Threshold > 0 && len(c.Incidents.LoginFailures.Paths) == 0 {
+		return fmt.Errorf("incidents.login_failures.paths must list at least one path")
+	}
+	for _, p := range c.Incidents.LoginFailures.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("incidents.login_failures.paths: %q must start with /", p)
+		}
+	}
+	for _, kind := range c.Blocklist.Auto.Incidents {
+		switch kind {
+		case "not_found", "login_failures", "request_rate", "error_ratio":
+		default:
+			return fmt.Errorf("blocklist.auto.incidents: unknown incident kind %q", kind)
+		}
+	}
+	if c.Blocklist.Auto.MinRequests < 1 {
+		return fmt.Errorf("blocklist.auto.min_requests must be at least 1")
+	}
+	if c.Blocklist.Auto.WindowMinutes < 1 {
+		return fmt.Errorf("blocklist.auto.window_minutes must be positive")
+	}
+	if c.Blocklist.Auto.DurationHours < 0 {
+		return fmt.Errorf("blocklist.auto.duration_hours must not be negative")
+	}
+	for _, e := range c.Blocklist.Auto.Exempt {
+		if _, _, err := net.ParseCIDR(e); err != nil && net.ParseIP(e) == nil {
+			return fmt.Errorf("blocklist.auto.exempt: invalid IP or CIDR range %q", e)
+		}
+	}
+	if len(c.Blocklist.ReloadCommand) > 0 && c.Blocklist.Dir == "" {
+		return fmt.Errorf("blocklist.reload_command needs blocklist.dir")
+	}
+	if c.Metrics.MaxHosts < 1 {
+		return fmt.Errorf("metrics.max_hosts must be at least 1")
+	}
+	notifiers := make(map[string]bool)
+	for i, n := range c.Alerts.Notifiers {
+		if n.Name == "" || notifiers[n.Name] {
+			return fmt.Errorf("alerts.notifiers[%d]: name must be set and unique", i)
+		}
+		notifiers[n.Name] = true
+		switch n.Type {
+		case "webhook", "slack", "teams":
+			if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("alerts.notifiers[%d]: url must be an http(s) URL", i)
+			}
+		case "email":
+			if c.SMTP.Host == "" {
+				return fmt.Errorf("alerts.notifiers[%d]: email needs smtp.host", i)
+			}
+			if err := validateRecipients(n.To); err != nil {
+				return fmt.Errorf("alerts.notifiers[%d]: %w", i, err)
+			}
+		default:
+			return fmt.Errorf("alerts.notifiers[%d]: unknown type %q", i, n.Type)
+		}
+	}
+	rules := make(map[string]bool)
+	for i, a := range c.Alerts.Rules {
+		if a.Name == "" || rules[a.Name] {
+			return fmt.Errorf("alerts.rules[%d]: name must be set and unique", i)
+		}
+		rules[a.Name] = true
+		switch a.Metric {
+		case "requests", "error_rate":
+		case "ip_requests":
+			if a.Below != nil || a.Change {
+				return fmt.Errorf("alerts.rules[%d]: ip_requests only supports above", i)
+			}
+		default:
+			return fmt.Errorf("alerts.rules[%d]: unknown metric %q", i, a.Metric)
+		}
+		if a.Above == nil && a.Below == nil {
+			return fmt.Errorf("alerts.rules[%d]: set above, below or both", i)
+		}
+		if a.WindowMinutes < 1 {
+			return fmt.Errorf("alerts.rules[%d]: window_minutes must be positive", i)
+		}
+		if _, _, err := a.StatusRange(); err != nil {
+			return fmt.Errorf("alerts.rules[%d]: %w", i, err)
+		}
+		for _, name := range a.Notify {
+			if !notifiers[name] {
+				return fmt.Errorf("alerts.rules[%d]: unknown notifier %q", i, name)
+			}
+		}
+	}
+	if c.SMTP.Host != "" {
+		switch c.SMTP.TLS {
+		case "starttls", "tls", "none":
+		default:
+			return fmt.Errorf("smtp.tls: unknown mode %q", c.SMTP.TLS)
+		}
+		if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+			return fmt.Errorf("smtp.port: invalid port %d", c.SMTP.Port)
+		}
+		if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+			return fmt.Errorf("smtp.from: %w", err)
+		}
+	}
+	reports := make(map[string]bool)
+	for i, r := range c.Reports {
+		if r.Name == "" || reports[r.Name] {
+			return fmt.Errorf("reports[%d]: name must be set and unique", i)
+		}
+		reports[r.Name] = true
+		if c.SMTP.Host == "" {
+			return fmt.Errorf("reports[%d]: reports need smtp.host", i)
+		}
+		if r.Period != "daily" && r.Period != "weekly" {
+			return fmt.Errorf("reports[%d]: period must be daily or weekly", i)
+		}
+		if _, err := r.ReportWeekday(); err != nil {
+			return fmt.Errorf("reports[%d]: %w", i, err)
+		}
+		if r.Hour < 0 || r.Hour > 23 {
+			return fmt.Errorf("reports[%d]: hour must be between 0 and 23", i)
+		}
+		if err := validateRecipients(r.To); err != nil {
+			return fmt.Errorf("reports[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateRecipients(to []string) error {
+	if len(to) == 0 {
+		return fmt.Errorf("to must list at least one address")
+	}
+	for _, addr := range to {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("to: %q: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// Live holds the active configuration and lets it be replaced atomically
+// while the server is running.
+type Live struct {
+	p atomic.Pointer[Config]
+}
+
+func NewLive(cfg *Config) *Live {
+	l := &Live{}
+	l.p.Store(cfg)
+	return l
+}
+
+func (l *Live) Get() *Config {
+	return l.p.Load()
+}
+
+func (l *Live) Set(cfg *Config) {
+	l.p.Store(cfg)
+}
+
+// Watch calls onChange whenever the file at path is written, created or
+// renamed over. The parent directory is watched so that editors which save
+// by replacing the file are picked up too. Bursts of events are coalesced.
+func Watch(path string, stopCh <-chan struct{}, onChange func()) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(filepath.Dir(abs)); err != nil {
+		return err
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != abs {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				debounce = time.After(500 * time.Millisecond)
+			}
+		case err := <-watcher.Errors:
+			if err != nil {
+				log.Printf("config watch: %v", err)
+			}
+		case <-debounce:
+			debounce = nil
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package geoip
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// record covers the fields we read from MaxMind GeoLite2/GeoIP2 City and ASN
+// databases and the DB-IP lite equivalents, which use the same layout.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// file is one .mmdb loaded into memory, plus the modification time it was
+// loaded at so changes on disk can be detected.
+type file struct {
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// DB looks addresses up in up to two local .mmdb files (city and ASN). The
+// files are read into memory, so a reload can swap readers while lookups are
+// in flight. The zero value has no databases and enriches nothing.
+type DB struct {
+	city atomic.Pointer[file]
+	asn  atomic.Pointer[file]
+}
+
+// SetPaths switches to the given database files, loading any that are not
+// already in use. An empty path disables that lookup. On error nothing is
+// changed.
+func (d *DB) SetPaths(cityPath, asnPath string) error {
+	type slot struct {
+		path string
+		dst  *atomic.Pointer[file]
+		next *file
+	}
+	slots := []*slot{{path: cityPath, dst: &d.city}, {path: asnPath, dst: &d.asn}}
+	for _, s := range slots {
+		cur := s.dst.Load()
+		if s.path == "" || (cur != nil && cur.path == s.path) {
+			s.next = cur
+			if s.path == "" {
+				s.next = nil
+			}
+			continue
+		}
+		f, err := load(s.path)
+		if err != nil {
+			return err
+		}
+		s.next = f
+	}
+	for _, s := range slots {
+		s.dst.Store(s.next)
+	}
+	return nil
+}
+
+func load(path string) (*file, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return &file{path: path, modTime: info.ModTime(), reader: reader}, nil
+}
+
+// Enrich fills in the entry's ASN and organization, and its city and country
+// when nginx did not already provide them.
+func (d *DB) Enrich(e *models.LogEntry) {
+	if d.city.Load() == nil && d.asn.Load() == nil {
+		return
+	}
+	ip := net.ParseIP(e.RemoteAddr)
+	if ip == nil {
+		return
+	}
+	if f := d.city.Load(); f != nil {
+		var rec record
+		if err := f.reader.Lookup(ip, &rec); err == nil {
+			if e.Country == "" {
+				e.Country = rec.Country.ISOCode
+			}
+			if e.City == "" {
+				e.City = rec.City.Names["en"]
+			}
+			if e.ASN == 0 && rec.ASN != 0 {
+				e.ASN = int64(rec.ASN)
+				e.ASOrg = rec.ASOrg
+			}
+		}
+	}
+	if f := d.asn.Load(); f != nil {
+		var rec record
+		if err := f.reader.Lookup(ip, &rec); err == nil && rec.ASN != 0 {
+			e.ASN = int64(rec.ASN)
+			e.ASOrg = rec.ASOrg
+		}
+	}
+}
+
+// Watch reloads a database whenever its file's modification time changes,
+// e.g. after geoipupdate replaced it. A file that fails to load keeps the
+// previous version in use.
+func (d *DB) Watch(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, p := range []*atomic.Pointer[file]{&d.city, &d.asn} {
+			cur := p.Load()
+			if cur == nil {
+				continue
+			}
+			info, err := os.Stat(cur.path)
+			if err != nil || info.ModTime().Equal(cur.modTime) {
+				continue
+			}
+			next, err := load(cur.path)
+			if err != nil {
+				log.Printf("geoip: reload %s: %v", cur.path, err)
+				continue
+			}
+			p.Store(next)
+			log.Printf("geoip: reloaded %s", cur.path)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xHacka/nginx-log-analyzer/internal/alerts"
+	"github.com/xHacka/nginx-log-analyzer/internal/config"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const alertHistoryLimit = 100
+
+// AlertsHandler shows firing and past alerts and manages silences.
+type AlertsHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+	Config        *config.Live
+}
+
+type AlertRow struct {
+	repository.AlertEvent
+	Duration string
+	Silenced bool
+}
+
+type SilenceRow struct {
+	repository.Silence
+	Active bool
+}
+
+type AlertsPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Firing        []AlertRow
+	History       []AlertRow
+	Silences      []SilenceRow
+	Rules         []string
+	Hosts         []string // host filters of the rules, for the silence form
+}
+
+func (h *AlertsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	firing, err := h.Repo.AlertEvents(true, alertHistoryLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history, err := h.Repo.AlertEvents(false, alertHistoryLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	silences, err := h.Repo.Silences(now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t := float64(now.UnixNano()) / 1e9
+	data := AlertsPageData{PageID: "alerts", UploadEnabled: h.UploadEnabled}
+	for _, e := range firing {
+		data.Firing = append(data.Firing, AlertRow{AlertEvent: e, Duration: formatDuration(t - e.StartedAt), Silenced: alerts.Silenced(silences, &e, now)})
+	}
+	for _, e := range history {
+		data.History = append(data.History, AlertRow{AlertEvent: e, Duration: formatDuration(e.ResolvedAt - e.StartedAt)})
+	}
+	for _, s := range silences {
+		data.Silences = append(data.Silences, SilenceRow{Silence: s, Active: s.StartsAt <= t})
+	}
+	seen := make(map[string]bool)
+	for _, rule := range h.Config.Get().Alerts.Rules {
+		data.Rules = append(data.Rules, rule.Name)
+		for _, host := range strings.Split(rule.Host, ",") {
+			host = strings.TrimSpace(host)
+			if host != "" && !strings.HasPrefix(host, "-") && !seen[host] {
+				seen[host] = true
+				data.Hosts = append(data.Hosts, host)
+			}
+		}
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type silenceRequest struct {
+	Rule     string    `json:"rule"`
+	Host     string    `json:"host"`
+	StartsAt time.Time `json:"starts_at"` // zero = now
+	EndsAt   time.Time `json:"ends_at"`
+	Comment  string    `json:"comment"`
+}
+
+// CreateSilence adds a silence from a JSON body.
+func (h *AlertsHandler) CreateSilence(w http.ResponseWriter, r *http.Request) {
+	var req silenceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if req.StartsAt.IsZero() || req.StartsAt.Before(now) {
+		req.StartsAt = now
+	}
+	req.Rule, req.Host = strings.TrimSpace(req.Rule), strings.TrimSpace(req.Host)
+	switch {
+	case req.Rule == "" && req.Host == "":
+		http.Error(w, "set a rule, a host or both", http.StatusBadRequest)
+		return
+	case !req.EndsAt.After(req.StartsAt):
+		http.Error(w, "the silence must end after it starts", http.StatusBadRequest)
+		return
+	case req.Host != "" && !h.hostScoped(req.Rule, req.Host):
+		// Rules without a host filter add up all hosts, so their alerts
+		// cannot be told apart by host and a host silence never covers them.
+		http.Error(w, "a host silence only covers rules whose host filter names that host, and no such rule matches", http.StatusBadRequest)
+		return
+	}
+	s := repository.Silence{
+		Rule:      req.Rule,
+		Host:      req.Host,
+		StartsAt:  float64(req.StartsAt.UnixNano()) / 1e9,
+		EndsAt:    float64(req.EndsAt.UnixNano()) / 1e9,
+		Comment:   strings.TrimSpace(req.Comment),
+		CreatedAt: float64(now.UnixNano()) / 1e9,
+	}
+	if err := h.Repo.AddSilence(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]int64{"id": s.ID})
+}
+
+// hostScoped reports whether a configured rule, or the named one if rule is
+// set, has a host filter that includes host.
+func (h *AlertsHandler) hostScoped(rule, host string) bool {
+	for _, r := range h.Config.Get().Alerts.Rules {
+		if rule != "" && r.Name != rule {
+			continue
+		}
+		for _, f := range strings.Split(r.Host, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExpireSilence ends the silence in the URL now.
+func (h *AlertsHandler) ExpireSilence(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid silence id", http.StatusBadRequest)
+		return
+	}
+	if err := h.Repo.ExpireSilence(id, time.Now()); err == sql.ErrNoRows {
+		http.Error(w, "no such silence", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// APIHandler serves the JSON API under /api/v1. Filters use the same query
+// parameters and include/exclude syntax as /query.
+type APIHandler struct {
+	Repo repository.LogRepository
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiEntries struct {
+	Data       []models.LogEntry `json:"data"`
+	NextCursor *string           `json:"next_cursor"` // null on the last page
+}
+
+type apiCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+type apiASN struct {
+	ASN   int64  `json:"asn"`
+	Org   string `json:"org"`
+	Count int64  `json:"count"`
+}
+
+type apiStats struct {
+	From          time.Time  `json:"from"`
+	To            time.Time  `json:"to"`
+	BucketSeconds int64      `json:"bucket_seconds"`
+	TotalRequests int64      `json:"total_requests"`
+	PrevRequests  int64      `json:"prev_requests"`
+	ErrorRate     float64    `json:"error_rate"`
+	UniqueIPs     int64      `json:"unique_ips"`
+	Timeline      []apiCount `json:"timeline"`
+	Statuses      []apiCount `json:"statuses"`
+	Countries     []apiCount `json:"countries"`
+	Paths         []apiCount `json:"paths"`
+	Routes        []apiCount `json:"routes"`
+	Browsers      []apiCount `json:"browsers"`
+	HumansVsBots  []apiCount `json:"humans_vs_bots"`
+	ASNs          []apiASN   `json:"asns"`
+	Hosts         []apiCount `json:"hosts"`
+}
+
+type apiGroup struct {
+	Key      string `json:"key"`
+	Rows     int64  `json:"rows"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
+
+// writeAPIInternal logs err and answers with a generic 500, so database
+// errors do not leak to API clients.
+func writeAPIInternal(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("api: %s: %v", r.URL.Path, err)
+	writeAPIError(w, http.StatusInternalServerError, "internal", "internal server error")
+}
+
+// NotFound answers unknown /api/v1 paths with an error object instead of
+// the HTML 404 page.
+func (h *APIHandler) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", "no such endpoint: "+r.URL.Path)
+}
+
+func (h *APIHandler) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not allowed here")
+}
+
+func (h *APIHandler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// Entries returns one page of matching rows, newest first unless
+// order=asc, with a cursor for the next page.
+func (h *APIHandler) Entries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := validateAPITimes(q); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	limit, err := apiLimit(q, apiDefaultLimit)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	var cursor *repository.EntryCursor
+	if c := q.Get("cursor"); c != "" {
+		if cursor, err = decodeCursor(c); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_cursor", "cursor is not valid")
+			return
+		}
+	}
+	switch q.Get("order") {
+	case "", "asc", "desc":
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "order must be asc or desc")
+		return
+	}
+	filters := toRepoFilters(parseQueryFilters(r))
+	filters.SortDesc = q.Get("order") != "asc"
+
+	// Ask for one extra row to know whether there is a next page.
+	entries, err := h.Repo.QueryAfter(filters, cursor, limit+1)
+	if err != nil {
+		writeAPIInternal(w, r, err)
+		return
+	}
+	resp := apiEntries{Data: entries}
+	if len(entries) > limit {
+		resp.Data = entries[:limit]
+		last := resp.Data[limit-1]
+		next := encodeCursor(repository.EntryCursor{Time: last.Time, ID: last.ID})
+		resp.NextCursor = &next
+	}
+	if resp.Data == nil {
+		resp.Data = []models.LogEntry{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Stats returns the dashboard figures for range= or time_from/time_to, and
+// host.
+func (h *APIHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := validateAPITimes(q); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if rk := q.Get("range"); rk != "" && q.Get("time_from") == "" && q.Get("time_to") == "" {
+		known := false
+		for _, dr := range dashboardRanges {
+			known = known || dr.Key == rk
+		}
+		if !known {
+			writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "unknown range "+strconv.Quote(rk))
+			return
+		}
+	}
+	filters, bucket, _ := dashboardScope(q, time.Now())
+	stats, err := h.Repo.GetDashboardStats(filters, bucket)
+	if err != nil {
+		writeAPIInternal(w, r, err)
+		return
+	}
+	out := apiStats{
+		From:          filters.TimeFrom.UTC(),
+		To:            filters.TimeTo.UTC(),
+		BucketSeconds: int64(bucket / time.Second),
+		TotalRequests: stats.TotalRequests,
+		PrevRequests:  stats.PrevRequests,
+		ErrorRate:     stats.ErrorRate,
+		UniqueIPs:     stats.UniqueIPs,
+		Timeline:      []apiCount{},
+		Statuses:      []apiCount{},
+		Countries:     []apiCount{},
+		Paths:         []apiCount{},
+		Routes:        []apiCount{},
+		Browsers:      labelCounts(stats.TopBrowsers),
+		HumansVsBots:  labelCounts(stats.HumansVsBots),
+		ASNs:          []apiASN{},
+		Hosts:         labelCounts(stats.Hosts),
+	}
+	for _, c := range stats.RequestsByHour {
+		out.Timeline = append(out.Timeline, apiCount{Key: c.Hour, Count: c.Count})
+	}
+	for _, c := range stats.StatusDistribution {
+		out.Statuses = append(out.Statuses, apiCount{Key: strconv.Itoa(c.Status), Count: c.Count})
+	}
+	for _, c := range stats.TopCountries {
+		out.Countries = append(out.Countries, apiCount{Key: c.Country, Count: c.Count})
+	}
+	for _, c := range stats.TopPaths {
+		out.Paths = append(out.Paths, apiCount{Key: c.Path, Count: c.Count})
+	}
+	for _, c := range stats.TopRoutes {
+		out.Routes = append(out.Routes, apiCount{Key: c.Path, Count: c.Count})
+	}
+	for _, c := range stats.TopASNs {
+		out.ASNs = append(out.ASNs, apiASN{ASN: c.ASN, Org: c.Org, Count: c.Count})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": out})
+}
+
+// Aggregate groups matching rows by the field in by=.
+func (h *APIHandler) Aggregate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := validateAPITimes(q); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	by := q.Get("by")
+	fields := repository.GroupFields()
+	valid := false
+	for _, f := range fields {
+		valid = valid || f == by
+	}
+	if !valid {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "by must be one of "+strings.Join(fields, ", "))
+		return
+	}
+	limit, err := apiLimit(q, apiDefaultLimit)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	groups, err := h.Repo.Aggregate(toRepoFilters(parseQueryFilters(r)), by, limit)
+	if err != nil {
+		writeAPIInternal(w, r, err)
+		return
+	}
+	out := make([]apiGroup, len(groups))
+	for i, g := range groups {
+		out[i] = apiGroup{Key: g.Key, Rows: g.Rows, Requests: g.Requests, Bytes: g.Bytes}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": out})
+}
+
+func labelCounts(in []repository.LabelCount) []apiCount {
+	out := make([]apiCount, len(in))
+	for i, c := range in {
+		out[i] = apiCount{Key: c.Label, Count: c.Count}
+	}
+	return out
+}
+
+func apiLimit(q url.Values, def int) (int, error) {
+	raw := q.Get("limit")
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > apiMaxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+	}
+	return n, nil
+}
+
+// validateAPITimes rejects time bounds /query would silently ignore.
+func validateAPITimes(q url.Values) error {
+	for _, key := range []string{"time_from", "time_to"} {
+		v := q.Get(key)
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02T15:04", v); err == nil {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", v); err == nil {
+			continue
+		}
+		return fmt.Errorf("%s must look like 2006-01-02 or 2006-01-02T15:04", key)
+	}
+	return nil
+}
+
+func encodeCursor(c repository.EntryCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatFloat(c.Time, 'f', -1, 64) + ":" + strconv.FormatInt(c.ID, 10)))
+}
+
+func decodeCursor(s string) (*repository.EntryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	t, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	c := &repository.EntryCursor{}
+	if c.Time, err = strconv.ParseFloat(t, 64); err != nil {
+		return nil, err
+	}
+	if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
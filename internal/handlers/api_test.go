@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []repository.EntryCursor{
+		{Time: 0, ID: 0},
+		{Time: 1700000000, ID: 1},
+		{Time: 1700000000.123456, ID: 987654321},
+		{Time: 1.5, ID: 1<<63 - 1},
+	}
+	for _, c := range tests {
+		s := encodeCursor(c)
+		got, err := decodeCursor(s)
+		if err != nil {
+			t.Errorf("decodeCursor(encodeCursor(%+v)): %v", c, err)
+			continue
+		}
+		if *got != c {
+			t.Errorf("cursor %+v came back as %+v", c, *got)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "***"},
+		{"no separator", enc("1700000000")},
+		{"bad time", enc("yesterday:1")},
+		{"bad id", enc("1700000000:x")},
+		{"fractional id", enc("1700000000:1.5")},
+		{"empty parts", enc(":")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := decodeCursor(tt.cursor); err == nil {
+				t.Errorf("decodeCursor(%q) = %+v, want an error", tt.cursor, *c)
+			}
+		})
+	}
+}
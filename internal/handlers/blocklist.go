@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xHacka/nginx-log-analyzer/internal/blocklist"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// blocklistEndedDays is how far back ended bans are listed.
+const blocklistEndedDays = 7
+
+// BlocklistHandler manages bans and serves the generated lists.
+type BlocklistHandler struct {
+	List          *blocklist.List
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type BanRow struct {
+	repository.Ban
+	Range bool // a CIDR range rather than one address
+}
+
+type BlocklistPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Active        []BanRow
+	Ended         []BanRow
+	Prefill       string // target for the ban form, from ?ban=
+	Dir           string // where the files are written, if anywhere
+}
+
+func (h *BlocklistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	bans, err := h.Repo.Bans(now.AddDate(0, 0, -blocklistEndedDays))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := BlocklistPageData{
+		PageID:        "blocklist",
+		UploadEnabled: h.UploadEnabled,
+		Dir:           h.List.Dir(),
+	}
+	if ban := r.URL.Query().Get("ban"); ban != "" {
+		data.Prefill = h.List.BanTarget(ban)
+	}
+	t := float64(now.UnixNano()) / 1e9
+	for _, b := range bans {
+		row := BanRow{b, strings.Contains(b.Target, "/")}
+		if b.ActiveAt(t) {
+			data.Active = append(data.Active, row)
+		} else {
+			data.Ended = append(data.Ended, row)
+		}
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type banRequest struct {
+	Target string  `json:"target"`
+	Reason string  `json:"reason"`
+	Hours  float64 `json:"hours"` // 0 = never expires
+}
+
+// CreateBan bans an address or range from a JSON body.
+func (h *BlocklistHandler) CreateBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Hours < 0 {
+		http.Error(w, "hours must not be negative", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.List.CheckTarget(req.Target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := h.List.Ban(req.Target, req.Reason, blocklist.Manual, time.Duration(req.Hours*float64(time.Hour)), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": b.ID, "target": b.Target})
+}
+
+// LiftBan ends the ban in the URL now.
+func (h *BlocklistHandler) LiftBan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid ban id", http.StatusBadRequest)
+		return
+	}
+	if err := h.List.Lift(id, time.Now()); err == sql.ErrNoRows {
+		http.Error(w, "no such ban in force", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Feed serves the bans in force as an nginx deny include, an nginx geo
+// include or a plain-text list, depending on the route.
+func (h *BlocklistHandler) Feed(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bans, err := h.List.Active(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(blocklist.Render(format, bans))
+	}
+}
+
+// Fail2banLog serves the ban log written next to the generated files.
+func (h *BlocklistHandler) Fail2banLog(w http.ResponseWriter, r *http.Request) {
+	dir := h.List.Dir()
+	if dir == "" {
+		http.Error(w, "the ban log is only kept when blocklist.dir is set", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeFile(w, r, filepath.Join(dir, blocklist.Fail2banLog))
+}
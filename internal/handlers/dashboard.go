@@ -4,11 +4,34 @@ import (
 	"encoding/json"
 	"html/template"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/xHacka/nginx-log-analyzer/internal/repository"
 )
 
+// dashboardRanges are the quick-pick windows on the dashboard, each with the
+// bucket size used for the requests-over-time chart.
+var dashboardRanges = []struct {
+	Key    string
+	Dur    time.Duration
+	Bucket time.Duration
+}{
+	{"1h", time.Hour, time.Minute},
+	{"6h", 6 * time.Hour, 5 * time.Minute},
+	{"24h", 24 * time.Hour, 15 * time.Minute},
+	{"7d", 7 * 24 * time.Hour, time.Hour},
+	{"30d", 30 * 24 * time.Hour, 6 * time.Hour},
+}
+
+// customBuckets are tried in order for a custom from/to window; the first
+// that yields at most maxBuckets points is used.
+var customBuckets = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour,
+}
+
+const maxBuckets = 200
+
 type DashboardHandler struct {
 	Repo          repository.LogRepository
 	Template      *template.Template
@@ -19,33 +42,117 @@ type DashboardPageData struct {
 	PageID        string
 	UploadEnabled bool
 	*repository.DashboardStats
+	Ranges        []RangeOption
+	Custom        bool
+	RangeLabel    string
+	Host          string
+	TimeFrom      string
+	TimeTo        string
+	EventsURL     string // live /events stream for the same range and host
 	RequestsByHourJSON   string
 	StatusDistJSON       string
 	TopCountriesJSON     string
 	TopPathsJSON         string
+	TopRoutesJSON        string
+	TopASNsJSON          string
+	HumansVsBotsJSON     string
+	TopBrowsersJSON      string
 }
 
+// ServeHTTP renders the dashboard for a quick range (?range=1h|6h|24h|7d|30d,
+// default 24h) or a custom ?time_from=&time_to= window, optionally scoped to
+// one ?host=. The selection lives in the URL so it can be bookmarked.
 func (h *DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	since := time.Now().Add(-24 * time.Hour)
-	stats, err := h.Repo.GetDashboardStats(since)
+	q := r.URL.Query()
+	filters, bucket, rangeKey := dashboardScope(q, time.Now())
+	custom := rangeKey == ""
+
+	stats, err := h.Repo.GetDashboardStats(filters, bucket)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	ranges := make([]RangeOption, len(dashboardRanges))
+	for i, dr := range dashboardRanges {
+		rq := cloneValuesExcept(q, "range", "time_from", "time_to")
+		rq.Set("range", dr.Key)
+		ranges[i] = RangeOption{Key: dr.Key, Active: dr.Key == rangeKey, URL: "?" + rq.Encode()}
+	}
+	rangeLabel := rangeKey
+	if custom {
+		rangeLabel = "selected range"
+	}
+
+	eventsQuery := cloneValuesExcept(q)
+	eventsQuery.Set("view", "dashboard")
+
 	j1, _ := json.Marshal(stats.RequestsByHour)
 	j2, _ := json.Marshal(stats.StatusDistribution)
 	j3, _ := json.Marshal(stats.TopCountries)
 	j4, _ := json.Marshal(stats.TopPaths)
+	j5, _ := json.Marshal(stats.TopASNs)
+	j8, _ := json.Marshal(stats.TopRoutes)
+	j6, _ := json.Marshal(stats.HumansVsBots)
+	j7, _ := json.Marshal(stats.TopBrowsers)
 	data := DashboardPageData{
 		PageID:              "dashboard",
 		UploadEnabled:       h.UploadEnabled,
 		DashboardStats:      stats,
+		Ranges:              ranges,
+		Custom:              custom,
+		RangeLabel:          rangeLabel,
+		Host:                q.Get("host"),
+		TimeFrom:            q.Get("time_from"),
+		TimeTo:              q.Get("time_to"),
+		EventsURL:           "/events?" + eventsQuery.Encode(),
 		RequestsByHourJSON:   string(j1),
 		StatusDistJSON:      string(j2),
 		TopCountriesJSON:    string(j3),
 		TopPathsJSON:        string(j4),
+		TopRoutesJSON:       string(j8),
+		TopASNsJSON:         string(j5),
+		HumansVsBotsJSON:    string(j6),
+		TopBrowsersJSON:     string(j7),
 	}
 	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// dashboardScope turns the dashboard's URL parameters into filters and a
+// bucket size. rangeKey is the active quick range, or "" for a custom window.
+func dashboardScope(q url.Values, now time.Time) (filters repository.QueryFilters, bucket time.Duration, rangeKey string) {
+	filters = toRepoFilters(QueryFormFilters{TimeFrom: q.Get("time_from"), TimeTo: q.Get("time_to"), Host: q.Get("host")})
+	if filters.TimeFrom != nil || filters.TimeTo != nil {
+		if filters.TimeTo == nil {
+			filters.TimeTo = &now
+		}
+		if filters.TimeFrom == nil {
+			from := filters.TimeTo.Add(-24 * time.Hour)
+			filters.TimeFrom = &from
+		}
+		span := filters.TimeTo.Sub(*filters.TimeFrom)
+		bucket = customBuckets[len(customBuckets)-1]
+		for _, b := range customBuckets {
+			if span/b <= maxBuckets {
+				bucket = b
+				break
+			}
+		}
+		return filters, bucket, ""
+	}
+	rangeKey = q.Get("range")
+	dur := time.Duration(0)
+	for _, dr := range dashboardRanges {
+		if dr.Key == rangeKey {
+			dur, bucket = dr.Dur, dr.Bucket
+		}
+	}
+	if dur == 0 {
+		rangeKey, dur, bucket = "24h", 24*time.Hour, 15*time.Minute
+	}
+	from := now.Add(-dur)
+	filters.TimeFrom, filters.TimeTo = &from, &now
+	return filters, bucket, rangeKey
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const drilldownLimit = 15
+
+// PathHandler serves /path?p=..., the drill-down for one exact path.
+type PathHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+// HostHandler serves /host/{host}, the drill-down for one virtual host.
+type HostHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type DrilldownPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Kind          string // "Path" or "Host"
+	Subject       string
+	Ranges        []RangeOption
+	*repository.Breakdown
+	QueryURL   string
+	VolumeJSON string
+	StatusJSON string
+	IPs        []LinkedCount
+	Referrers  []LinkedCount
+	UserAgents []LinkedCount
+	Paths      []LinkedCount
+	Hosts      []LinkedCount
+}
+
+func (h *PathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("p")
+	if p == "" {
+		http.Error(w, "missing path parameter p", http.StatusBadRequest)
+		return
+	}
+	renderDrilldown(w, r, h.Repo, h.Template, h.UploadEnabled, "Path", p,
+		repository.QueryFilters{Path: p}, url.Values{"exact_path": {p}})
+}
+
+func (h *HostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := chi.URLParam(r, "host")
+	renderDrilldown(w, r, h.Repo, h.Template, h.UploadEnabled, "Host", host,
+		repository.QueryFilters{Host: host}, url.Values{"host": {host}})
+}
+
+// renderDrilldown breaks down the rows selected by filters over the chosen
+// quick range. scope holds the matching /query parameters for links.
+func renderDrilldown(w http.ResponseWriter, r *http.Request, repo repository.LogRepository, tmpl *template.Template,
+	uploadEnabled bool, kind, subject string, filters repository.QueryFilters, scope url.Values) {
+	rangeKey := r.URL.Query().Get("range")
+	dur := time.Duration(0)
+	for _, sr := range sourceRanges {
+		if sr.Key == rangeKey {
+			dur = sr.Dur
+		}
+	}
+	if dur == 0 {
+		rangeKey, dur = "7d", 7*24*time.Hour
+	}
+	since := time.Now().Add(-dur)
+	filters.TimeFrom = &since
+	bucket := "hour"
+	if dur > 7*24*time.Hour {
+		bucket = "day"
+	}
+
+	b, err := repo.Breakdown(filters, bucket, drilldownLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ranges := make([]RangeOption, len(sourceRanges))
+	for i, sr := range sourceRanges {
+		q := cloneValuesExcept(r.URL.Query(), "range")
+		q.Set("range", sr.Key)
+		ranges[i] = RangeOption{Key: sr.Key, Active: sr.Key == rangeKey, URL: "?" + q.Encode()}
+	}
+	scope.Set("time_from", since.UTC().Format("2006-01-02T15:04"))
+	link := func(key, value string) string {
+		q := cloneValuesExcept(scope)
+		if key != "" {
+			q.Set(key, value)
+		}
+		return "/query?" + q.Encode()
+	}
+	volumeJSON, _ := json.Marshal(b.Volume)
+	statusJSON, _ := json.Marshal(b.Statuses)
+	data := DrilldownPageData{
+		PageID:        "drilldown",
+		UploadEnabled: uploadEnabled,
+		Kind:          kind,
+		Subject:       subject,
+		Ranges:        ranges,
+		Breakdown:     b,
+		QueryURL:      link("", ""),
+		VolumeJSON:    string(volumeJSON),
+		StatusJSON:    string(statusJSON),
+	}
+	for _, lc := range b.TopIPs {
+		data.IPs = append(data.IPs, LinkedCount{lc.Label, lc.Count, "/ip/" + url.PathEscape(lc.Label)})
+	}
+	for _, lc := range b.TopReferrers {
+		data.Referrers = append(data.Referrers, LinkedCount{lc.Label, lc.Count, link("ref_domain", lc.Label)})
+	}
+	for _, lc := range b.TopUserAgents {
+		data.UserAgents = append(data.UserAgents, LinkedCount{lc.Label, lc.Count, link("exact_user_agent", lc.Label)})
+	}
+	for _, lc := range b.TopPaths {
+		data.Paths = append(data.Paths, LinkedCount{lc.Label, lc.Count, "/path?" + url.Values{"p": {lc.Label}}.Encode()})
+	}
+	for _, lc := range b.TopHosts {
+		data.Hosts = append(data.Hosts, LinkedCount{lc.Label, lc.Count, "/host/" + url.PathEscape(lc.Label)})
+	}
+	if err := tmpl.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
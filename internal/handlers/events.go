@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/live"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const (
+	// eventsMaxRows caps how many new rows one "entries" event carries; the
+	// count still reports all of them.
+	eventsMaxRows = 100
+	// statsInterval throttles dashboard recomputation while rows stream in.
+	statsInterval = 3 * time.Second
+	keepAlive     = 25 * time.Second
+)
+
+// EventsHandler streams Server-Sent Events for live pages.
+//
+//	/events?view=dashboard&range=...&host=...  "stats" events with DashboardStats
+//	/events?view=query&<query filters>         "entries" events with new rows
+//
+// Rows are rendered with the query page's "row" template so live rows look
+// exactly like server-rendered ones.
+type EventsHandler struct {
+	Repo     repository.LogRepository
+	Hub      *live.Hub
+	Template *template.Template // query page template
+}
+
+type entriesEvent struct {
+	Count int      `json:"count"`
+	Rows  []string `json:"rows"`
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	view := r.URL.Query().Get("view")
+	if view != "dashboard" && view != "query" {
+		http.Error(w, "view must be dashboard or query", http.StatusBadRequest)
+		return
+	}
+	cursor, err := h.Repo.MaxID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	notify, unsubscribe := h.Hub.Subscribe()
+	defer unsubscribe()
+	ping := time.NewTicker(keepAlive)
+	defer ping.Stop()
+	throttle := time.NewTicker(statsInterval)
+	defer throttle.Stop()
+	dirty := false
+
+	send := func(event string, payload interface{}) bool {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("events: %v", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case _, open := <-notify:
+			if !open {
+				return
+			}
+			if view == "dashboard" {
+				dirty = true
+				continue
+			}
+			ev, next, err := h.newEntries(r, cursor)
+			if err != nil {
+				log.Printf("events: %v", err)
+				continue
+			}
+			cursor = next
+			if ev.Count > 0 && !send("entries", ev) {
+				return
+			}
+		case <-throttle.C:
+			if !dirty {
+				continue
+			}
+			dirty = false
+			filters, bucket, _ := dashboardScope(r.URL.Query(), time.Now())
+			stats, err := h.Repo.GetDashboardStats(filters, bucket)
+			if err != nil {
+				log.Printf("events: %v", err)
+				continue
+			}
+			if !send("stats", stats) {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// newEntries renders rows stored after cursor that match the request's
+// query filters, newest first, and returns the new cursor.
+func (h *EventsHandler) newEntries(r *http.Request, cursor int64) (entriesEvent, int64, error) {
+	var ev entriesEvent
+	latest, err := h.Repo.MaxID()
+	if err != nil || latest <= cursor {
+		return ev, cursor, err
+	}
+	filters := toRepoFilters(parseQueryFilters(r))
+	filters.SinceID, filters.UntilID = cursor, latest
+	filters.SortBy, filters.SortDesc = "id", true
+	entries, total, _, err := h.Repo.Query(filters, eventsMaxRows, 0)
+	if err != nil {
+		return ev, cursor, err
+	}
+	ev.Count = total
+	for _, e := range entries {
+		var buf bytes.Buffer
+		if err := h.Template.ExecuteTemplate(&buf, "row", e); err != nil {
+			return ev, cursor, err
+		}
+		ev.Rows = append(ev.Rows, buf.String())
+	}
+	return ev, latest, nil
+}
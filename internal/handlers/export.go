@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// exportFormats lists the formats /export can produce, in the order the
+// query page links them.
+var exportFormats = []struct {
+	Key, Label, ContentType, Ext string
+}{
+	{"csv", "CSV", "text/csv; charset=utf-8", "csv"},
+	{"ndjson", "NDJSON", "application/x-ndjson", "ndjson"},
+	{"parquet", "Parquet", "application/vnd.apache.parquet", "parquet"},
+}
+
+// ExportHandler streams every row matching the /query filters as a file.
+type ExportHandler struct {
+	Repo repository.LogRepository
+}
+
+type ExportLink struct {
+	Label string
+	URL   string
+}
+
+// exportLinks returns links exporting the rows of a /query page, keeping its
+// filters and sort but not its paging.
+func exportLinks(q url.Values) []ExportLink {
+	links := make([]ExportLink, len(exportFormats))
+	for i, f := range exportFormats {
+		eq := cloneValuesExcept(q, "page", "page_size")
+		eq.Set("format", f.Key)
+		links[i] = ExportLink{Label: f.Label, URL: "/export?" + eq.Encode()}
+	}
+	return links
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	idx := -1
+	for i, f := range exportFormats {
+		if f.Key == format {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		http.Error(w, "format must be csv, ndjson or parquet", http.StatusBadRequest)
+		return
+	}
+	f := exportFormats[idx]
+	filters := toRepoFilters(parseQueryFilters(r))
+
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="access-`+time.Now().Format("20060102-150405")+"."+f.Ext+`"`)
+	var err error
+	switch f.Key {
+	case "csv":
+		err = exportCSV(w, h.Repo, filters)
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		err = h.Repo.Iterate(filters, func(e models.LogEntry) error { return enc.Encode(e) })
+	case "parquet":
+		err = exportParquet(w, h.Repo, filters)
+	}
+	if err != nil {
+		// Headers and part of the body are already sent; cut the
+		// connection so the client sees a failed download instead of a
+		// short file.
+		log.Printf("export: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+var exportColumns = []string{
+	"id", "time", "remote_addr", "host", "method", "path", "route", "query", "protocol", "status", "bytes",
+	"request_time", "referer", "user_agent", "country", "city", "asn", "as_org", "browser", "os", "device",
+	"is_bot", "bot_name", "session_id", "threats", "sample_rate",
+}
+
+func exportCSV(w http.ResponseWriter, repo repository.LogRepository, filters repository.QueryFilters) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return err
+	}
+	err := repo.Iterate(filters, func(e models.LogEntry) error {
+		requestTime := ""
+		if e.RequestTime >= 0 {
+			requestTime = strconv.FormatFloat(e.RequestTime, 'f', -1, 64)
+		}
+		record := []string{
+			strconv.FormatInt(e.ID, 10),
+			time.Unix(0, int64(e.Time*1e9)).UTC().Format("2006-01-02T15:04:05.000Z"),
+			e.RemoteAddr, e.Host, e.Method, e.Path, e.Route, e.Query, e.Protocol,
+			strconv.Itoa(e.Status),
+			strconv.FormatInt(e.Bytes, 10),
+			requestTime,
+			e.Referer, e.UserAgent, e.Country, e.City,
+			strconv.FormatInt(e.ASN, 10),
+			e.ASOrg, e.Browser, e.OS, e.Device,
+			strconv.FormatBool(e.IsBot),
+			e.BotName, e.SessionID, e.Threats,
+			strconv.Itoa(e.SampleRate),
+		}
+		for i, v := range record {
+			record[i] = csvSafe(v)
+		}
+		return cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvSafe defuses a cell that a spreadsheet would run as a formula. Paths,
+// user agents and referrers are chosen by whoever sent the request.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// parquetRow is the Parquet schema of an export, with the same columns as
+// the CSV. Time is milliseconds since the epoch and RequestTime is null when
+// it was not logged.
+type parquetRow struct {
+	ID          int64    `parquet:"name=id, type=INT64"`
+	Time        int64    `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	RemoteAddr  string   `parquet:"name=remote_addr, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Host        string   `parquet:"name=host, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Method      string   `parquet:"name=method, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Path        string   `parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Route       string   `parquet:"name=route, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Query       string   `parquet:"name=query, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Protocol    string   `parquet:"name=protocol, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Status      int32    `parquet:"name=status, type=INT32"`
+	Bytes       int64    `parquet:"name=bytes, type=INT64"`
+	RequestTime *float64 `parquet:"name=request_time, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Referer     string   `parquet:"name=referer, type=BYTE_ARRAY, convertedtype=UTF8"`
+	UserAgent   string   `parquet:"name=user_agent, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country     string   `parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	City        string   `parquet:"name=city, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ASN         int64    `parquet:"name=asn, type=INT64"`
+	ASOrg       string   `parquet:"name=as_org, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Browser     string   `parquet:"name=browser, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	OS          string   `parquet:"name=os, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Device      string   `parquet:"name=device, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	IsBot       bool     `parquet:"name=is_bot, type=BOOLEAN"`
+	BotName     string   `parquet:"name=bot_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SessionID   string   `parquet:"name=session_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Threats     string   `parquet:"name=threats, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SampleRate  int32    `parquet:"name=sample_rate, type=INT32"`
+}
+
+func exportParquet(w http.ResponseWriter, repo repository.LogRepository, filters repository.QueryFilters) error {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetRow), 1)
+	if err != nil {
+		return err
+	}
+	// Row groups are buffered in memory until full; keep them small so a
+	// large export streams out in pieces.
+	pw.RowGroupSize = 8 * 1024 * 1024
+	err = repo.Iterate(filters, func(e models.LogEntry) error {
+		row := parquetRow{
+			ID: e.ID, Time: int64(e.Time * 1000), RemoteAddr: e.RemoteAddr, Host: e.Host, Method: e.Method,
+			Path: e.Path, Route: e.Route, Query: e.Query, Protocol: e.Protocol, Status: int32(e.Status), Bytes: e.Bytes,
+			Referer: e.Referer, UserAgent: e.UserAgent, Country: e.Country, City: e.City, ASN: e.ASN, ASOrg: e.ASOrg,
+			Browser: e.Browser, OS: e.OS, Device: e.Device, IsBot: e.IsBot, BotName: e.BotName,
+			SessionID: e.SessionID, Threats: e.Threats, SampleRate: int32(e.SampleRate),
+		}
+		if e.RequestTime >= 0 {
+			rt := e.RequestTime
+			row.RequestTime = &rt
+		}
+		return pw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	return pw.WriteStop()
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const ipTopLimit = 15
+
+var weekdays = [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+type IPHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type HeatCell struct {
+	Count int64
+	Level int // 0 (none) to 4 (busiest hour)
+}
+
+type HeatRow struct {
+	Day   string
+	Cells []HeatCell
+}
+
+type IPPageData struct {
+	PageID        string
+	UploadEnabled bool
+	*repository.IPProfile
+	QueryURL    string
+	SessionsURL string
+	Statuses    []LinkedCount
+	Hosts       []LinkedCount
+	Paths       []LinkedCount
+	UserAgents  []LinkedCount
+	Heatmap     []HeatRow
+}
+
+// ServeHTTP shows the profile of one client address. Every list links to
+// /query narrowed to the address and the clicked value.
+func (h *IPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr := chi.URLParam(r, "addr")
+	profile, err := h.Repo.IPProfile(addr, ipTopLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	link := func(key, value string) string {
+		q := url.Values{}
+		q.Set("ip", addr)
+		if key != "" {
+			q.Set(key, value)
+		}
+		return "/query?" + q.Encode()
+	}
+	linked := func(key string, counts []repository.LabelCount) []LinkedCount {
+		out := make([]LinkedCount, len(counts))
+		for i, c := range counts {
+			out[i] = LinkedCount{Label: c.Label, Count: c.Count, URL: link(key, c.Label)}
+		}
+		return out
+	}
+	data := IPPageData{
+		PageID:        "ip",
+		UploadEnabled: h.UploadEnabled,
+		IPProfile:     profile,
+		QueryURL:      link("", ""),
+		SessionsURL:   "/sessions?" + url.Values{"ip": {addr}}.Encode(),
+		Statuses:      linked("status", profile.Statuses),
+		Hosts:         linked("host", profile.Hosts),
+		Paths:         linked("path", profile.Paths),
+		UserAgents:    linked("exact_user_agent", profile.UserAgents),
+		Heatmap:       heatmapRows(profile.Heatmap),
+	}
+	if profile.Requests == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// heatmapRows scales each cell against the busiest hour so the shading
+// shows the address's own rhythm rather than absolute volume.
+func heatmapRows(m [7][24]int64) []HeatRow {
+	var max int64
+	for _, day := range m {
+		for _, c := range day {
+			if c > max {
+				max = c
+			}
+		}
+	}
+	rows := make([]HeatRow, 7)
+	for d, day := range m {
+		rows[d] = HeatRow{Day: weekdays[d], Cells: make([]HeatCell, 24)}
+		for hr, c := range day {
+			cell := HeatCell{Count: c}
+			if c > 0 && max > 0 {
+				cell.Level = 1 + int(3*c/max)
+				if cell.Level > 4 {
+					cell.Level = 4
+				}
+			}
+			rows[d].Cells[hr] = cell
+		}
+	}
+	return rows
+}
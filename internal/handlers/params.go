@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const paramsLimit = 200
+
+type ParamsHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type ParamRow struct {
+	repository.ParamStat
+	// DistinctRatio is distinct values per request; close to 100% means
+	// nearly every request carries a new value (cache-busters, scrapers
+	// walking IDs, tracking tokens).
+	DistinctRatio float64
+	QueryURL      string
+}
+
+type ParamsPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Filters       QueryFormFilters
+	Params        []ParamRow
+	Limit         int
+}
+
+// ServeHTTP lists the most used query-string parameters per path. It accepts
+// the same filter parameters as /query.
+func (h *ParamsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := parseQueryFilters(r)
+	stats, err := h.Repo.ParamStats(toRepoFilters(filters), paramsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := make([]ParamRow, len(stats))
+	for i, s := range stats {
+		q := cloneValuesExcept(r.URL.Query(), "path", "params", "page")
+		q.Set("path", s.Path)
+		p := s.Name
+		if filters.Params != "" {
+			p = filters.Params + ", " + s.Name
+		}
+		q.Set("params", p)
+		rows[i] = ParamRow{ParamStat: s, QueryURL: "/query?" + q.Encode()}
+		if s.Requests > 0 {
+			rows[i].DistinctRatio = float64(s.DistinctValues) / float64(s.Requests) * 100
+		}
+	}
+	data := ParamsPageData{
+		PageID:        "params",
+		UploadEnabled: h.UploadEnabled,
+		Filters:       filters,
+		Params:        rows,
+		Limit:         paramsLimit,
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
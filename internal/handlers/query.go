@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/xHacka/nginx-log-analyzer/internal/config"
 	"github.com/xHacka/nginx-log-analyzer/internal/models"
 	"github.com/xHacka/nginx-log-analyzer/internal/repository"
 )
@@ -18,7 +19,7 @@ type QueryHandler struct {
 	Repo            repository.LogRepository
 	Template        *template.Template
 	UploadEnabled   bool
-	DefaultPageSize int
+	Config          *config.Live
 }
 
 type SortableColumn struct {
@@ -40,6 +41,8 @@ type QueryPageData struct {
 	UploadEnabled bool
 	Entries       []models.LogEntry
 	Total         int
+	Requests      int64 // Total scaled by sample rates
+	Sampled       bool
 	Page          int
 	Pages         int
 	PageSize      int
@@ -48,6 +51,11 @@ type QueryPageData struct {
 	PrevURL       string
 	NextURL       string
 	Columns       []SortableColumn
+	EventsURL     string
+	Exports       []ExportLink
+	// LivePrepend is set when new rows belong at the top of this page
+	// (first page, newest first); otherwise live updates only count them.
+	LivePrepend   bool
 }
 
 type QueryFormFilters struct {
@@ -55,10 +63,28 @@ type QueryFormFilters struct {
 	TimeTo     string
 	Status     string
 	Country    string
+	IP         string
+	ASN        string
 	PathContains string
+	ExactPath  string
+	Route      string
 	Method     string
 	Host       string
 	UserAgent  string
+	ExactUserAgent string
+	Browser    string
+	OS         string
+	Device     string
+	Bot        string
+	RefDomain  string
+	SearchEngine string
+	UTMSource  string
+	UTMMedium  string
+	UTMCampaign string
+	Session    string
+	Params     string
+	Threat     string
+	Incident   string
 	SortBy     string
 	SortDesc   bool
 }
@@ -66,14 +92,15 @@ type QueryFormFilters struct {
 func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	filters := parseQueryFilters(r)
 
-	pageSize := h.DefaultPageSize
+	defaultPageSize := h.Config.Get().PageSize
+	pageSize := defaultPageSize
 	if ps := r.URL.Query().Get("page_size"); ps != "" {
 		if n, err := strconv.Atoi(ps); err == nil {
 			pageSize = n
 		}
 	}
 	if !isAllowedPageSize(pageSize) {
-		pageSize = h.DefaultPageSize
+		pageSize = defaultPageSize
 	}
 
 	page := 1
@@ -85,7 +112,7 @@ func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	repoFilters := toRepoFilters(filters)
 	offset := (page - 1) * pageSize
-	entries, total, err := h.Repo.Query(repoFilters, pageSize, offset)
+	entries, total, requests, err := h.Repo.Query(repoFilters, pageSize, offset)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -119,11 +146,16 @@ func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pageSizes[i] = PageSizeOption{Size: s, Active: s == pageSize, URL: "?" + q.Encode()}
 	}
 
+	eventsQuery := cloneValuesExcept(baseQuery, "page", "page_size", "sort", "order")
+	eventsQuery.Set("view", "query")
+
 	data := QueryPageData{
 		PageID:        "query",
 		UploadEnabled: h.UploadEnabled,
 		Entries:       entries,
 		Total:         total,
+		Requests:      requests,
+		Sampled:       requests != int64(total),
 		Page:          page,
 		Pages:         pages,
 		PageSize:      pageSize,
@@ -132,6 +164,9 @@ func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		PrevURL:       prevURL,
 		NextURL:       nextURL,
 		Columns:       columns,
+		EventsURL:     "/events?" + eventsQuery.Encode(),
+		Exports:       exportLinks(baseQuery),
+		LivePrepend:   page == 1 && (filters.SortBy == "" || filters.SortBy == "time") && filters.SortDesc,
 	}
 	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -167,10 +202,28 @@ func parseQueryFilters(r *http.Request) QueryFormFilters {
 		TimeTo:     r.URL.Query().Get("time_to"),
 		Status:     r.URL.Query().Get("status"),
 		Country:    r.URL.Query().Get("country"),
+		IP:         r.URL.Query().Get("ip"),
+		ASN:        r.URL.Query().Get("asn"),
 		PathContains: r.URL.Query().Get("path"),
+		ExactPath:  r.URL.Query().Get("exact_path"),
+		Route:      r.URL.Query().Get("route"),
 		Method:     r.URL.Query().Get("method"),
 		Host:       r.URL.Query().Get("host"),
 		UserAgent:  r.URL.Query().Get("user_agent"),
+		ExactUserAgent: r.URL.Query().Get("exact_user_agent"),
+		Browser:    r.URL.Query().Get("browser"),
+		OS:         r.URL.Query().Get("os"),
+		Device:     r.URL.Query().Get("device"),
+		Bot:        r.URL.Query().Get("bot"),
+		RefDomain:  r.URL.Query().Get("ref_domain"),
+		SearchEngine: r.URL.Query().Get("search_engine"),
+		UTMSource:  r.URL.Query().Get("utm_source"),
+		UTMMedium:  r.URL.Query().Get("utm_medium"),
+		UTMCampaign: r.URL.Query().Get("utm_campaign"),
+		Session:    r.URL.Query().Get("session"),
+		Params:     r.URL.Query().Get("params"),
+		Threat:     r.URL.Query().Get("threat"),
+		Incident:   r.URL.Query().Get("incident"),
 		SortBy:     r.URL.Query().Get("sort"),
 		SortDesc:   r.URL.Query().Get("order") == "desc",
 	}
@@ -189,6 +242,8 @@ func buildSortColumns(base url.Values, currentSort string, currentDesc bool) []S
 		{"Bytes", "bytes"},
 		{"City", "city"},
 		{"Country", "country"},
+		{"ASN", "asn"},
+		{"Client", "browser"},
 		{"User Agent", "user_agent"},
 	}
 	if currentSort == "" {
@@ -242,9 +297,29 @@ func toRepoFilters(f QueryFormFilters) repository.QueryFilters {
 	}
 	rf.Status = strings.TrimSpace(f.Status)
 	rf.Country = f.Country
+	rf.RemoteAddr = strings.TrimSpace(f.IP)
+	rf.ASN = strings.TrimSpace(f.ASN)
 	rf.PathContains = f.PathContains
+	rf.Path = f.ExactPath
+	rf.Route = f.Route
 	rf.Method = f.Method
 	rf.Host = f.Host
 	rf.UserAgentContains = f.UserAgent
+	rf.UserAgent = f.ExactUserAgent
+	rf.Browser = f.Browser
+	rf.OS = f.OS
+	rf.Device = f.Device
+	rf.Bot = f.Bot
+	rf.RefDomain = f.RefDomain
+	rf.SearchEngine = f.SearchEngine
+	rf.UTMSource = f.UTMSource
+	rf.UTMMedium = f.UTMMedium
+	rf.UTMCampaign = f.UTMCampaign
+	rf.Session = f.Session
+	rf.Params = f.Params
+	rf.Threat = f.Threat
+	if id, err := strconv.ParseInt(f.Incident, 10, 64); err == nil && id > 0 {
+		rf.Incident = id
+	}
 	return rf
 }
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const routesLimit = 200
+
+type RoutesHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type RouteRow struct {
+	repository.RouteStat
+	QueryURL string
+}
+
+type RoutesPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Filters       QueryFormFilters
+	Routes        []RouteRow
+	Limit         int
+}
+
+// ServeHTTP aggregates requests by route template. It accepts the same
+// filter parameters as /query so a view can be narrowed down the same way.
+func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := parseQueryFilters(r)
+	stats, err := h.Repo.RouteStats(toRepoFilters(filters), routesLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := make([]RouteRow, len(stats))
+	for i, s := range stats {
+		q := cloneValuesExcept(r.URL.Query(), "route", "page")
+		q.Set("route", s.Route)
+		rows[i] = RouteRow{RouteStat: s, QueryURL: "/query?" + q.Encode()}
+	}
+	data := RoutesPageData{
+		PageID:        "routes",
+		UploadEnabled: h.UploadEnabled,
+		Filters:       filters,
+		Routes:        rows,
+		Limit:         routesLimit,
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/ingest"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+	"github.com/xHacka/nginx-log-analyzer/internal/threats"
+)
+
+const securityLimit = 25
+
+// SecurityHandler summarizes requests flagged by the attack rules.
+type SecurityHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+	Ingest        *ingest.LiveOptions // for the active rule set
+}
+
+type ThreatRuleRow struct {
+	repository.ThreatCount
+	Category    string
+	Description string // empty for rules no longer in the rule set
+	URL         string
+}
+
+type ThreatSourceRow struct {
+	repository.ThreatSource
+	URL string
+}
+
+// IncidentRow is a behaviour incident with links to its evidence rows.
+type IncidentRow struct {
+	repository.Incident
+	URL     string
+	Exports []ExportLink
+}
+
+type SecurityPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Enabled       bool // detection is on
+	Filters       QueryFormFilters
+	Ranges        []RangeOption
+	Custom        bool
+	Categories    []string
+	Requests      int64
+	UniqueIPs     int64
+	Rules         []ThreatRuleRow
+	TopIPs        []ThreatSourceRow
+	Hosts         []LinkedCount
+	Incidents     []IncidentRow
+	AllURL        string
+}
+
+func (h *SecurityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := parseQueryFilters(r)
+	repoFilters := toRepoFilters(filters)
+	ranges, custom := timeScope(r.URL.Query(), &repoFilters)
+
+	s, err := h.Repo.SecuritySummary(repoFilters, securityLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	incidents, err := h.Repo.Incidents(repoFilters, securityLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	detector := h.Ingest.Get().Threats
+	known := make(map[string]threats.Rule)
+	data := SecurityPageData{
+		PageID:        "security",
+		UploadEnabled: h.UploadEnabled,
+		Enabled:       detector != nil,
+		Filters:       filters,
+		Ranges:        ranges,
+		Custom:        custom,
+		Requests:      s.Requests,
+		UniqueIPs:     s.UniqueIPs,
+	}
+	seen := make(map[string]bool)
+	for _, rule := range detector.Rules() {
+		known[rule.ID] = rule
+		if !seen[rule.Category] {
+			seen[rule.Category] = true
+			data.Categories = append(data.Categories, rule.Category)
+		}
+	}
+
+	link := drilldown(r.URL.Query(), repoFilters, custom)
+	// Links keep a category or rule filter of the page and otherwise ask
+	// for any flagged row.
+	threat := filters.Threat
+	if threat == "" {
+		threat = "any"
+	}
+	data.AllURL = link(url.Values{"threat": {threat}})
+	// Flagged rows carry every rule they matched; when the page is narrowed
+	// to one category or rule, list only the rules it selects.
+	pick := strings.TrimSpace(filters.Threat)
+	if pick == "any" || strings.ContainsAny(pick, ",") || strings.HasPrefix(pick, "-") {
+		pick = ""
+	}
+	for _, tc := range s.Rules {
+		if pick != "" && tc.Rule != pick && !strings.HasPrefix(tc.Rule, pick+"-") {
+			continue
+		}
+		rule := known[tc.Rule]
+		data.Rules = append(data.Rules, ThreatRuleRow{
+			ThreatCount: tc,
+			Category:    rule.Category,
+			Description: rule.Description,
+			URL:         link(url.Values{"threat": {tc.Rule}}),
+		})
+	}
+	for _, ts := range s.TopIPs {
+		data.TopIPs = append(data.TopIPs, ThreatSourceRow{ts, link(url.Values{"ip": {ts.Addr}, "threat": {threat}})})
+	}
+	for _, lc := range s.Hosts {
+		data.Hosts = append(data.Hosts, LinkedCount{lc.Label, lc.Count, link(url.Values{"host": {lc.Label}, "threat": {threat}})})
+	}
+	// Evidence links carry no time range: the incident picks the rows.
+	for _, inc := range incidents {
+		q := url.Values{"incident": {strconv.FormatInt(inc.ID, 10)}, "sort": {"time"}, "order": {"asc"}}
+		data.Incidents = append(data.Incidents, IncidentRow{inc, "/query?" + q.Encode(), exportLinks(q)})
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
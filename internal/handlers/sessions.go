@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const sessionsLimit = 200
+
+// sessionOrders are the orderings offered on the sessions page.
+var sessionOrders = []struct{ Key, Label string }{
+	{"recent", "Most recent"},
+	{"duration", "Longest"},
+	{"requests", "Most requests"},
+}
+
+type SessionsHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type SessionRow struct {
+	repository.SessionSummary
+	Duration    string
+	TimelineURL string
+}
+
+type SessionsPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Filters       QueryFormFilters
+	Orders        []RangeOption
+	Order         string
+	Sessions      []SessionRow
+	Limit         int
+}
+
+// ServeHTTP lists visits among rows matching the /query filters. Each links
+// to its timeline, which is the /query table filtered to the session.
+func (h *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := parseQueryFilters(r)
+	order := r.URL.Query().Get("by")
+	valid := false
+	orders := make([]RangeOption, len(sessionOrders))
+	for i, o := range sessionOrders {
+		q := cloneValuesExcept(r.URL.Query(), "by")
+		q.Set("by", o.Key)
+		orders[i] = RangeOption{Key: o.Label, Active: o.Key == order, URL: "/sessions?" + q.Encode()}
+		valid = valid || o.Key == order
+	}
+	if !valid {
+		order = "recent"
+		orders[0].Active = true
+	}
+
+	stats, err := h.Repo.Sessions(toRepoFilters(filters), order, sessionsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := make([]SessionRow, len(stats))
+	for i, s := range stats {
+		q := url.Values{}
+		q.Set("session", s.ID)
+		q.Set("sort", "time")
+		q.Set("order", "asc")
+		rows[i] = SessionRow{
+			SessionSummary: s,
+			Duration:       formatDuration(s.End - s.Start),
+			TimelineURL:    "/query?" + q.Encode(),
+		}
+	}
+	data := SessionsPageData{
+		PageID:        "sessions",
+		UploadEnabled: h.UploadEnabled,
+		Filters:       filters,
+		Orders:        orders,
+		Order:         order,
+		Sessions:      rows,
+		Limit:         sessionsLimit,
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// formatDuration renders seconds as e.g. "45s", "12m 5s" or "2h 3m".
+func formatDuration(seconds float64) string {
+	n := int64(seconds)
+	switch {
+	case n < 60:
+		return fmt.Sprintf("%ds", n)
+	case n < 3600:
+		return fmt.Sprintf("%dm %ds", n/60, n%60)
+	default:
+		return fmt.Sprintf("%dh %dm", n/3600, n%3600/60)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const sourcesLimit = 25
+
+// sourceRanges are the quick-pick time ranges on the traffic sources and
+// security pages.
+var sourceRanges = []struct {
+	Key string
+	Dur time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"90d", 90 * 24 * time.Hour},
+}
+
+type SourcesHandler struct {
+	Repo          repository.LogRepository
+	Template      *template.Template
+	UploadEnabled bool
+}
+
+type RangeOption struct {
+	Key    string
+	Active bool
+	URL    string
+}
+
+type LinkedCount struct {
+	Label string
+	Count int64
+	URL   string
+}
+
+type SourcesPageData struct {
+	PageID        string
+	UploadEnabled bool
+	Filters       QueryFormFilters
+	Ranges        []RangeOption
+	Custom        bool
+	*repository.TrafficSources
+	Referrers    []LinkedCount
+	Engines      []LinkedCount
+	Landing      []LinkedCount
+	CampaignRows []CampaignRow
+}
+
+type CampaignRow struct {
+	repository.CampaignCount
+	URL string
+}
+
+func (h *SourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filters := parseQueryFilters(r)
+	repoFilters := toRepoFilters(filters)
+	ranges, custom := timeScope(r.URL.Query(), &repoFilters)
+
+	ts, err := h.Repo.TrafficSources(repoFilters, sourcesLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	link := drilldown(r.URL.Query(), repoFilters, custom)
+	data := SourcesPageData{
+		PageID:         "sources",
+		UploadEnabled:  h.UploadEnabled,
+		Filters:        filters,
+		Ranges:         ranges,
+		Custom:         custom,
+		TrafficSources: ts,
+	}
+	for _, lc := range ts.TopReferrers {
+		data.Referrers = append(data.Referrers, LinkedCount{lc.Label, lc.Count, link(url.Values{"ref_domain": {lc.Label}})})
+	}
+	for _, lc := range ts.SearchEngines {
+		data.Engines = append(data.Engines, LinkedCount{lc.Label, lc.Count, link(url.Values{"search_engine": {lc.Label}})})
+	}
+	for _, pc := range ts.LandingPaths {
+		data.Landing = append(data.Landing, LinkedCount{pc.Path, pc.Count, link(url.Values{"path": {pc.Path}})})
+	}
+	for _, cc := range ts.Campaigns {
+		data.CampaignRows = append(data.CampaignRows, CampaignRow{cc, link(url.Values{"utm_source": {cc.Source}, "utm_campaign": {cc.Campaign}})})
+	}
+	if err := h.Template.ExecuteTemplate(w, "base", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// timeScope limits rf to the quick range selected in q, 7 days by default,
+// unless q has an explicit from/to. It returns the range buttons and
+// whether the explicit range is in use.
+func timeScope(q url.Values, rf *repository.QueryFilters) ([]RangeOption, bool) {
+	custom := rf.TimeFrom != nil || rf.TimeTo != nil
+	rangeKey := q.Get("range")
+	if !custom {
+		dur := 7 * 24 * time.Hour
+		found := false
+		for _, sr := range sourceRanges {
+			if sr.Key == rangeKey {
+				dur, found = sr.Dur, true
+			}
+		}
+		if !found {
+			rangeKey = "7d"
+		}
+		since := time.Now().Add(-dur)
+		rf.TimeFrom = &since
+	}
+	ranges := make([]RangeOption, len(sourceRanges))
+	for i, sr := range sourceRanges {
+		rq := cloneValuesExcept(q, "range", "time_from", "time_to")
+		rq.Set("range", sr.Key)
+		ranges[i] = RangeOption{Key: sr.Key, Active: !custom && sr.Key == rangeKey, URL: "?" + rq.Encode()}
+	}
+	return ranges, custom
+}
+
+// drilldown returns a function that links to /query with the page's scope
+// (its query q, with the quick range turned into a start time) plus extra.
+func drilldown(q url.Values, rf repository.QueryFilters, custom bool) func(extra url.Values) string {
+	scope := cloneValuesExcept(q, "range")
+	if !custom {
+		scope.Set("time_from", rf.TimeFrom.UTC().Format("2006-01-02T15:04"))
+	}
+	return func(extra url.Values) string {
+		lq := cloneValuesExcept(scope)
+		for k, v := range extra {
+			lq[k] = v
+		}
+		return "/query?" + lq.Encode()
+	}
+}
@@ -9,8 +9,8 @@ import (
 )
 
 type UploadHandler struct {
-	Repo  repository.LogRepository
-	Rules ingest.FilterRules
+	Repo   repository.LogRepository
+	Ingest *ingest.LiveOptions
 }
 
 func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -25,7 +25,8 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	n, err := ingest.IngestReader(file, h.Repo, h.Rules)
+	live := ingest.NewLiveOptions(h.Ingest.Get().WithOwnState())
+	n, err := ingest.IngestReader(file, h.Repo, live)
 	if err != nil {
 		http.Error(w, "Failed to ingest: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,351 @@
+// Package incidents watches the ingest stream for abusive behaviour by one
+// client address over a sliding window: many distinct paths answered 404,
+// repeated failed logins, an abnormal request rate or a high error ratio.
+// Signatures in package threats look at single requests; these catch the
+// slow scanners and credential stuffing that no single request gives away.
+package incidents
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// Rule kinds.
+const (
+	NotFound      = "not_found"      // distinct paths answered 404
+	LoginFailures = "login_failures" // POSTs to a login path answered 401 or 403
+	RequestRate   = "request_rate"   // requests of any kind
+	ErrorRatio    = "error_ratio"    // percentage of requests answered 4xx or 5xx
+)
+
+// sweepEvery is how many observed entries pass between purges of idle
+// addresses.
+const sweepEvery = 10000
+
+// Rule opens an incident when the value measured for one address over
+// Window reaches Threshold.
+type Rule struct {
+	Kind        string
+	Window      time.Duration
+	Threshold   float64
+	MinRequests int64    // error_ratio: requests needed in the window before the ratio counts
+	Paths       []string // login_failures: path prefixes of login endpoints
+}
+
+// Store is where incidents are kept; repository.LogRepository is one.
+type Store interface {
+	SaveIncident(inc *repository.Incident, evidence []int64) error
+	LatestIncident(addr, kind string) (*repository.Incident, error)
+}
+
+type event struct {
+	time   float64
+	id     int64
+	weight int64
+	path   string
+	hit    bool // counts toward the value, e.g. a 404 or a failed login
+}
+
+// window is what one rule has seen of one address.
+type window struct {
+	events   []event // in time order
+	unlinked []event // hits in events not yet evidence of an incident, in time order
+	total    int64   // weight of events
+	hits     int64   // weight of events with hit set
+	paths    map[string]int
+	inc      *repository.Incident // open or most recent incident
+	pending  []int64              // evidence not saved yet
+}
+
+// Detector applies the rules to stored entries and saves what they find.
+// It is safe for concurrent use. A nil Detector detects nothing.
+type Detector struct {
+	mu     sync.Mutex
+	store  Store
+	rules  []Rule
+	state  map[string]*window // by kind and address
+	newest float64
+	calls  int
+}
+
+func New(store Store, rules []Rule) *Detector {
+	return &Detector{store: store, rules: rules, state: make(map[string]*window)}
+}
+
+// SetRules replaces the rules. Windows of kinds that stay enabled are kept.
+func (d *Detector) SetRules(rules []Rule) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rules = rules
+	for key := range d.state {
+		kind, _, _ := strings.Cut(key, "\x00")
+		if d.rule(kind) == nil {
+			delete(d.state, key)
+		}
+	}
+}
+
+// Fork returns an empty Detector with the same rules and store, for input
+// that should not interleave with this one's windows (e.g. an uploaded
+// historical file).
+func (d *Detector) Fork() *Detector {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return New(d.store, d.rules)
+}
+
+func (d *Detector) rule(kind string) *Rule {
+	for i := range d.rules {
+		if d.rules[i].Kind == kind {
+			return &d.rules[i]
+		}
+	}
+	return nil
+}
+
+// Observe feeds a batch of entries to the rules. Batches should arrive in
+// time order; an entry more than a window older than the newest one seen
+// from its address is not counted. Entries that were not stored (ID 0) are
+// ignored, since incidents link to their evidence rows. Incidents found or
+// extended are saved before it returns.
+func (d *Detector) Observe(entries []models.LogEntry) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.rules) == 0 {
+		return
+	}
+	// A whole file arrives as one batch, and it need not be sorted.
+	stored := make([]*models.LogEntry, 0, len(entries))
+	for i := range entries {
+		if entries[i].ID != 0 {
+			stored = append(stored, &entries[i])
+		}
+	}
+	sort.SliceStable(stored, func(i, j int) bool { return stored[i].Time < stored[j].Time })
+
+	dirty := make(map[*window]bool)
+	for _, e := range stored {
+		for j := range d.rules {
+			if w := d.observe(&d.rules[j], e); w != nil {
+				dirty[w] = true
+			}
+		}
+		if e.Time > d.newest {
+			d.newest = e.Time
+		}
+		d.calls++
+		if d.calls%sweepEvery == 0 {
+			d.sweep()
+		}
+	}
+	for w := range dirty {
+		d.save(w)
+	}
+}
+
+// save stores the incident of w with the evidence found since the last save.
+func (d *Detector) save(w *window) {
+	if w.inc == nil || len(w.pending) == 0 {
+		return
+	}
+	if err := d.store.SaveIncident(w.inc, w.pending); err != nil {
+		log.Printf("incidents: saving %s incident for %s: %v", w.inc.Kind, w.inc.RemoteAddr, err)
+	}
+	w.pending = nil
+}
+
+// observe adds e to the window of r for its address and returns the window
+// if that opened or extended an incident.
+func (d *Detector) observe(r *Rule, e *models.LogEntry) *window {
+	ev := event{time: e.Time, id: e.ID, weight: int64(max(e.SampleRate, 1)), path: e.Path}
+	switch r.Kind {
+	case NotFound:
+		if e.Status != 404 {
+			return nil
+		}
+		ev.hit = true
+	case LoginFailures:
+		if e.Method != "POST" || (e.Status != 401 && e.Status != 403) || !hasPrefix(e.Path, r.Paths) {
+			return nil
+		}
+		ev.hit = true
+	case RequestRate:
+		ev.hit = true
+	case ErrorRatio:
+		ev.hit = e.Status >= 400
+	default:
+		return nil
+	}
+
+	key := r.Kind + "\x00" + e.RemoteAddr
+	w := d.state[key]
+	if w == nil {
+		w = &window{}
+		if r.Kind == NotFound {
+			w.paths = make(map[string]int)
+		}
+		d.state[key] = w
+	}
+	span := r.Window.Seconds()
+	if n := len(w.events); n > 0 && w.events[n-1].time-e.Time > span {
+		return nil
+	}
+	w.add(ev)
+	w.prune(w.events[len(w.events)-1].time - span)
+
+	// Only a hit can push the value over the threshold, and it leaves
+	// something to attach as evidence.
+	value := w.value(r)
+	if !ev.hit || value < r.Threshold {
+		return nil
+	}
+	if w.inc == nil {
+		// After a restart the previous incident may still be going on.
+		prev, err := d.store.LatestIncident(e.RemoteAddr, r.Kind)
+		if err != nil {
+			log.Printf("incidents: %v", err)
+		}
+		w.inc = prev
+	}
+	if w.inc == nil || e.Time-w.inc.LastSeen > span || w.inc.StartedAt-e.Time > span {
+		d.save(w)
+		w.inc = &repository.Incident{Kind: r.Kind, RemoteAddr: e.RemoteAddr, Host: e.Host, StartedAt: e.Time, LastSeen: e.Time}
+	}
+	inc := w.inc
+	for _, ev := range w.unlinked {
+		w.pending = append(w.pending, ev.id)
+		inc.Requests += ev.weight
+		inc.StartedAt = min(inc.StartedAt, ev.time)
+		inc.LastSeen = max(inc.LastSeen, ev.time)
+	}
+	w.unlinked = w.unlinked[:0]
+	inc.Peak = max(inc.Peak, value)
+	inc.Summary = summary(r, inc.Peak)
+	return w
+}
+
+// add inserts ev in time order.
+func (w *window) add(ev event) {
+	w.events = insertByTime(w.events, ev)
+	w.total += ev.weight
+	if ev.hit {
+		w.hits += ev.weight
+		w.unlinked = insertByTime(w.unlinked, ev)
+	}
+	if w.paths != nil {
+		w.paths[ev.path]++
+	}
+}
+
+// prune drops events before cutoff.
+func (w *window) prune(cutoff float64) {
+	n := 0
+	for n < len(w.events) && w.events[n].time < cutoff {
+		ev := w.events[n]
+		w.total -= ev.weight
+		if ev.hit {
+			w.hits -= ev.weight
+		}
+		if w.paths != nil {
+			if w.paths[ev.path]--; w.paths[ev.path] <= 0 {
+				delete(w.paths, ev.path)
+			}
+		}
+		n++
+	}
+	// Slicing off the front instead of copying keeps this constant time;
+	// the dropped events are freed when append next grows the slice.
+	w.events = w.events[n:]
+	n = 0
+	for n < len(w.unlinked) && w.unlinked[n].time < cutoff {
+		n++
+	}
+	w.unlinked = w.unlinked[n:]
+}
+
+// insertByTime inserts ev into events, which are in time order. Entries
+// mostly arrive in order, so the search starts from the end.
+func insertByTime(events []event, ev event) []event {
+	i := len(events)
+	for i > 0 && events[i-1].time > ev.time {
+		i--
+	}
+	return slices.Insert(events, i, ev)
+}
+
+func (w *window) value(r *Rule) float64 {
+	switch r.Kind {
+	case NotFound:
+		return float64(len(w.paths))
+	case ErrorRatio:
+		if w.total < max(r.MinRequests, 1) {
+			return 0
+		}
+		return float64(w.hits) * 100 / float64(w.total)
+	}
+	return float64(w.hits)
+}
+
+// sweep forgets addresses that have been quiet for longer than their window.
+func (d *Detector) sweep() {
+	for key, w := range d.state {
+		kind, _, _ := strings.Cut(key, "\x00")
+		r := d.rule(kind)
+		if r == nil {
+			delete(d.state, key)
+			continue
+		}
+		w.prune(d.newest - r.Window.Seconds())
+		if len(w.events) == 0 && len(w.pending) == 0 {
+			delete(d.state, key)
+		}
+	}
+}
+
+func hasPrefix(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func summary(r *Rule, peak float64) string {
+	in := " in " + formatWindow(r.Window)
+	switch r.Kind {
+	case NotFound:
+		return fmt.Sprintf("up to %.0f distinct paths answered 404%s", peak, in)
+	case LoginFailures:
+		return fmt.Sprintf("up to %.0f failed login attempts%s", peak, in)
+	case RequestRate:
+		return fmt.Sprintf("up to %.0f requests%s", peak, in)
+	case ErrorRatio:
+		return fmt.Sprintf("up to %.0f%% of requests failed%s", peak, in)
+	}
+	return ""
+}
+
+func formatWindow(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	}
+	return d.String()
+}
@@ -0,0 +1,254 @@
+package incidents
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// memStore keeps incidents and their evidence in memory.
+type memStore struct {
+	incidents []repository.Incident
+	evidence  map[int64][]int64
+}
+
+func (s *memStore) SaveIncident(inc *repository.Incident, evidence []int64) error {
+	if s.evidence == nil {
+		s.evidence = make(map[int64][]int64)
+	}
+	if inc.ID == 0 {
+		inc.ID = int64(len(s.incidents) + 1)
+		s.incidents = append(s.incidents, *inc)
+	} else {
+		s.incidents[inc.ID-1] = *inc
+	}
+	s.evidence[inc.ID] = append(s.evidence[inc.ID], evidence...)
+	return nil
+}
+
+func (s *memStore) LatestIncident(addr, kind string) (*repository.Incident, error) {
+	for i := len(s.incidents) - 1; i >= 0; i-- {
+		if inc := s.incidents[i]; inc.RemoteAddr == addr && inc.Kind == kind {
+			return &inc, nil
+		}
+	}
+	return nil, nil
+}
+
+const t0 = 1700000000
+
+// req is a stored request sec seconds after t0.
+func req(id int64, sec float64, addr, method, path string, status int) models.LogEntry {
+	return models.LogEntry{ID: id, Time: t0 + sec, RemoteAddr: addr, Host: "example.com", Method: method, Path: path, Status: status, SampleRate: 1}
+}
+
+func notFound(id int64, sec float64, path string) models.LogEntry {
+	return req(id, sec, "192.0.2.1", "GET", path, 404)
+}
+
+type wantIncident struct {
+	kind     string
+	addr     string
+	evidence []int64
+	requests int64
+	from, to float64 // seconds after t0
+}
+
+func TestDetector(t *testing.T) {
+	notFound3 := []Rule{{Kind: NotFound, Window: 5 * time.Minute, Threshold: 3}}
+	tests := []struct {
+		name    string
+		rules   []Rule
+		batches [][]models.LogEntry
+		want    []wantIncident
+	}{
+		{
+			name:    "below threshold",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/b")}},
+		},
+		{
+			name:    "threshold reached",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/b"), notFound(3, 20, "/c")}},
+			want:    []wantIncident{{NotFound, "192.0.2.1", []int64{1, 2, 3}, 3, 0, 20}},
+		},
+		{
+			name:    "repeated path counts once",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/a"), notFound(3, 20, "/b"), notFound(4, 30, "/b")}},
+		},
+		{
+			name:  "other statuses ignored",
+			rules: notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/b"),
+				req(3, 20, "192.0.2.1", "GET", "/c", 200), req(4, 30, "192.0.2.1", "GET", "/d", 500)}},
+		},
+		{
+			name:    "spread wider than the window",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 200, "/b"), notFound(3, 400, "/c")}},
+		},
+		{
+			name:  "hits inside the window extend the incident",
+			rules: notFound3,
+			batches: [][]models.LogEntry{
+				{notFound(1, 0, "/a"), notFound(2, 10, "/b"), notFound(3, 20, "/c")},
+				{notFound(4, 200, "/d")},
+				{notFound(5, 450, "/e"), notFound(6, 460, "/f")},
+			},
+			want: []wantIncident{{NotFound, "192.0.2.1", []int64{1, 2, 3, 4, 5, 6}, 6, 0, 460}},
+		},
+		{
+			name:  "a gap longer than the window opens a new incident",
+			rules: notFound3,
+			batches: [][]models.LogEntry{
+				{notFound(1, 0, "/a"), notFound(2, 10, "/b"), notFound(3, 20, "/c")},
+				{notFound(4, 1000, "/a"), notFound(5, 1010, "/b"), notFound(6, 1020, "/c")},
+			},
+			want: []wantIncident{
+				{NotFound, "192.0.2.1", []int64{1, 2, 3}, 3, 0, 20},
+				{NotFound, "192.0.2.1", []int64{4, 5, 6}, 3, 1000, 1020},
+			},
+		},
+		{
+			name:    "unsorted batch",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(3, 20, "/c"), notFound(1, 0, "/a"), notFound(2, 10, "/b")}},
+			want:    []wantIncident{{NotFound, "192.0.2.1", []int64{1, 2, 3}, 3, 0, 20}},
+		},
+		{
+			name:  "late batch within the window",
+			rules: notFound3,
+			batches: [][]models.LogEntry{
+				{notFound(3, 100, "/c"), notFound(4, 110, "/d")},
+				{notFound(1, 30, "/a"), notFound(2, 40, "/b")},
+			},
+			want: []wantIncident{{NotFound, "192.0.2.1", []int64{1, 2, 3, 4}, 4, 30, 110}},
+		},
+		{
+			name:  "late batch extends an open incident backwards",
+			rules: notFound3,
+			batches: [][]models.LogEntry{
+				{notFound(3, 100, "/c"), notFound(4, 110, "/d"), notFound(5, 120, "/e")},
+				{notFound(1, 50, "/a")},
+			},
+			want: []wantIncident{{NotFound, "192.0.2.1", []int64{1, 3, 4, 5}, 4, 50, 120}},
+		},
+		{
+			name:  "entries older than the window are dropped",
+			rules: notFound3,
+			batches: [][]models.LogEntry{
+				{notFound(3, 1000, "/c"), notFound(4, 1010, "/d")},
+				{notFound(1, 0, "/a"), notFound(2, 10, "/b")},
+			},
+		},
+		{
+			name:  "addresses are separate",
+			rules: notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/b"),
+				req(3, 20, "192.0.2.2", "GET", "/c", 404)}},
+		},
+		{
+			name:    "unstored entries are ignored",
+			rules:   notFound3,
+			batches: [][]models.LogEntry{{notFound(1, 0, "/a"), notFound(2, 10, "/b"), notFound(0, 20, "/c")}},
+		},
+		{
+			name:  "login failures",
+			rules: []Rule{{Kind: LoginFailures, Window: time.Minute, Threshold: 2, Paths: []string{"/login"}}},
+			batches: [][]models.LogEntry{{
+				req(1, 0, "192.0.2.1", "POST", "/login", 401),
+				req(2, 1, "192.0.2.1", "GET", "/login", 401),
+				req(3, 2, "192.0.2.1", "POST", "/signup", 403),
+				req(4, 3, "192.0.2.1", "POST", "/login", 200),
+				req(5, 4, "192.0.2.1", "POST", "/login/2fa", 403),
+			}},
+			want: []wantIncident{{LoginFailures, "192.0.2.1", []int64{1, 5}, 2, 0, 4}},
+		},
+		{
+			name:  "request rate weighs sampled rows",
+			rules: []Rule{{Kind: RequestRate, Window: time.Minute, Threshold: 20}},
+			batches: [][]models.LogEntry{func() []models.LogEntry {
+				a, b := req(1, 0, "192.0.2.1", "GET", "/", 200), req(2, 5, "192.0.2.1", "GET", "/", 200)
+				a.SampleRate, b.SampleRate = 10, 10
+				return []models.LogEntry{a, b}
+			}()},
+			want: []wantIncident{{RequestRate, "192.0.2.1", []int64{1, 2}, 20, 0, 5}},
+		},
+		{
+			name:  "error ratio needs min requests",
+			rules: []Rule{{Kind: ErrorRatio, Window: time.Minute, Threshold: 50, MinRequests: 4}},
+			batches: [][]models.LogEntry{{
+				req(1, 0, "192.0.2.1", "GET", "/", 500),
+				req(2, 1, "192.0.2.1", "GET", "/", 500),
+				req(3, 2, "192.0.2.1", "GET", "/", 200),
+				req(4, 3, "192.0.2.1", "GET", "/", 502),
+			}},
+			want: []wantIncident{{ErrorRatio, "192.0.2.1", []int64{1, 2, 4}, 3, 0, 3}},
+		},
+		{
+			name:  "error ratio below threshold",
+			rules: []Rule{{Kind: ErrorRatio, Window: time.Minute, Threshold: 50, MinRequests: 4}},
+			batches: [][]models.LogEntry{{
+				req(1, 0, "192.0.2.1", "GET", "/", 500),
+				req(2, 1, "192.0.2.1", "GET", "/", 200),
+				req(3, 2, "192.0.2.1", "GET", "/", 200),
+				req(4, 3, "192.0.2.1", "GET", "/", 200),
+				req(5, 4, "192.0.2.1", "GET", "/", 404),
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memStore{}
+			d := New(store, tt.rules)
+			for _, b := range tt.batches {
+				d.Observe(b)
+			}
+			if len(store.incidents) != len(tt.want) {
+				t.Fatalf("got %d incidents %+v, want %d", len(store.incidents), store.incidents, len(tt.want))
+			}
+			for i, w := range tt.want {
+				inc := store.incidents[i]
+				evidence := slices.Clone(store.evidence[inc.ID])
+				slices.Sort(evidence)
+				got := wantIncident{inc.Kind, inc.RemoteAddr, evidence, inc.Requests, inc.StartedAt - t0, inc.LastSeen - t0}
+				if fmt.Sprint(got) != fmt.Sprint(w) {
+					t.Errorf("incident %d = %+v, want %+v", i, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorResumesAfterRestart(t *testing.T) {
+	store := &memStore{}
+	rules := []Rule{{Kind: NotFound, Window: 5 * time.Minute, Threshold: 3}}
+	New(store, rules).Observe([]models.LogEntry{notFound(1, 0, "/a"), notFound(2, 10, "/b"), notFound(3, 20, "/c")})
+	// A new Detector has no windows, so it needs three paths again, but
+	// then carries on with the stored incident instead of opening one.
+	New(store, rules).Observe([]models.LogEntry{notFound(4, 60, "/d"), notFound(5, 70, "/e"), notFound(6, 80, "/f")})
+	if len(store.incidents) != 1 {
+		t.Fatalf("got %d incidents, want 1", len(store.incidents))
+	}
+	if n := len(store.evidence[1]); n != 6 {
+		t.Errorf("incident has %d evidence rows, want 6", n)
+	}
+	if inc := store.incidents[0]; inc.Requests != 6 || inc.LastSeen != t0+80 {
+		t.Errorf("incident = %+v", inc)
+	}
+}
+
+func TestNilDetector(t *testing.T) {
+	var d *Detector
+	d.Observe([]models.LogEntry{notFound(1, 0, "/a")})
+	d.SetRules(nil)
+	if d.Fork() != nil {
+		t.Error("Fork of a nil Detector is not nil")
+	}
+}
@@ -2,18 +2,30 @@ package ingest
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/xHacka/nginx-log-analyzer/internal/geoip"
+	"github.com/xHacka/nginx-log-analyzer/internal/incidents"
+	"github.com/xHacka/nginx-log-analyzer/internal/metrics"
 	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/privacy"
+	"github.com/xHacka/nginx-log-analyzer/internal/referrer"
 	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+	"github.com/xHacka/nginx-log-analyzer/internal/routes"
+	"github.com/xHacka/nginx-log-analyzer/internal/sessions"
+	"github.com/xHacka/nginx-log-analyzer/internal/threats"
+	"github.com/xHacka/nginx-log-analyzer/internal/useragent"
 )
 
 const batchSize = 1000
@@ -68,6 +80,64 @@ func NewFilterRules(ips []string, exts []string, methods []string, statuses []in
 	return r
 }
 
+// Options holds everything that decides how raw log lines become stored entries.
+type Options struct {
+	Rules    FilterRules
+	Sampling Sampler
+	GeoIP    *geoip.DB // optional; looked up before Privacy rewrites the IP
+	Routes   *routes.Normalizer
+	// Threats flags attack patterns; nil detects nothing. It runs before
+	// Privacy so stripped query parameters are still inspected.
+	Threats  *threats.Detector
+	// Sessions assigns session ids. It keeps state between batches, so the
+	// same Tracker is carried over when Options are rebuilt on reload.
+	Sessions *sessions.Tracker
+	// Incidents watches stored entries for abusive behaviour per address.
+	// Like Sessions it keeps state between batches and is carried over on
+	// reload; nil detects nothing.
+	Incidents *incidents.Detector
+	// Privacy, when set, scrubs entries before they are stored. With
+	// PrivacyDelay set it only scrubs entries older than that, the age at
+	// which the background job rewrites stored rows, so re-reading an old
+	// file does not bring raw addresses back.
+	Privacy      *privacy.Anonymizer
+	PrivacyDelay time.Duration
+	// Metrics counts malformed lines; nil records nothing.
+	Metrics *metrics.Registry
+}
+
+// LiveOptions holds the active Options and lets them be swapped (e.g. on a
+// config reload) without interrupting tailing or uploads. Each batch uses the
+// Options that were active when it started.
+type LiveOptions struct {
+	p atomic.Pointer[Options]
+}
+
+func NewLiveOptions(opts *Options) *LiveOptions {
+	l := &LiveOptions{}
+	l.p.Store(opts)
+	return l
+}
+
+func (l *LiveOptions) Get() *Options {
+	return l.p.Load()
+}
+
+// WithOwnState returns a copy of o whose session tracker and incident
+// detector start empty. Uploaded files are usually older than the live log,
+// and sharing the tailer's state would split or merge visits and incidents
+// across the two.
+func (o *Options) WithOwnState() *Options {
+	c := *o
+	c.Sessions = o.Sessions.Fork()
+	c.Incidents = o.Incidents.Fork()
+	return &c
+}
+
+func (l *LiveOptions) Set(opts *Options) {
+	l.p.Store(opts)
+}
+
 func (r FilterRules) ShouldSkip(e models.LogEntry) bool {
 	if _, ok := r.WhitelistedIPs[e.RemoteAddr]; ok {
 		return true
@@ -93,8 +163,12 @@ func (r FilterRules) ShouldSkip(e models.LogEntry) bool {
 }
 
 // ParseJSONLines reads newline-delimited JSON and returns LogEntry slice.
-func ParseJSONLines(r io.Reader, rules FilterRules) ([]models.LogEntry, error) {
+func ParseJSONLines(r io.Reader, opts *Options) ([]models.LogEntry, error) {
 	var entries []models.LogEntry
+	scrubBefore := math.Inf(1)
+	if opts.PrivacyDelay > 0 {
+		scrubBefore = float64(time.Now().Add(-opts.PrivacyDelay).UnixNano()) / 1e9
+	}
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Bytes()
@@ -103,12 +177,30 @@ func ParseJSONLines(r io.Reader, rules FilterRules) ([]models.LogEntry, error) {
 		}
 		var row models.NginxLogRow
 		if err := json.Unmarshal(line, &row); err != nil {
+			opts.Metrics.MalformedLine()
 			continue // skip malformed lines
 		}
 		e := parseRow(&row)
-		if rules.ShouldSkip(e) {
+		if opts.Rules.ShouldSkip(e) {
+			continue
+		}
+		// Sessionize before sampling so dropped requests still keep a
+		// visit alive, and before Privacy so truncated IPs don't merge visitors.
+		opts.Sessions.Assign(&e)
+		if !opts.Sampling.Keep(&e) {
 			continue
 		}
+		e.Route = e.Path
+		if opts.Routes != nil {
+			e.Route = opts.Routes.Route(e.Path)
+		}
+		if opts.GeoIP != nil {
+			opts.GeoIP.Enrich(&e)
+		}
+		e.Threats = opts.Threats.Match(&e)
+		if opts.Privacy.Enabled() && e.Time < scrubBefore {
+			opts.Privacy.Apply(&e)
+		}
 		entries = append(entries, e)
 	}
 	return entries, scanner.Err()
@@ -125,6 +217,22 @@ func parseRow(row *models.NginxLogRow) models.LogEntry {
 	e.City = row.City
 	e.Country = row.Country
 	e.UserAgent = row.UserAgent
+	e.SampleRate = 1
+
+	e.Referer = row.Referer
+	ref := referrer.Parse(row.Referer, row.Host)
+	e.RefDomain = ref.Domain
+	e.SearchEngine = ref.SearchEngine
+	e.SearchTerms = ref.SearchTerms
+	e.UTMSource, e.UTMMedium, e.UTMCampaign = referrer.UTM(row.Query)
+
+	ua := useragent.Parse(row.UserAgent)
+	e.Browser = ua.Browser
+	e.BrowserVer = ua.BrowserVersion
+	e.OS = ua.OS
+	e.Device = ua.Device
+	e.IsBot = ua.IsBot
+	e.BotName = ua.BotName
 
 	if t, err := strconv.ParseFloat(row.Time, 64); err == nil {
 		e.Time = t
@@ -135,30 +243,37 @@ func parseRow(row *models.NginxLogRow) models.LogEntry {
 	if b, err := strconv.ParseInt(row.Bytes, 10, 64); err == nil {
 		e.Bytes = b
 	}
+	e.RequestTime = -1
+	if rt, err := strconv.ParseFloat(row.RequestTime, 64); err == nil && rt >= 0 {
+		e.RequestTime = rt
+	}
 	e.CreatedAt = time.Now()
 	return e
 }
 
 // IngestFile reads a file and inserts entries into the repository.
-func IngestFile(path string, repo repository.LogRepository, rules FilterRules) (int, error) {
+func IngestFile(path string, repo repository.LogRepository, live *LiveOptions) (int, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
-	entries, err := ParseJSONLines(f, rules)
+	opts := live.Get()
+	entries, err := ParseJSONLines(f, opts)
 	if err != nil {
 		return 0, err
 	}
 	if err := repo.InsertBatch(entries); err != nil {
 		return 0, err
 	}
+	opts.Incidents.Observe(entries)
 	return len(entries), nil
 }
 
 // IngestReader reads from an io.Reader (e.g. uploaded file) and inserts.
-func IngestReader(r io.Reader, repo repository.LogRepository, rules FilterRules) (int, error) {
-	entries, err := ParseJSONLines(r, rules)
+func IngestReader(r io.Reader, repo repository.LogRepository, live *LiveOptions) (int, error) {
+	opts := live.Get()
+	entries, err := ParseJSONLines(r, opts)
 	if err != nil {
 		return 0, err
 	}
@@ -171,12 +286,13 @@ func IngestReader(r io.Reader, repo repository.LogRepository, rules FilterRules)
 		if err := repo.InsertBatch(entries[i:end]); err != nil {
 			return i, err
 		}
+		opts.Incidents.Observe(entries[i:end])
 	}
 	return len(entries), nil
 }
 
 // TailFile watches a file for changes and ingests new lines.
-func TailFile(path string, repo repository.LogRepository, rules FilterRules, stopCh <-chan struct{}) error {
+func TailFile(path string, repo repository.LogRepository, live *LiveOptions, stopCh <-chan struct{}) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -206,50 +322,67 @@ func TailFile(path string, repo repository.LogRepository, rules FilterRules, sto
 				return nil
 			}
 			if event.Op&fsnotify.Write == fsnotify.Write {
-				ingestNewLines(path, &offset, repo, rules)
+				ingestNewLines(path, &offset, repo, live)
 			}
 		case err := <-watcher.Errors:
 			if err != nil {
 				log.Printf("fsnotify error: %v", err)
 			}
 		case <-ticker.C:
-			ingestNewLines(path, &offset, repo, rules)
+			ingestNewLines(path, &offset, repo, live)
 		}
 	}
 }
 
-func ingestNewLines(path string, offset *int64, repo repository.LogRepository, rules FilterRules) {
+func ingestNewLines(path string, offset *int64, repo repository.LogRepository, live *LiveOptions) {
 	f, err := os.Open(path)
 	if err != nil {
 		return
 	}
 	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() < *offset {
+		// Truncated or replaced by a shorter file: start over.
+		*offset = 0
+	}
 	if _, err := f.Seek(*offset, 0); err != nil {
 		return
 	}
-	entries, err := ParseJSONLines(f, rules)
+	buf, err := io.ReadAll(f)
 	if err != nil {
 		return
 	}
+	// Only whole lines: nginx may be halfway through writing the last one,
+	// and it is read again on the next tick.
+	end := bytes.LastIndexByte(buf, '\n')
+	if end < 0 {
+		return
+	}
+	buf = buf[:end+1]
+	opts := live.Get()
+	entries, err := ParseJSONLines(bytes.NewReader(buf), opts)
+	if err != nil {
+		return
+	}
+	// Move past the lines even if all were skipped, so malformed or
+	// filtered lines are not read (and counted) again on every tick.
 	if len(entries) > 0 {
 		if err := repo.InsertBatch(entries); err != nil {
 			log.Printf("ingest error: %v", err)
-		} else {
-			if info, err := f.Stat(); err == nil {
-				*offset = info.Size()
-			}
+			return
 		}
+		opts.Incidents.Observe(entries)
 	}
+	*offset += int64(len(buf))
 }
 
 // ReadFullFileAndTail reads existing content first, then tails.
-func ReadFullFileAndTail(path string, repo repository.LogRepository, rules FilterRules, stopCh <-chan struct{}) error {
-	n, err := IngestFile(path, repo, rules)
+func ReadFullFileAndTail(path string, repo repository.LogRepository, live *LiveOptions, stopCh <-chan struct{}) error {
+	n, err := IngestFile(path, repo, live)
 	if err != nil {
 		return err
 	}
 	if n > 0 {
 		log.Printf("Ingested %d lines from %s", n, path)
 	}
-	return TailFile(path, repo, rules, stopCh)
+	return TailFile(path, repo, live, stopCh)
 }
@@ -0,0 +1,73 @@
+package ingest
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// SamplingRule keeps roughly one in KeepOneIn matching requests. Host and
+// PathPrefix narrow which requests the rule applies to; empty matches all.
+type SamplingRule struct {
+	Host       string
+	PathPrefix string
+	KeepOneIn  int
+	KeepErrors bool // always keep 4xx/5xx responses, unsampled
+}
+
+// Sampler applies the first matching SamplingRule to each entry.
+type Sampler struct {
+	rules []SamplingRule
+}
+
+func NewSampler(rules []SamplingRule) Sampler {
+	s := Sampler{}
+	for _, r := range rules {
+		r.Host = strings.ToLower(strings.TrimSpace(r.Host))
+		if r.KeepOneIn < 1 {
+			r.KeepOneIn = 1
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s
+}
+
+// Keep reports whether e should be stored and sets e.SampleRate to the
+// number of requests the stored row stands for. The choice is a hash of the
+// line rather than a coin toss, so re-reading a file keeps the same rows
+// and the duplicates index drops them all.
+func (s Sampler) Keep(e *models.LogEntry) bool {
+	e.SampleRate = 1
+	for _, r := range s.rules {
+		if r.Host != "" && r.Host != strings.ToLower(e.Host) {
+			continue
+		}
+		if r.PathPrefix != "" && !strings.HasPrefix(e.Path, r.PathPrefix) {
+			continue
+		}
+		if r.KeepOneIn == 1 || (r.KeepErrors && e.Status >= 400) {
+			return true
+		}
+		if sampleHash(e)%uint64(r.KeepOneIn) != 0 {
+			return false
+		}
+		e.SampleRate = r.KeepOneIn
+		return true
+	}
+	return true
+}
+
+// sampleHash hashes the fields that identify a log line.
+func sampleHash(e *models.LogEntry) uint64 {
+	h := fnv.New64a()
+	for _, f := range []string{
+		strconv.FormatFloat(e.Time, 'f', -1, 64), e.RemoteAddr, e.Host, e.Method, e.Path, e.Query,
+		strconv.Itoa(e.Status), strconv.FormatInt(e.Bytes, 10),
+	} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
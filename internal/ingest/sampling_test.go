@@ -0,0 +1,95 @@
+package ingest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+func TestSamplerKeepUnsampled(t *testing.T) {
+	s := NewSampler([]SamplingRule{
+		{Host: " Static.Example.com ", KeepOneIn: 1000},
+		{PathPrefix: "/health", KeepOneIn: 1},
+		{PathPrefix: "/api/", KeepOneIn: 1000, KeepErrors: true},
+		{Host: "zero.example.com", KeepOneIn: 0},
+	})
+	tests := []struct {
+		name  string
+		entry models.LogEntry
+	}{
+		{"no rule matches", models.LogEntry{Host: "www.example.com", Path: "/", Status: 200}},
+		{"keep one in 1", models.LogEntry{Host: "www.example.com", Path: "/health", Status: 200}},
+		{"errors kept", models.LogEntry{Host: "www.example.com", Path: "/api/users", Status: 503}},
+		{"client errors kept", models.LogEntry{Host: "www.example.com", Path: "/api/users", Status: 404}},
+		{"keep one in 0 means 1", models.LogEntry{Host: "zero.example.com", Path: "/", Status: 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Try many lines so a rule that samples would drop some.
+			for i := 0; i < 100; i++ {
+				e := tt.entry
+				e.Time = float64(1700000000 + i)
+				e.SampleRate = 7
+				if !s.Keep(&e) {
+					t.Fatalf("line %d dropped", i)
+				}
+				if e.SampleRate != 1 {
+					t.Fatalf("line %d: SampleRate = %d, want 1", i, e.SampleRate)
+				}
+			}
+		})
+	}
+}
+
+func TestSamplerKeepSampled(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []SamplingRule
+		entry     models.LogEntry
+		keepOneIn int
+	}{
+		{"host", []SamplingRule{{Host: "Static.Example.com", KeepOneIn: 10}},
+			models.LogEntry{Host: "STATIC.example.com", Path: "/a.css", Status: 200}, 10},
+		{"path prefix", []SamplingRule{{PathPrefix: "/api/", KeepOneIn: 4}},
+			models.LogEntry{Host: "www.example.com", Path: "/api/users", Status: 200}, 4},
+		{"first match wins", []SamplingRule{{PathPrefix: "/api/", KeepOneIn: 5}, {KeepOneIn: 50}},
+			models.LogEntry{Host: "www.example.com", Path: "/api/users", Status: 200}, 5},
+		{"errors sampled without KeepErrors", []SamplingRule{{KeepOneIn: 10}},
+			models.LogEntry{Host: "www.example.com", Path: "/", Status: 500}, 10},
+	}
+	const lines = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSampler(tt.rules)
+			kept := 0
+			for i := 0; i < lines; i++ {
+				e := tt.entry
+				e.Time = float64(1700000000 + i)
+				e.RemoteAddr = fmt.Sprintf("192.0.2.%d", i%256)
+				if !s.Keep(&e) {
+					continue
+				}
+				kept++
+				if e.SampleRate != tt.keepOneIn {
+					t.Fatalf("line %d: SampleRate = %d, want %d", i, e.SampleRate, tt.keepOneIn)
+				}
+			}
+			want := lines / tt.keepOneIn
+			if kept < want*8/10 || kept > want*12/10 {
+				t.Errorf("kept %d of %d lines, want about %d", kept, lines, want)
+			}
+		})
+	}
+}
+
+func TestSamplerKeepStable(t *testing.T) {
+	s := NewSampler([]SamplingRule{{KeepOneIn: 3}})
+	for i := 0; i < 1000; i++ {
+		e := models.LogEntry{Time: float64(1700000000 + i), RemoteAddr: "198.51.100.7", Host: "example.com", Method: "GET", Path: "/", Status: 200, Bytes: 512}
+		again := e
+		if s.Keep(&e) != s.Keep(&again) {
+			t.Fatalf("line %d: re-reading the same line changed whether it is kept", i)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package live
+
+import (
+	"sync"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// Hub tells subscribers that new rows were stored. Notifications carry no
+// data; subscribers query what they need, so a slow client only ever has
+// one pending signal instead of a growing backlog.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[chan struct{}]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value after new rows are
+// stored, and a function to unsubscribe. The channel is closed when the hub
+// is closed.
+func (h *Hub) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Notify signals every subscriber without blocking.
+func (h *Hub) Notify() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close disconnects all subscribers, e.g. so server shutdown does not wait
+// for open event streams.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = nil
+	h.closed = true
+}
+
+// Repository notifies a Hub whenever InsertBatch stores new rows. Everything
+// else is passed through to the wrapped repository.
+type Repository struct {
+	repository.LogRepository
+	Hub *Hub
+}
+
+func (r *Repository) InsertBatch(entries []models.LogEntry) error {
+	if err := r.LogRepository.InsertBatch(entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.ID != 0 {
+			r.Hub.Notify()
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+// durationBuckets are the upper bounds, in seconds, of both the request
+// duration and the query latency histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// knownMethods keeps the method label bounded; anything else is "OTHER".
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// Registry holds the metrics served on /metrics. Traffic metrics count rows
+// as they are stored, scaled by sample rate, so they match the dashboard.
+// Methods are safe on a nil Registry, which records nothing.
+type Registry struct {
+	mu        sync.Mutex
+	dbPath    string
+	maxHosts  int
+	hosts     map[string]bool
+	requests  map[[3]string]float64 // host, status class, method
+	bytes     map[string]float64    // host
+	durations map[string]*histogram // host
+	queries   map[string]*histogram // repository method
+	malformed int64
+	lag       float64
+	lagSet    bool
+}
+
+type histogram struct {
+	counts []float64 // per bucket, not cumulative
+	sum    float64
+	count  float64
+}
+
+func (h *histogram) observe(v, weight float64) {
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i] += weight
+			break
+		}
+	}
+	h.sum += v * weight
+	h.count += weight
+}
+
+// New returns a Registry that reports the size of the database at dbPath and
+// labels at most maxHosts distinct hosts; later ones are counted as "other".
+func New(dbPath string, maxHosts int) *Registry {
+	return &Registry{
+		dbPath:    dbPath,
+		maxHosts:  maxHosts,
+		hosts:     make(map[string]bool),
+		requests:  make(map[[3]string]float64),
+		bytes:     make(map[string]float64),
+		durations: make(map[string]*histogram),
+		queries:   make(map[string]*histogram),
+	}
+}
+
+// hostLabel must be called with mu held.
+func (m *Registry) hostLabel(host string) string {
+	if m.hosts[host] {
+		return host
+	}
+	if len(m.hosts) >= m.maxHosts {
+		return "other"
+	}
+	m.hosts[host] = true
+	return host
+}
+
+// Observe records newly stored entries (those with an ID).
+func (m *Registry) Observe(entries []models.LogEntry) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	newest := 0.0
+	for _, e := range entries {
+		if e.ID == 0 {
+			continue
+		}
+		weight := float64(e.SampleRate)
+		if weight < 1 {
+			weight = 1
+		}
+		host := m.hostLabel(e.Host)
+		method := e.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		class := "other"
+		if e.Status >= 100 && e.Status < 600 {
+			class = strconv.Itoa(e.Status/100) + "xx"
+		}
+		m.requests[[3]string{host, class, method}] += weight
+		m.bytes[host] += float64(e.Bytes) * weight
+		if e.RequestTime >= 0 {
+			h := m.durations[host]
+			if h == nil {
+				h = &histogram{counts: make([]float64, len(durationBuckets))}
+				m.durations[host] = h
+			}
+			h.observe(e.RequestTime, weight)
+		}
+		if e.Time > newest {
+			newest = e.Time
+		}
+	}
+	if newest > 0 {
+		m.lag = float64(time.Now().UnixNano())/1e9 - newest
+		m.lagSet = true
+	}
+}
+
+// MalformedLine counts a log line that could not be parsed.
+func (m *Registry) MalformedLine() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.malformed++
+	m.mu.Unlock()
+}
+
+// ObserveQuery records how long a repository read that started at start took.
+func (m *Registry) ObserveQuery(op string, start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.queries[op]
+	if h == nil {
+		h = &histogram{counts: make([]float64, len(durationBuckets))}
+		m.queries[op] = h
+	}
+	h.observe(d, 1)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format. They are
+// rendered before anything is sent, so a slow scraper does not hold up
+// ingestion.
+func (m *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.mu.Lock()
+	m.render(&buf)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// render writes all metrics to w. The caller holds mu.
+func (m *Registry) render(w io.Writer) {
+	family(w, "nla_http_requests_total", "counter", "Requests seen in the ingested logs, scaled by sample rate.")
+	keys := make([][3]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		return a[2] < b[2]
+	})
+	for _, k := range keys {
+		sample(w, "nla_http_requests_total", labels("host", k[0], "status_class", k[1], "method", k[2]), m.requests[k])
+	}
+
+	family(w, "nla_http_response_bytes_total", "counter", "Response bytes sent, from $body_bytes_sent, scaled by sample rate.")
+	for _, host := range sortedKeys(m.bytes) {
+		sample(w, "nla_http_response_bytes_total", labels("host", host), m.bytes[host])
+	}
+
+	family(w, "nla_http_request_duration_seconds", "histogram", "Request time from $request_time, for lines that have it.")
+	for _, host := range sortedKeys(m.durations) {
+		writeHistogram(w, "nla_http_request_duration_seconds", "host", host, m.durations[host])
+	}
+
+	family(w, "nla_ingest_malformed_lines_total", "counter", "Log lines skipped because they were not valid JSON.")
+	sample(w, "nla_ingest_malformed_lines_total", "", float64(m.malformed))
+
+	if m.lagSet {
+		family(w, "nla_ingest_lag_seconds", "gauge", "Age of the newest request in the last stored batch when it was stored.")
+		sample(w, "nla_ingest_lag_seconds", "", m.lag)
+	}
+
+	family(w, "nla_db_size_bytes", "gauge", "Size of the SQLite database, including its write-ahead log.")
+	sample(w, "nla_db_size_bytes", "", float64(fileSize(m.dbPath)+fileSize(m.dbPath+"-wal")))
+
+	family(w, "nla_db_query_duration_seconds", "histogram", "Time taken by database reads, by repository method.")
+	for _, op := range sortedKeys(m.queries) {
+		writeHistogram(w, "nla_db_query_duration_seconds", "op", op, m.queries[op])
+	}
+}
+
+func family(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w io.Writer, name, labels string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func writeHistogram(w io.Writer, name, label, value string, h *histogram) {
+	cumulative := 0.0
+	for i, b := range durationBuckets {
+		cumulative += h.counts[i]
+		sample(w, name+"_bucket", labels(label, value, "le", strconv.FormatFloat(b, 'g', -1, 64)), cumulative)
+	}
+	sample(w, name+"_bucket", labels(label, value, "le", "+Inf"), h.count)
+	sample(w, name+"_sum", labels(label, value), h.sum)
+	sample(w, name+"_count", labels(label, value), h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name/value pairs as {a="1",b="2"}.
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i] + `="` + labelEscaper.Replace(pairs[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Repository records stored rows and the latency of reads in a Registry.
+// Everything else is passed through to the wrapped repository.
+type Repository struct {
+	repository.LogRepository
+	Metrics *Registry
+}
+
+func (r *Repository) InsertBatch(entries []models.LogEntry) error {
+	if err := r.LogRepository.InsertBatch(entries); err != nil {
+		return err
+	}
+	r.Metrics.Observe(entries)
+	return nil
+}
+
+func (r *Repository) Query(filters repository.QueryFilters, limit, offset int) ([]models.LogEntry, int, int64, error) {
+	defer r.Metrics.ObserveQuery("query", time.Now())
+	return r.LogRepository.Query(filters, limit, offset)
+}
+
+func (r *Repository) QueryAfter(filters repository.QueryFilters, cursor *repository.EntryCursor, limit int) ([]models.LogEntry, error) {
+	defer r.Metrics.ObserveQuery("query_after", time.Now())
+	return r.LogRepository.QueryAfter(filters, cursor, limit)
+}
+
+func (r *Repository) Aggregate(filters repository.QueryFilters, by string, limit int) ([]repository.GroupStat, error) {
+	defer r.Metrics.ObserveQuery("aggregate", time.Now())
+	return r.LogRepository.Aggregate(filters, by, limit)
+}
+
+func (r *Repository) RouteStats(filters repository.QueryFilters, limit int) ([]repository.RouteStat, error) {
+	defer r.Metrics.ObserveQuery("route_stats", time.Now())
+	return r.LogRepository.RouteStats(filters, limit)
+}
+
+func (r *Repository) TrafficSources(filters repository.QueryFilters, limit int) (*repository.TrafficSources, error) {
+	defer r.Metrics.ObserveQuery("traffic_sources", time.Now())
+	return r.LogRepository.TrafficSources(filters, limit)
+}
+
+func (r *Repository) ParamStats(filters repository.QueryFilters, limit int) ([]repository.ParamStat, error) {
+	defer r.Metrics.ObserveQuery("param_stats", time.Now())
+	return r.LogRepository.ParamStats(filters, limit)
+}
+
+func (r *Repository) Sessions(filters repository.QueryFilters, orderBy string, limit int) ([]repository.SessionSummary, error) {
+	defer r.Metrics.ObserveQuery("sessions", time.Now())
+	return r.LogRepository.Sessions(filters, orderBy, limit)
+}
+
+func (r *Repository) IPProfile(addr string, limit int) (*repository.IPProfile, error) {
+	defer r.Metrics.ObserveQuery("ip_profile", time.Now())
+	return r.LogRepository.IPProfile(addr, limit)
+}
+
+func (r *Repository) Breakdown(filters repository.QueryFilters, bucket string, limit int) (*repository.Breakdown, error) {
+	defer r.Metrics.ObserveQuery("breakdown", time.Now())
+	return r.LogRepository.Breakdown(filters, bucket, limit)
+}
+
+func (r *Repository) GetDashboardStats(filters repository.QueryFilters, bucket time.Duration) (*repository.DashboardStats, error) {
+	defer r.Metrics.ObserveQuery("dashboard_stats", time.Now())
+	return r.LogRepository.GetDashboardStats(filters, bucket)
+}
@@ -11,6 +11,7 @@ type LogEntry struct {
 	Host       string    `json:"host"`
 	Method     string    `json:"method"`
 	Path       string    `json:"path"`
+	Route      string    `json:"route"`       // Path normalized to a route template
 	Query      string    `json:"query"`       // $args, stored as "q" in nginx
 	Protocol   string    `json:"protocol"`
 	Status     int       `json:"status"`
@@ -18,6 +19,26 @@ type LogEntry struct {
 	City       string    `json:"city"`
 	Country    string    `json:"country"`
 	UserAgent  string    `json:"user_agent"`
+	Referer    string    `json:"referer"`
+	RefDomain  string    `json:"ref_domain"`    // external referring domain
+	SearchEngine string  `json:"search_engine"`
+	SearchTerms  string  `json:"search_terms"`
+	UTMSource   string   `json:"utm_source"`
+	UTMMedium   string   `json:"utm_medium"`
+	UTMCampaign string   `json:"utm_campaign"`
+	Browser    string    `json:"browser"`
+	BrowserVer string    `json:"browser_version"`
+	OS         string    `json:"os"`
+	Device     string    `json:"device"` // desktop, mobile, tablet, bot
+	IsBot      bool      `json:"is_bot"`
+	BotName    string    `json:"bot_name"`
+	ASN        int64     `json:"asn"`
+	ASOrg      string    `json:"as_org"`
+	RequestTime float64  `json:"request_time"` // seconds; -1 when the log has no $request_time
+	SessionID  string    `json:"session_id"` // visit by the same IP and user agent
+	Threats    string    `json:"threats"`    // comma-separated ids of the attack rules matched
+	SampleRate int       `json:"sample_rate"` // row stands for this many requests (1 = unsampled)
+	Anonymized bool      `json:"anonymized"`  // IP and query already scrubbed
 	CreatedAt  time.Time `json:"created_at"`
 }
 
@@ -35,4 +56,6 @@ type NginxLogRow struct {
 	City       string `json:"city"`
 	Country    string `json:"country"`
 	UserAgent  string `json:"user_agent"`
+	Referer    string `json:"referer"`
+	RequestTime string `json:"request_time"`
 }
@@ -0,0 +1,128 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"github.com/xHacka/nginx-log-analyzer/internal/referrer"
+)
+
+const (
+	IPModeNone     = ""
+	IPModeTruncate = "truncate" // IPv4 to /24, IPv6 to /48
+	IPModeHMAC     = "hmac"     // keyed pseudonym, stable for a given key
+)
+
+// Anonymizer rewrites the personal parts of an entry: the client address and
+// configured query-string parameters.
+type Anonymizer struct {
+	ipMode string
+	key    []byte
+	strip  map[string]struct{}
+}
+
+func New(ipMode, hmacKey string, stripParams []string) (*Anonymizer, error) {
+	switch ipMode {
+	case IPModeNone, IPModeTruncate:
+	case IPModeHMAC:
+		if hmacKey == "" {
+			return nil, fmt.Errorf("ip mode %q needs a key", ipMode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown ip mode %q", ipMode)
+	}
+	a := &Anonymizer{ipMode: ipMode, key: []byte(hmacKey), strip: make(map[string]struct{})}
+	for _, p := range stripParams {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			a.strip[p] = struct{}{}
+		}
+	}
+	return a, nil
+}
+
+// Enabled reports whether Apply changes anything.
+func (a *Anonymizer) Enabled() bool {
+	return a != nil && (a.ipMode != IPModeNone || len(a.strip) > 0)
+}
+
+func (a *Anonymizer) Apply(e *models.LogEntry) {
+	e.RemoteAddr = a.IP(e.RemoteAddr)
+	e.Query = a.Query(e.Query)
+	if ref := a.URL(e.Referer); ref != e.Referer {
+		// Search terms come from the referrer's query string; keep only
+		// what survives the scrub.
+		e.Referer = ref
+		e.SearchTerms = referrer.Parse(ref, e.Host).SearchTerms
+	}
+	e.Anonymized = true
+}
+
+// IP returns the anonymized form of addr. Values that are not IP addresses
+// (including already anonymized ones) are only touched in HMAC mode.
+func (a *Anonymizer) IP(addr string) string {
+	switch a.ipMode {
+	case IPModeTruncate:
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return addr
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	case IPModeHMAC:
+		if addr == "" || strings.HasPrefix(addr, "anon-") {
+			return addr
+		}
+		mac := hmac.New(sha256.New, a.key)
+		mac.Write([]byte(addr))
+		return "anon-" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	return addr
+}
+
+// URL applies Query to the query-string part of a full URL, such as a
+// Referer header.
+func (a *Anonymizer) URL(u string) string {
+	base, q, ok := strings.Cut(u, "?")
+	if !ok {
+		return u
+	}
+	q, frag, hasFrag := strings.Cut(q, "#")
+	out := base
+	if q = a.Query(q); q != "" {
+		out += "?" + q
+	}
+	if hasFrag {
+		out += "#" + frag
+	}
+	return out
+}
+
+// Query drops the configured parameters from a raw query string, keeping the
+// remaining parameters in their original order and encoding.
+func (a *Anonymizer) Query(q string) string {
+	if len(a.strip) == 0 || q == "" {
+		return q
+	}
+	parts := strings.Split(q, "&")
+	kept := parts[:0]
+	for _, p := range parts {
+		key, _, _ := strings.Cut(p, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if _, ok := a.strip[strings.ToLower(key)]; ok {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,80 @@
+package referrer
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Info describes where a request came from.
+type Info struct {
+	Domain       string // referring host without "www.", empty for direct or internal traffic
+	SearchEngine string
+	SearchTerms  string
+}
+
+// searchEngines maps a domain marker to the engine name and the query
+// parameter that carries the search terms. Most engines no longer send the
+// terms, in which case only the engine is recorded.
+var searchEngines = []struct {
+	marker, name, param string
+}{
+	{"google.", "Google", "q"},
+	{"bing.com", "Bing", "q"},
+	{"duckduckgo.com", "DuckDuckGo", "q"},
+	{"search.yahoo.", "Yahoo", "p"},
+	{"yandex.", "Yandex", "text"},
+	{"baidu.com", "Baidu", "wd"},
+	{"ecosia.org", "Ecosia", "q"},
+	{"search.brave.com", "Brave", "q"},
+	{"qwant.com", "Qwant", "q"},
+	{"startpage.com", "Startpage", "query"},
+	{"naver.com", "Naver", "query"},
+	{"seznam.cz", "Seznam", "q"},
+}
+
+// Parse classifies a Referer header for a request to host. Referrers from
+// host itself (internal navigation) yield an empty Info.
+func Parse(referer, host string) Info {
+	var info Info
+	if referer == "" || referer == "-" {
+		return info
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return info
+	}
+	domain := trimWWW(strings.ToLower(u.Hostname()))
+	if domain == trimWWW(strings.ToLower(hostOnly(host))) {
+		return info
+	}
+	info.Domain = domain
+	for _, se := range searchEngines {
+		if strings.Contains(domain, se.marker) {
+			info.SearchEngine = se.name
+			info.SearchTerms = strings.TrimSpace(u.Query().Get(se.param))
+			break
+		}
+	}
+	return info
+}
+
+// UTM returns the utm_source, utm_medium and utm_campaign values of a raw
+// query string.
+func UTM(rawQuery string) (source, medium, campaign string) {
+	if !strings.Contains(rawQuery, "utm_") {
+		return "", "", ""
+	}
+	q, _ := url.ParseQuery(rawQuery)
+	return strings.ToLower(q.Get("utm_source")), strings.ToLower(q.Get("utm_medium")), q.Get("utm_campaign")
+}
+
+func trimWWW(h string) string {
+	return strings.TrimPrefix(h, "www.")
+}
+
+func hostOnly(h string) string {
+	if i := strings.LastIndex(h, ":"); i >= 0 && !strings.Contains(h[i:], "]") {
+		return h[:i]
+	}
+	return h
+}
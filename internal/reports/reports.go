@@ -0,0 +1,322 @@
+package reports
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/mailer"
+	"github.com/xHacka/nginx-log-analyzer/internal/repository"
+)
+
+const (
+	retryAfter  = 15 * time.Minute
+	maxAttempts = 3
+	topIPs      = 20 // busiest addresses checked for being new
+	newIPWindow = 7 * 24 * time.Hour
+)
+
+// Report is a traffic summary mailed every day or week at Hour, server local
+// time. It covers the calendar day or the seven days before the day it is
+// sent.
+type Report struct {
+	Name    string
+	Weekly  bool
+	Weekday time.Weekday // for weekly reports
+	Hour    int
+	Host    string // include/exclude list as on /query; empty = all hosts
+	To      []string
+}
+
+// Scheduler sends reports when they are due. A report whose mail fails is
+// retried a few times before waiting for its next run.
+type Scheduler struct {
+	Repo     repository.LogRepository
+	Template *template.Template
+
+	mu      sync.Mutex
+	reports []Report
+	mailer  *mailer.Mailer
+	state   map[string]*schedule
+}
+
+type schedule struct {
+	due      time.Time // the run being attempted; it decides the period
+	retryAt  time.Time
+	attempts int
+}
+
+func NewScheduler(repo repository.LogRepository, tmpl *template.Template) *Scheduler {
+	return &Scheduler{Repo: repo, Template: tmpl, state: make(map[string]*schedule)}
+}
+
+// Set replaces the reports and the mailer that sends them. Reports whose
+// name and timing are unchanged keep their next run; the others are
+// scheduled from now, so a run missed while the server was down is skipped.
+func (s *Scheduler) Set(reports []Report, m *mailer.Mailer, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := make(map[string]*schedule, len(reports))
+	for _, r := range reports {
+		st := s.state[r.Name]
+		if st == nil || !s.sameTiming(r) {
+			due := r.next(now)
+			st = &schedule{due: due, retryAt: due}
+		}
+		state[r.Name] = st
+	}
+	s.reports, s.mailer, s.state = reports, m, state
+}
+
+func (s *Scheduler) sameTiming(r Report) bool {
+	for _, old := range s.reports {
+		if old.Name == r.Name {
+			return old.Weekly == r.Weekly && old.Weekday == r.Weekday && old.Hour == r.Hour
+		}
+	}
+	return false
+}
+
+// Run sends the reports that are due at now.
+func (s *Scheduler) Run(now time.Time) {
+	type job struct {
+		r   Report
+		due time.Time
+	}
+	s.mu.Lock()
+	var jobs []job
+	for _, r := range s.reports {
+		if st := s.state[r.Name]; !now.Before(st.retryAt) {
+			jobs = append(jobs, job{r, st.due})
+		}
+	}
+	m := s.mailer
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		err := Send(s.Repo, s.Template, m, j.r, j.due)
+		s.mu.Lock()
+		st := s.state[j.r.Name]
+		if st == nil || !st.due.Equal(j.due) {
+			// Rescheduled by Set while sending.
+			s.mu.Unlock()
+			continue
+		}
+		st.attempts++
+		switch {
+		case err == nil:
+			log.Printf("reports: sent %s to %s", j.r.Name, strings.Join(j.r.To, ", "))
+		case st.attempts < maxAttempts:
+			log.Printf("reports: %s: %v (retrying in %v)", j.r.Name, err, retryAfter)
+			st.retryAt = now.Add(retryAfter)
+			s.mu.Unlock()
+			continue
+		default:
+			log.Printf("reports: %s: %v (giving up until the next run)", j.r.Name, err)
+		}
+		due := j.r.next(now)
+		*st = schedule{due: due, retryAt: due}
+		s.mu.Unlock()
+	}
+}
+
+// next returns the first run of r after t.
+func (r Report) next(t time.Time) time.Time {
+	run := time.Date(t.Year(), t.Month(), t.Day(), r.Hour, 0, 0, 0, t.Location())
+	for !run.After(t) || (r.Weekly && run.Weekday() != r.Weekday) {
+		run = run.AddDate(0, 0, 1)
+	}
+	return run
+}
+
+// period returns the span a run at due covers: the calendar day or week
+// that ended at the midnight before it.
+func (r Report) period(due time.Time) (from, to time.Time) {
+	to = time.Date(due.Year(), due.Month(), due.Day(), 0, 0, 0, 0, due.Location())
+	if r.Weekly {
+		return to.AddDate(0, 0, -7), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+// Send builds the report for the run at due and mails it.
+func Send(repo repository.LogRepository, tmpl *template.Template, m *mailer.Mailer, r Report, due time.Time) error {
+	if m == nil {
+		return fmt.Errorf("smtp is not configured")
+	}
+	data, err := build(repo, r, due)
+	if err != nil {
+		return err
+	}
+	var html bytes.Buffer
+	if err := tmpl.Execute(&html, data); err != nil {
+		return err
+	}
+	return m.Send(mailer.Message{To: r.To, Subject: data.Title, Text: data.text(), HTML: html.String()})
+}
+
+type reportData struct {
+	Title    string
+	Host     string
+	Period   string // "day" or "week"
+	From, To time.Time
+	Figures  []figure
+	Paths    []row
+	NewIPs   []row
+}
+
+type figure struct {
+	Label string
+	Value string
+	Delta string // change from the same period a week earlier
+}
+
+type row struct {
+	Key      string
+	Requests string
+	Delta    string
+}
+
+func build(repo repository.LogRepository, r Report, due time.Time) (*reportData, error) {
+	from, to := r.period(due)
+	// The dashboard range includes its end; stop just short of midnight.
+	last := to.Add(-time.Millisecond)
+	weekAgoFrom, weekAgoLast := from.AddDate(0, 0, -7), last.AddDate(0, 0, -7)
+	bucket := time.Hour
+	if r.Weekly {
+		bucket = 24 * time.Hour
+	}
+	cur, err := repo.GetDashboardStats(repository.QueryFilters{TimeFrom: &from, TimeTo: &last, Host: r.Host}, bucket)
+	if err != nil {
+		return nil, err
+	}
+	prev, err := repo.GetDashboardStats(repository.QueryFilters{TimeFrom: &weekAgoFrom, TimeTo: &weekAgoLast, Host: r.Host}, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &reportData{Host: r.Host, Period: "day", From: from, To: to}
+	kind := "Daily"
+	span := from.Format("Mon 2 Jan 2006")
+	if r.Weekly {
+		d.Period, kind = "week", "Weekly"
+		span = from.Format("2 Jan") + " - " + last.Format("2 Jan 2006")
+	}
+	d.Title = kind + " traffic report: " + span
+	if r.Host != "" {
+		d.Title += " (" + r.Host + ")"
+	}
+	d.Figures = []figure{
+		{"Requests", formatCount(cur.TotalRequests), percentDelta(cur.TotalRequests, prev.TotalRequests)},
+		{"Error rate (4xx+5xx)", strconv.FormatFloat(cur.ErrorRate, 'f', 1, 64) + "%", pointDelta(cur.ErrorRate, prev.ErrorRate, prev.TotalRequests > 0)},
+		{"Unique IPs", formatCount(cur.UniqueIPs), percentDelta(cur.UniqueIPs, prev.UniqueIPs)},
+	}
+	prevPaths := make(map[string]int64, len(prev.TopPaths))
+	for _, p := range prev.TopPaths {
+		prevPaths[p.Path] = p.Count
+	}
+	for _, p := range cur.TopPaths {
+		pr := row{Key: p.Path, Requests: formatCount(p.Count), Delta: "not in top " + strconv.Itoa(len(prev.TopPaths))}
+		if n, ok := prevPaths[p.Path]; ok {
+			pr.Delta = percentDelta(p.Count, n)
+		} else if len(prev.TopPaths) == 0 {
+			pr.Delta = "-"
+		}
+		d.Paths = append(d.Paths, pr)
+	}
+
+	// New top IPs: the busiest addresses of the period that made no
+	// request in the week before it.
+	busiest, err := repo.Aggregate(repository.QueryFilters{TimeFrom: &from, TimeTo: &last, Host: r.Host}, "remote_addr", topIPs)
+	if err != nil {
+		return nil, err
+	}
+	if len(busiest) > 0 {
+		addrs := make([]string, len(busiest))
+		for i, g := range busiest {
+			addrs[i] = g.Key
+		}
+		seenFrom, seenTo := from.Add(-newIPWindow), from.Add(-time.Millisecond)
+		seen, err := repo.Aggregate(repository.QueryFilters{TimeFrom: &seenFrom, TimeTo: &seenTo, Host: r.Host, RemoteAddr: strings.Join(addrs, ",")}, "remote_addr", topIPs)
+		if err != nil {
+			return nil, err
+		}
+		known := make(map[string]bool, len(seen))
+		for _, g := range seen {
+			known[g.Key] = true
+		}
+		for _, g := range busiest {
+			if !known[g.Key] {
+				d.NewIPs = append(d.NewIPs, row{Key: g.Key, Requests: formatCount(g.Requests)})
+			}
+		}
+	}
+	return d, nil
+}
+
+// text is the plain text alternative of the HTML mail.
+func (d *reportData) text() string {
+	var b strings.Builder
+	b.WriteString(d.Title + "\n\n")
+	fmt.Fprintf(&b, "%-22s %12s   %s\n", "", "", "vs a week earlier")
+	for _, f := range d.Figures {
+		fmt.Fprintf(&b, "%-22s %12s   %s\n", f.Label, f.Value, f.Delta)
+	}
+	if len(d.Paths) > 0 {
+		b.WriteString("\nTop paths (requests, vs a week earlier)\n")
+		for _, p := range d.Paths {
+			fmt.Fprintf(&b, "  %10s  %-14s  %s\n", p.Requests, p.Delta, p.Key)
+		}
+	}
+	b.WriteString("\nNew top IPs (no requests in the 7 days before)\n")
+	if len(d.NewIPs) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, g := range d.NewIPs {
+		fmt.Fprintf(&b, "  %10s  %s\n", g.Requests, g.Key)
+	}
+	return b.String()
+}
+
+func percentDelta(cur, prev int64) string {
+	if prev == 0 {
+		return "-"
+	}
+	p := math.Round(float64(cur-prev) / float64(prev) * 100)
+	if p >= 0 {
+		return "+" + strconv.FormatFloat(p, 'f', 0, 64) + "%"
+	}
+	return strconv.FormatFloat(p, 'f', 0, 64) + "%"
+}
+
+func pointDelta(cur, prev float64, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	d := cur - prev
+	s := strconv.FormatFloat(math.Abs(d), 'f', 1, 64) + " pts"
+	if d < 0 {
+		return "-" + s
+	}
+	return "+" + s
+}
+
+// formatCount writes n with thousands separators.
+func formatCount(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if neg {
+		return "-" + s
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+)
+
+const alertsSchema = `
+CREATE TABLE IF NOT EXISTS alert_events (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	rule          TEXT NOT NULL,
+	host          TEXT NOT NULL DEFAULT '',
+	subject       TEXT NOT NULL DEFAULT '',
+	metric        TEXT NOT NULL,
+	value         REAL NOT NULL,
+	summary       TEXT NOT NULL,
+	query         TEXT NOT NULL DEFAULT '',
+	started_at    REAL NOT NULL,
+	resolved_at   REAL,
+	resolved_value REAL,
+	notified      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_alert_events_started ON alert_events(started_at);
+CREATE INDEX IF NOT EXISTS idx_alert_events_open ON alert_events(resolved_at) WHERE resolved_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS silences (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	rule       TEXT NOT NULL DEFAULT '',
+	host       TEXT NOT NULL DEFAULT '',
+	starts_at  REAL NOT NULL,
+	ends_at    REAL NOT NULL,
+	comment    TEXT NOT NULL DEFAULT '',
+	created_at REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_silences_ends ON silences(ends_at);
+`
+
+// AlertEvent is one episode of an alert rule firing, from when it started
+// until it resolved.
+type AlertEvent struct {
+	ID            int64
+	Rule          string
+	Host          string // the rule's host filter
+	Subject       string // client address for per-IP rules
+	Metric        string
+	Value         float64 // when it started firing
+	Summary       string
+	Query         string  // /query link to the matching rows
+	StartedAt     float64 // epoch seconds
+	ResolvedAt    float64 // 0 while firing
+	ResolvedValue float64
+	Notified      bool // the firing notification was sent
+}
+
+// Silence mutes notifications of alerts matching Rule and/or Host between
+// StartsAt and EndsAt.
+type Silence struct {
+	ID        int64
+	Rule      string // empty = any rule
+	Host      string // empty = any host
+	StartsAt  float64
+	EndsAt    float64
+	Comment   string
+	CreatedAt float64
+}
+
+func epoch(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func (r *SQLiteRepository) OpenAlert(e *AlertEvent) error {
+	res, err := r.db.Exec(`INSERT INTO alert_events (rule, host, subject, metric, value, summary, query, started_at, notified)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Rule, e.Host, e.Subject, e.Metric, e.Value, e.Summary, e.Query, e.StartedAt, e.Notified)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+func (r *SQLiteRepository) UpdateAlert(e AlertEvent) error {
+	var resolvedAt, resolvedValue interface{}
+	if e.ResolvedAt != 0 {
+		resolvedAt, resolvedValue = e.ResolvedAt, e.ResolvedValue
+	}
+	_, err := r.db.Exec(`UPDATE alert_events SET summary = ?, query = ?, resolved_at = ?, resolved_value = ?, notified = ? WHERE id = ?`,
+		e.Summary, e.Query, resolvedAt, resolvedValue, e.Notified, e.ID)
+	return err
+}
+
+func (r *SQLiteRepository) AlertEvents(firing bool, limit int) ([]AlertEvent, error) {
+	query := `SELECT id, rule, host, subject, metric, value, summary, query, started_at, resolved_at, resolved_value, notified
+		FROM alert_events WHERE resolved_at IS NULL ORDER BY started_at DESC LIMIT ?`
+	if !firing {
+		query = `SELECT id, rule, host, subject, metric, value, summary, query, started_at, resolved_at, resolved_value, notified
+		FROM alert_events WHERE resolved_at IS NOT NULL ORDER BY resolved_at DESC LIMIT ?`
+	}
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []AlertEvent
+	for rows.Next() {
+		var e AlertEvent
+		var resolvedAt, resolvedValue sql.NullFloat64
+		if err := rows.Scan(&e.ID, &e.Rule, &e.Host, &e.Subject, &e.Metric, &e.Value, &e.Summary, &e.Query,
+			&e.StartedAt, &resolvedAt, &resolvedValue, &e.Notified); err != nil {
+			return nil, err
+		}
+		e.ResolvedAt, e.ResolvedValue = resolvedAt.Float64, resolvedValue.Float64
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (r *SQLiteRepository) AddSilence(s *Silence) error {
+	res, err := r.db.Exec(`INSERT INTO silences (rule, host, starts_at, ends_at, comment, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.Rule, s.Host, s.StartsAt, s.EndsAt, s.Comment, s.CreatedAt)
+	if err != nil {
+		return err
+	}
+	s.ID, err = res.LastInsertId()
+	return err
+}
+
+func (r *SQLiteRepository) ExpireSilence(id int64, at time.Time) error {
+	res, err := r.db.Exec(`UPDATE silences SET ends_at = MIN(ends_at, ?), starts_at = MIN(starts_at, ?) WHERE id = ?`, epoch(at), epoch(at), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) Silences(endingAfter time.Time) ([]Silence, error) {
+	rows, err := r.db.Query(`SELECT id, rule, host, starts_at, ends_at, comment, created_at FROM silences
+		WHERE ends_at > ? ORDER BY starts_at, id`, epoch(endingAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Silence
+	for rows.Next() {
+		var s Silence
+		if err := rows.Scan(&s.ID, &s.Rule, &s.Host, &s.StartsAt, &s.EndsAt, &s.Comment, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+)
+
+const bansSchema = `
+CREATE TABLE IF NOT EXISTS bans (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	target     TEXT NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	source     TEXT NOT NULL DEFAULT 'manual',
+	created_at REAL NOT NULL,
+	expires_at REAL NOT NULL DEFAULT 0,
+	lifted_at  REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_bans_target ON bans(target);
+CREATE INDEX IF NOT EXISTS idx_bans_expires ON bans(expires_at);
+`
+
+// Ban blocks a client address or CIDR range until ExpiresAt.
+type Ban struct {
+	ID        int64
+	Target    string // canonical address or CIDR
+	Reason    string
+	Source    string  // "manual", "incident" or "threat"
+	CreatedAt float64 // epoch seconds
+	ExpiresAt float64 // 0 = never
+	LiftedAt  float64 // when it was lifted by hand, 0 otherwise
+}
+
+// ActiveAt reports whether the ban is in force at t (epoch seconds).
+func (b Ban) ActiveAt(t float64) bool {
+	return b.ExpiresAt == 0 || b.ExpiresAt > t
+}
+
+func (r *SQLiteRepository) AddBan(b *Ban) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	var expires float64
+	var source string
+	err = tx.QueryRow(`SELECT id, expires_at, source FROM bans WHERE target = ? AND (expires_at = 0 OR expires_at > ?)
+		ORDER BY id DESC LIMIT 1`, b.Target, b.CreatedAt).Scan(&id, &expires, &source)
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := tx.Exec(`INSERT INTO bans (target, reason, source, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			b.Target, b.Reason, b.Source, b.CreatedAt, b.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if b.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		return tx.Commit()
+	case err != nil:
+		return err
+	}
+
+	// Already banned: keep the later expiry. An automatic ban does not
+	// replace the reason someone gave for a manual one.
+	if expires == 0 || (b.ExpiresAt != 0 && expires > b.ExpiresAt) {
+		b.ExpiresAt = expires
+	}
+	if source == "manual" && b.Source != "manual" {
+		_, err = tx.Exec(`UPDATE bans SET expires_at = ? WHERE id = ?`, b.ExpiresAt, id)
+	} else {
+		_, err = tx.Exec(`UPDATE bans SET expires_at = ?, reason = ?, source = ? WHERE id = ?`, b.ExpiresAt, b.Reason, b.Source, id)
+	}
+	if err != nil {
+		return err
+	}
+	b.ID = id
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) LiftBan(id int64, at time.Time) error {
+	t := epoch(at)
+	res, err := r.db.Exec(`UPDATE bans SET expires_at = ?, lifted_at = ? WHERE id = ? AND (expires_at = 0 OR expires_at > ?)`, t, t, id, t)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) Bans(endingAfter time.Time) ([]Ban, error) {
+	rows, err := r.db.Query(`SELECT id, target, reason, source, created_at, expires_at, lifted_at FROM bans
+		WHERE expires_at = 0 OR expires_at > ? ORDER BY created_at DESC, id DESC`, epoch(endingAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.Target, &b.Reason, &b.Source, &b.CreatedAt, &b.ExpiresAt, &b.LiftedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"database/sql"
+	"strings"
+)
+
+const incidentsSchema = `
+CREATE TABLE IF NOT EXISTS incidents (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind        TEXT NOT NULL,
+	remote_addr TEXT NOT NULL,
+	host        TEXT NOT NULL DEFAULT '',
+	summary     TEXT NOT NULL,
+	peak        REAL NOT NULL,
+	requests    INTEGER NOT NULL DEFAULT 0,
+	started_at  REAL NOT NULL,
+	last_seen   REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_incidents_last_seen ON incidents(last_seen);
+CREATE INDEX IF NOT EXISTS idx_incidents_addr ON incidents(remote_addr, kind, last_seen);
+
+CREATE TABLE IF NOT EXISTS incident_evidence (
+	incident_id INTEGER NOT NULL,
+	entry_id    INTEGER NOT NULL,
+	PRIMARY KEY (incident_id, entry_id)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS idx_incident_evidence_entry ON incident_evidence(entry_id);
+`
+
+// Incident is a stretch of suspicious behaviour by one client address,
+// backed by the stored rows that showed it.
+type Incident struct {
+	ID         int64
+	Kind       string // "not_found", "login_failures", "request_rate" or "error_ratio"
+	RemoteAddr string
+	Host       string // of the row that started it
+	Summary    string
+	Peak       float64 // highest value measured: paths, failures, requests or error percent
+	Requests   int64   // evidence rows, scaled by sample rate
+	StartedAt  float64 // epoch seconds of the first and last evidence rows
+	LastSeen   float64
+}
+
+func (r *SQLiteRepository) SaveIncident(inc *Incident, evidence []int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if inc.ID == 0 {
+		res, err := tx.Exec(`INSERT INTO incidents (kind, remote_addr, host, summary, peak, requests, started_at, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			inc.Kind, inc.RemoteAddr, inc.Host, inc.Summary, inc.Peak, inc.Requests, inc.StartedAt, inc.LastSeen)
+		if err != nil {
+			return err
+		}
+		if inc.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.Exec(`UPDATE incidents SET summary = ?, peak = ?, requests = ?, started_at = ?, last_seen = ? WHERE id = ?`,
+			inc.Summary, inc.Peak, inc.Requests, inc.StartedAt, inc.LastSeen, inc.ID)
+		if err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO incident_evidence (incident_id, entry_id) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range evidence {
+		if _, err := stmt.Exec(inc.ID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) LatestIncident(addr, kind string) (*Incident, error) {
+	rows, err := r.db.Query(`SELECT `+incidentColumns+` FROM incidents
+		WHERE remote_addr = ? AND kind = ? ORDER BY last_seen DESC LIMIT 1`, addr, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanIncident(rows)
+}
+
+func (r *SQLiteRepository) Incidents(filters QueryFilters, limit int) ([]Incident, error) {
+	var where []string
+	var args []interface{}
+	if filters.TimeFrom != nil {
+		where = append(where, "last_seen >= ?")
+		args = append(args, epoch(*filters.TimeFrom))
+	}
+	if filters.TimeTo != nil {
+		where = append(where, "started_at <= ?")
+		args = append(args, epoch(*filters.TimeTo))
+	}
+	for _, f := range []struct{ column, raw string }{
+		{"remote_addr", filters.RemoteAddr},
+		{"host", filters.Host},
+	} {
+		if f.raw == "" {
+			continue
+		}
+		includes, excludes := parseTextFilter(f.raw)
+		if clause, vals := buildTextMatchClause(f.column, includes, excludes, false); clause != "" {
+			where = append(where, clause)
+			args = append(args, vals...)
+		}
+	}
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := r.db.Query("SELECT "+incidentColumns+" FROM incidents"+whereClause+" ORDER BY last_seen DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Incident
+	for rows.Next() {
+		inc, err := scanIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *inc)
+	}
+	return out, rows.Err()
+}
+
+const incidentColumns = "id, kind, remote_addr, host, summary, peak, requests, started_at, last_seen"
+
+func scanIncident(rows *sql.Rows) (*Incident, error) {
+	var inc Incident
+	err := rows.Scan(&inc.ID, &inc.Kind, &inc.RemoteAddr, &inc.Host, &inc.Summary, &inc.Peak, &inc.Requests, &inc.StartedAt, &inc.LastSeen)
+	if err != nil {
+		return nil, err
+	}
+	return &inc, nil
+}
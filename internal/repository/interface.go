@@ -11,23 +11,179 @@ type QueryFilters struct {
 	TimeTo     *time.Time
 	Status     string
 	Country    string
+	RemoteAddr string // include/exclude list of client addresses, exact match
+	ASN        string // include/exclude list of AS numbers
 	PathContains string
+	Path       string // exact path
+	Route      string // include/exclude list of route templates, exact match
 	Method     string
 	Host       string
 	UserAgentContains string
+	UserAgent  string // exact user agent
+	Browser    string // include/exclude lists, exact match
+	OS         string
+	Device     string
+	Bot        string // "yes" = bots only, "no" = humans only
+	RefDomain  string // include/exclude lists, exact match
+	SearchEngine string
+	UTMSource  string
+	UTMMedium  string
+	UTMCampaign string
+	Session    string // session id, exact match
+	Params     string // e.g. "page>100, utm_source=google, -debug"
+	Threat     string // attack rule ids or categories, "any" or "none"; "-" excludes
+	Incident   int64  // only the evidence rows of this incident, 0 = no filter
+	SinceID    int64 // only rows with a larger id, 0 = no bound
+	UntilID    int64 // only rows with this id or smaller, 0 = no bound
 	SortBy     string // time, status, path, host, etc.
 	SortDesc   bool
 }
 
 type DashboardStats struct {
-	TotalRequests24h int64
-	TotalRequests7d  int64
-	ErrorRate24h     float64 // 4xx+5xx percentage
-	UniqueIPs24h     int64
-	RequestsByHour   []HourCount
+	TotalRequests    int64
+	PrevRequests     int64   // the window of the same length just before
+	ErrorRate        float64 // 4xx+5xx percentage
+	UniqueIPs        int64
+	RequestsByHour   []HourCount // per bucket; the name predates variable buckets
 	StatusDistribution []StatusCount
 	TopCountries     []CountryCount
 	TopPaths         []PathCount
+	TopRoutes        []PathCount // like TopPaths, grouped by route template
+	TopASNs          []ASNCount
+	HumansVsBots     []LabelCount
+	TopBrowsers      []LabelCount
+	Hosts            []LabelCount // all hosts in the window, ignoring the host filter
+}
+
+// RouteStat aggregates all requests that share a route template.
+type RouteStat struct {
+	Route         string
+	Requests      int64
+	Errors        int64 // 4xx + 5xx
+	ServerErrors  int64 // 5xx
+	ErrorRate     float64
+	Bytes         int64
+	UniqueIPs     int64
+	DistinctPaths int64
+}
+
+// TrafficSources breaks requests down by where they came from.
+type TrafficSources struct {
+	TotalRequests int64
+	Referred      int64 // with an external referrer
+	Search        int64 // from a recognised search engine
+	Campaign      int64 // tagged with utm_source or utm_campaign
+	TopReferrers  []LabelCount
+	SearchEngines []LabelCount
+	SearchTerms   []LabelCount
+	Campaigns     []CampaignCount
+	LandingPaths  []PathCount
+}
+
+type CampaignCount struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Count    int64
+}
+
+// SessionSummary describes one visit: consecutive requests from the same IP
+// and user agent with no gap longer than the session timeout.
+type SessionSummary struct {
+	ID            string
+	Start         float64 // epoch seconds
+	End           float64
+	Requests      int64
+	Errors        int64 // 4xx + 5xx
+	DistinctPaths int64
+	RemoteAddr    string
+	UserAgent     string
+	Country       string
+	Browser       string
+	OS            string
+	Device        string
+	IsBot         bool
+	BotName       string
+	EntryPath     string
+	ExitPath      string
+}
+
+// IPProfile summarizes everything stored for one client address.
+type IPProfile struct {
+	Addr       string
+	FirstSeen  float64 // epoch seconds
+	LastSeen   float64
+	Requests   int64
+	Bytes      int64
+	Errors     int64 // 4xx + 5xx
+	Sessions   int64
+	// Location and network as of the most recent request.
+	Country    string
+	City       string
+	ASN        int64
+	ASOrg      string
+	Statuses   []LabelCount
+	Hosts      []LabelCount
+	Paths      []LabelCount
+	UserAgents []LabelCount
+	Heatmap    [7][24]int64 // requests by weekday (0 = Sunday) and hour, server local time
+}
+
+// Breakdown summarizes the rows matching a filter, e.g. everything for one
+// path or one virtual host.
+type Breakdown struct {
+	Requests      int64
+	Errors        int64 // 4xx + 5xx
+	Bytes         int64
+	UniqueIPs     int64
+	Volume        []HourCount // per hour or day, see LogRepository.Breakdown
+	Statuses      []StatusCount
+	TopIPs        []LabelCount
+	TopReferrers  []LabelCount
+	TopUserAgents []LabelCount
+	TopPaths      []LabelCount
+	TopHosts      []LabelCount
+	Latency       *LatencyStats // nil when no matching row logged $request_time
+}
+
+// LatencyStats are request time percentiles in seconds.
+type LatencyStats struct {
+	Samples int64
+	P50     float64
+	P90     float64
+	P95     float64
+	P99     float64
+	Max     float64
+}
+
+// ParamStat describes how one query parameter is used on one path.
+type ParamStat struct {
+	Path           string
+	Name           string
+	Requests       int64
+	DistinctValues int64
+	MinValue       string
+	MaxValue       string
+}
+
+// LabelCount is a generic (label, requests) pair for breakdown charts.
+type LabelCount struct {
+	Label string
+	Count int64
+}
+
+// EntryCursor is the position of a row in (time, id) order.
+type EntryCursor struct {
+	Time float64
+	ID   int64
+}
+
+// GroupStat is one group of an aggregation.
+type GroupStat struct {
+	Key      string
+	Rows     int64 // stored rows
+	Requests int64 // rows scaled by sample rate
+	Bytes    int64 // scaled like Requests
 }
 
 type HourCount struct {
@@ -45,14 +201,113 @@ type CountryCount struct {
 	Count  int64
 }
 
+type ASNCount struct {
+	ASN   int64
+	Org   string
+	Count int64
+}
+
 type PathCount struct {
 	Path  string
 	Count int64
 }
 
 type LogRepository interface {
+	// InsertBatch stores entries, skipping duplicates of stored rows. It
+	// sets the ID of each newly stored entry; skipped ones keep ID 0.
 	InsertBatch(entries []models.LogEntry) error
-	Query(filters QueryFilters, limit, offset int) ([]models.LogEntry, int, error)
-	GetDashboardStats(since time.Time) (*DashboardStats, error)
-	DeleteOlderThan(t time.Time) error
+	// RestoreBatch stores entries read back from an archive, skipping
+	// duplicates. Rollups are not touched, retention counts from the time of
+	// the restore and will not archive the rows again.
+	RestoreBatch(entries []models.LogEntry) error
+	// MaxID returns the id of the newest stored row, 0 if there are none.
+	MaxID() (int64, error)
+	// Query returns one page of matching rows, the total number of rows and
+	// how many requests they represent, i.e. the row count scaled by each
+	// row's sample rate.
+	Query(filters QueryFilters, limit, offset int) ([]models.LogEntry, int, int64, error)
+	// QueryAfter returns up to limit matching rows in time order (newest
+	// first if filters.SortDesc) after cursor, or from the start if nil.
+	QueryAfter(filters QueryFilters, cursor *EntryCursor, limit int) ([]models.LogEntry, error)
+	// Aggregate groups matching rows by one of GroupFields, busiest first
+	// (chronological for "hour" and "day").
+	Aggregate(filters QueryFilters, by string, limit int) ([]GroupStat, error)
+	// Iterate streams every matching row, in sort order, to fn.
+	Iterate(filters QueryFilters, fn func(models.LogEntry) error) error
+	// RouteStats groups matching rows by route, busiest first.
+	RouteStats(filters QueryFilters, limit int) ([]RouteStat, error)
+	// TrafficSources summarizes referrers, search engines, UTM campaigns
+	// and landing paths of matching rows.
+	TrafficSources(filters QueryFilters, limit int) (*TrafficSources, error)
+	// ParamStats lists the most used query parameters per path among
+	// matching rows, with how many distinct values each takes.
+	ParamStats(filters QueryFilters, limit int) ([]ParamStat, error)
+	// Sessions lists visits that have matching rows, ordered by "recent",
+	// "duration" or "requests". Counts cover the matching rows only; entry
+	// and exit paths are those of the whole session.
+	Sessions(filters QueryFilters, orderBy string, limit int) ([]SessionSummary, error)
+	// IPProfile returns the activity summary of one address, with at most
+	// limit entries per top list. Requests is 0 if nothing is stored.
+	IPProfile(addr string, limit int) (*IPProfile, error)
+	// Breakdown aggregates matching rows, with request volume bucketed by
+	// "hour" or "day" and at most limit entries per top list.
+	Breakdown(filters QueryFilters, bucket string, limit int) (*Breakdown, error)
+	// GetDashboardStats summarizes the time range and host filter of filters
+	// from the rollup tables, with request volume grouped into buckets of the
+	// given size. Other filters are ignored.
+	GetDashboardStats(filters QueryFilters, bucket time.Duration) (*DashboardStats, error)
+	// RebuildRollups recomputes the rollup tables from the stored rows.
+	RebuildRollups() error
+	// ApplyRetention deletes raw rows, rollups and ended bans older than p
+	// allows, returning the number of raw rows deleted. If archiver is not nil the
+	// expiring rows are handed to it first, and nothing is deleted unless
+	// its Commit succeeds.
+	ApplyRetention(p RetentionPolicy, archiver Archiver) (int64, error)
+	// OpenAlert stores a newly firing alert and sets its ID.
+	OpenAlert(e *AlertEvent) error
+	// UpdateAlert saves the summary, query link, resolution and notified
+	// flag of a stored alert.
+	UpdateAlert(e AlertEvent) error
+	// AlertEvents returns firing alerts, newest first, or if firing is
+	// false the most recently resolved ones.
+	AlertEvents(firing bool, limit int) ([]AlertEvent, error)
+	// AddSilence stores s and sets its ID.
+	AddSilence(s *Silence) error
+	// ExpireSilence ends a silence at the given time if it would end later,
+	// returning sql.ErrNoRows if there is no such silence.
+	ExpireSilence(id int64, at time.Time) error
+	// Silences returns the silences that end after the given time, active
+	// and upcoming, in start order.
+	Silences(endingAfter time.Time) ([]Silence, error)
+	// SecuritySummary counts the matching rows flagged by attack rules by
+	// rule, client address and host, with at most limit addresses and hosts.
+	SecuritySummary(filters QueryFilters, limit int) (*SecuritySummary, error)
+	// SaveIncident stores a new incident (ID 0, which it then sets) or
+	// updates a stored one, and links the evidence rows to it.
+	SaveIncident(inc *Incident, evidence []int64) error
+	// LatestIncident returns the most recent incident of kind for addr, or
+	// nil if there is none.
+	LatestIncident(addr, kind string) (*Incident, error)
+	// Incidents returns incidents overlapping the time range of filters,
+	// optionally for some addresses or hosts, most recent first.
+	Incidents(filters QueryFilters, limit int) ([]Incident, error)
+	// AddBan stores b and sets its ID. If its target is already banned the
+	// stored ban is extended to the later expiry instead, and b is updated
+	// to match.
+	AddBan(b *Ban) error
+	// LiftBan ends a ban at the given time, returning sql.ErrNoRows if there
+	// is no such ban in force.
+	LiftBan(id int64, at time.Time) error
+	// Bans returns the bans that end after the given time or never, newest
+	// first.
+	Bans(endingAfter time.Time) ([]Ban, error)
+	// RescanThreats replaces the attack rule ids of every stored row with
+	// what match returns, returning how many rows changed. Anonymized rows
+	// keep the ids they have and only gain new ones.
+	RescanThreats(match func(e *models.LogEntry) string) (int, error)
+	// AnonymizeOlderThan rewrites rows older than t that were stored with
+	// their raw IP and query, returning how many rows were rewritten. The
+	// addresses of incidents last seen before t and of alert events
+	// resolved before t are rewritten too.
+	AnonymizeOlderThan(t time.Time, anonymize func(e *models.LogEntry)) (int, error)
 }
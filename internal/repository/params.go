@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// query_params holds one row per query-string parameter of an entry, so
+// parameters can be filtered on and aggregated without parsing strings in SQL.
+const paramsSchema = `
+CREATE TABLE IF NOT EXISTS query_params (
+	entry_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	num REAL
+);
+
+CREATE INDEX IF NOT EXISTS idx_query_params_entry ON query_params(entry_id);
+CREATE INDEX IF NOT EXISTS idx_query_params_name_num ON query_params(name, num);
+CREATE INDEX IF NOT EXISTS idx_query_params_name_value ON query_params(name, value);
+`
+
+const insertParamSQL = "INSERT INTO query_params (entry_id, name, value, num) VALUES (?, ?, ?, ?)"
+
+type queryParam struct {
+	name  string
+	value string
+	num   sql.NullFloat64 // set when value is numeric, for range filters
+}
+
+// parseQueryParams splits a raw query string into decoded name/value pairs.
+// Malformed escapes are kept verbatim rather than dropped.
+func parseQueryParams(raw string) []queryParam {
+	if raw == "" {
+		return nil
+	}
+	var out []queryParam
+	for _, part := range strings.Split(raw, "&") {
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		if name == "" {
+			continue
+		}
+		p := queryParam{name: name, value: value}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			p.num = sql.NullFloat64{Float64: f, Valid: true}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func insertParams(stmt *sql.Stmt, entryID int64, rawQuery string) error {
+	for _, p := range parseQueryParams(rawQuery) {
+		if _, err := stmt.Exec(entryID, p.name, p.value, p.num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paramsBackfillSchema records how far the parameters of entries stored
+// before query_params existed have been filled in: rows with next_id <= id
+// <= last_id are still to do. The row is deleted when the backfill is done.
+const paramsBackfillSchema = `
+CREATE TABLE IF NOT EXISTS query_params_backfill (
+	next_id INTEGER NOT NULL,
+	last_id INTEGER NOT NULL
+);
+`
+
+// createParamsTable creates query_params and, if it did not exist before,
+// queues the entries already stored for backfillParams.
+func createParamsTable(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'query_params'").Scan(&exists); err != nil {
+		return err
+	}
+	if _, err := db.Exec(paramsSchema + paramsBackfillSchema); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+	_, err := db.Exec("INSERT INTO query_params_backfill (next_id, last_id) SELECT 0, MAX(id) FROM log_entries HAVING MAX(id) IS NOT NULL")
+	return err
+}
+
+// backfillParams fills in the parameters of the entries queued by
+// createParamsTable a batch at a time, so a large database does not hold up
+// startup. New entries get theirs on insert; until it finishes, parameter
+// filters and reports miss the older rows.
+func backfillParams(db *sql.DB) {
+	for {
+		done, err := backfillParamsBatch(db, 5000)
+		if err != nil {
+			log.Printf("query params backfill: %v", err)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func backfillParamsBatch(db *sql.DB, limit int) (done bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var next, last int64
+	err = tx.QueryRow("SELECT next_id, last_id FROM query_params_backfill").Scan(&next, &last)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	rows, err := tx.Query("SELECT id, query FROM log_entries WHERE id >= ? AND id <= ? AND query <> '' ORDER BY id LIMIT ?", next, last, limit)
+	if err != nil {
+		return false, err
+	}
+	type idQuery struct {
+		id    int64
+		query string
+	}
+	var batch []idQuery
+	for rows.Next() {
+		var iq idQuery
+		if err := rows.Scan(&iq.id, &iq.query); err != nil {
+			rows.Close()
+			return false, err
+		}
+		batch = append(batch, iq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if len(batch) == 0 {
+		if _, err := tx.Exec("DELETE FROM query_params_backfill"); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	stmt, err := tx.Prepare(insertParamSQL)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	for _, iq := range batch {
+		// The anonymization job may have rewritten this row's parameters
+		// already.
+		if _, err := tx.Exec("DELETE FROM query_params WHERE entry_id = ?", iq.id); err != nil {
+			return false, err
+		}
+		if err := insertParams(stmt, iq.id, iq.query); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("UPDATE query_params_backfill SET next_id = ?", batch[len(batch)-1].id+1); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+// paramOps are the comparison operators accepted in parameter filters,
+// longest first so ">=" is not read as ">" at the same position.
+var paramOps = []string{">=", "<=", "!=", "=", ">", "<", "~"}
+
+// buildParamClauses turns a parameter filter such as
+// "param:page>100, utm_source=google, -debug, token" into SQL conditions.
+// A bare name requires the parameter to be present and "-name" requires it
+// to be absent; "~" is a substring match on the value. Numeric comparisons
+// only match values that parse as numbers.
+func buildParamClauses(raw string) ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+	for _, token := range strings.Split(raw, ",") {
+		t := strings.TrimSpace(token)
+		t = strings.TrimSpace(strings.TrimPrefix(t, "param:"))
+		if t == "" {
+			continue
+		}
+		exists := "EXISTS"
+		if strings.HasPrefix(t, "-") {
+			exists = "NOT EXISTS"
+			t = strings.TrimSpace(t[1:])
+		}
+		// The leftmost operator splits the token, so a value may contain
+		// operators itself ("name~a=b").
+		name, op, value := t, "", ""
+		at := len(t)
+		for _, o := range paramOps {
+			if i := strings.Index(t, o); i > 0 && i < at {
+				at, op = i, o
+			}
+		}
+		if op != "" {
+			name, value = strings.TrimSpace(t[:at]), strings.TrimSpace(t[at+len(op):])
+		}
+		cond := "qp.name = ?"
+		condArgs := []interface{}{name}
+		switch op {
+		case "":
+		case "~":
+			cond += " AND qp.value LIKE ?"
+			condArgs = append(condArgs, "%"+value+"%")
+		case "=", "!=":
+			sqlOp := "="
+			if op == "!=" {
+				sqlOp = "<>"
+			}
+			cond += " AND qp.value " + sqlOp + " ?"
+			condArgs = append(condArgs, value)
+		default:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			cond += fmt.Sprintf(" AND qp.num %s ?", op)
+			condArgs = append(condArgs, n)
+		}
+		where = append(where, exists+" (SELECT 1 FROM query_params qp WHERE qp.entry_id = log_entries.id AND "+cond+")")
+		args = append(args, condArgs...)
+	}
+	return where, args
+}
+
+func (r *SQLiteRepository) ParamStats(filters QueryFilters, limit int) ([]ParamStat, error) {
+	whereClause, args := buildWhere(filters)
+	args = append(args, limit)
+	rows, err := r.db.Query(`
+		SELECT log_entries.path, query_params.name,
+			SUM(log_entries.sample_rate) as cnt,
+			COUNT(DISTINCT query_params.value),
+			MIN(query_params.value), MAX(query_params.value)
+		FROM query_params JOIN log_entries ON log_entries.id = query_params.entry_id`+whereClause+`
+		GROUP BY log_entries.path, query_params.name
+		ORDER BY cnt DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ParamStat
+	for rows.Next() {
+		var ps ParamStat
+		if err := rows.Scan(&ps.Path, &ps.Name, &ps.Requests, &ps.DistinctValues, &ps.MinValue, &ps.MaxValue); err != nil {
+			return nil, err
+		}
+		out = append(out, ps)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// RetentionPolicy says how long each tier of stored data is kept.
+type RetentionPolicy struct {
+	Raw           time.Duration // raw rows not matched by an override
+	Overrides     []RetentionOverride
+	HourlyRollups time.Duration // 0 keeps them forever
+	DailyRollups  time.Duration // 0 keeps them forever
+}
+
+// RetentionOverride keeps raw rows of one host and/or status range for Keep
+// instead of the default. Empty Host and zero StatusMin/StatusMax match
+// anything; the first matching override applies.
+type RetentionOverride struct {
+	Host                 string
+	StatusMin, StatusMax int
+	Keep                 time.Duration
+}
+
+// Archiver receives raw rows before ApplyRetention deletes them.
+type Archiver interface {
+	Add(e models.LogEntry) error
+	// Commit makes the added rows durable and checks that rows of them
+	// were written. The rows are only deleted if it succeeds.
+	Commit(rows int64) error
+	// Abort discards everything added since the last Commit.
+	Abort()
+}
+
+// expiredClause returns the condition matching raw rows past their
+// retention at now, as a CASE over the overrides. Rows restored from an
+// archive are already past it by their own time, so theirs counts from
+// when they were restored.
+func (p RetentionPolicy) expiredClause(now time.Time) (string, []interface{}) {
+	limit, args := p.cutoffExpr(now)
+	return "((archived = 0 AND time < " + limit + ") OR (archived > 0 AND archived < " + limit + "))",
+		append(args, args...)
+}
+
+// cutoffExpr returns the time before which a row is expired at now.
+func (p RetentionPolicy) cutoffExpr(now time.Time) (string, []interface{}) {
+	cutoff := func(d time.Duration) float64 {
+		return float64(now.Add(-d).UnixNano()) / 1e9
+	}
+	if len(p.Overrides) == 0 {
+		return "?", []interface{}{cutoff(p.Raw)}
+	}
+	var b strings.Builder
+	var args []interface{}
+	b.WriteString("CASE")
+	for _, o := range p.Overrides {
+		var conds []string
+		if o.Host != "" {
+			conds = append(conds, "host = ?")
+			args = append(args, o.Host)
+		}
+		if o.StatusMax > 0 {
+			conds = append(conds, "status BETWEEN ? AND ?")
+			args = append(args, o.StatusMin, o.StatusMax)
+		}
+		if len(conds) == 0 {
+			conds = append(conds, "1")
+		}
+		b.WriteString(" WHEN " + strings.Join(conds, " AND ") + " THEN ?")
+		args = append(args, cutoff(o.Keep))
+	}
+	b.WriteString(" ELSE ? END")
+	return b.String(), append(args, cutoff(p.Raw))
+}
+
+// ApplyRetention deletes raw rows, rollups and ended bans past their
+// retention and returns how many raw rows were deleted. Before a day's raw
+// rows go, its hour and day rollups are checked against them and rebuilt if
+// they fall short, so deleting never loses totals. If the final commit
+// fails after the archiver committed, the rows are archived again on the
+// next run.
+func (r *SQLiteRepository) ApplyRetention(p RetentionPolicy, archiver Archiver) (int64, error) {
+	now := time.Now()
+	expired, args := p.expiredClause(now)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := ensureDayRollups(tx, expired, args); err != nil {
+		return 0, err
+	}
+	if archiver != nil {
+		if err := archiveRows(tx, expired, args, archiver); err != nil {
+			archiver.Abort()
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM query_params WHERE entry_id IN (SELECT id FROM log_entries WHERE "+expired+")", args...); err != nil {
+		return 0, err
+	}
+	// Incidents outlive their evidence; only the links to the rows go.
+	if _, err := tx.Exec("DELETE FROM incident_evidence WHERE entry_id IN (SELECT id FROM log_entries WHERE "+expired+")", args...); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM log_entries WHERE "+expired, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+
+	prune := []struct {
+		res int64
+		age time.Duration
+	}{
+		{resMinute, minuteRollupAge},
+		{resHour, p.HourlyRollups},
+		{resDay, p.DailyRollups},
+	}
+	for _, pr := range prune {
+		if pr.age <= 0 {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM rollups WHERE resolution = ? AND bucket < ?", pr.res, now.Add(-pr.age).Unix()); err != nil {
+			return 0, err
+		}
+	}
+	// No client address outlives the default raw retention.
+	if _, err := tx.Exec("DELETE FROM rollup_ips WHERE day < ?", now.Add(-p.Raw).Unix()/resDay*resDay); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM rollup_hour_ips WHERE hour < ?", now.Add(-min(p.Raw, minuteRollupAge)).Unix()/resHour*resHour); err != nil {
+		return 0, err
+	}
+	// Nor do bans that ended.
+	ended := float64(now.Add(-p.Raw).UnixNano()) / 1e9
+	if _, err := tx.Exec("DELETE FROM bans WHERE (lifted_at > 0 AND lifted_at < ?) OR (expires_at > 0 AND expires_at < ?)", ended, ended); err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// ensureDayRollups rebuilds the hour and day rollups of every day that has
+// expiring rows and whose day rollup counts fewer requests than its raw rows,
+// e.g. rows stored before rollups existed or rollups pruned by hand.
+func ensureDayRollups(tx *sql.Tx, expired string, args []interface{}) error {
+	rows, err := tx.Query(`SELECT DISTINCT CAST(time AS INTEGER) / 86400 * 86400 FROM log_entries WHERE `+expired, args...)
+	if err != nil {
+		return err
+	}
+	var days []int64
+	for rows.Next() {
+		var d int64
+		if err := rows.Scan(&d); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, d := range days {
+		var raw, rolled int64
+		if err := tx.QueryRow("SELECT COALESCE(SUM(sample_rate), 0) FROM log_entries WHERE time >= ? AND time < ?", d, d+resDay).Scan(&raw); err != nil {
+			return err
+		}
+		if err := tx.QueryRow("SELECT COALESCE(SUM(requests), 0) FROM rollups WHERE resolution = ? AND dim = 'status' AND bucket = ?", resDay, d).Scan(&rolled); err != nil {
+			return err
+		}
+		if rolled >= raw {
+			continue
+		}
+		for _, res := range []int64{resHour, resDay} {
+			if err := fillRollups(tx, res, d, d+resDay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveRows passes the expiring rows that did not come from an archive to
+// archiver and commits it.
+func archiveRows(tx *sql.Tx, expired string, args []interface{}, archiver Archiver) error {
+	rows, err := tx.Query("SELECT "+entryColumns+" FROM log_entries WHERE ("+expired+") AND archived = 0 ORDER BY time", args...)
+	if err != nil {
+		return err
+	}
+	var n int64
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if err := archiver.Add(e); err != nil {
+			rows.Close()
+			return err
+		}
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var want int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM log_entries WHERE ("+expired+") AND archived = 0", args...).Scan(&want); err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("archive: read %d of %d expiring rows", n, want)
+	}
+	return archiver.Commit(n)
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredClauseOverrides(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	ago := func(n int) float64 { return float64(now.Add(-days(n)).Unix()) }
+	overrides := []RetentionOverride{
+		{Host: "api.example.com", StatusMin: 500, StatusMax: 599, Keep: days(90)},
+		{Host: "api.example.com", Keep: days(3)},
+		{StatusMin: 400, StatusMax: 499, Keep: days(30)},
+	}
+	tests := []struct {
+		name      string
+		overrides []RetentionOverride
+		host      string
+		status    int
+		time      float64
+		archived  float64
+		want      bool
+	}{
+		{"default, within", nil, "example.com", 200, ago(6), 0, false},
+		{"default, past", nil, "example.com", 200, ago(8), 0, true},
+		{"no override matches", overrides, "example.com", 200, ago(8), 0, true},
+		{"host and status", overrides, "api.example.com", 503, ago(60), 0, false},
+		{"host and status, past", overrides, "api.example.com", 503, ago(91), 0, true},
+		{"first match wins over status", overrides, "api.example.com", 404, ago(4), 0, true},
+		{"host only, within", overrides, "api.example.com", 200, ago(2), 0, false},
+		{"status only", overrides, "example.com", 404, ago(20), 0, false},
+		{"status only, past", overrides, "example.com", 404, ago(31), 0, true},
+		{"status range bounds", overrides, "example.com", 499, ago(20), 0, false},
+		{"restored, counts from restore", nil, "example.com", 200, ago(400), ago(1), false},
+		{"restored, past", nil, "example.com", 200, ago(400), ago(8), true},
+		{"restored with override", overrides, "example.com", 404, ago(400), ago(20), false},
+	}
+	r := newTestRepo(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := RetentionPolicy{Raw: days(7), Overrides: tt.overrides}
+			clause, args := p.expiredClause(now)
+			args = append(args, tt.host, tt.status, tt.time, tt.archived)
+			var got bool
+			err := r.db.QueryRow("SELECT "+clause+" FROM (SELECT ? AS host, ? AS status, ? AS time, ? AS archived)", args...).Scan(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
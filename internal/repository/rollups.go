@@ -0,0 +1,785 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// Rollups are per-bucket request and byte totals, kept up to date by
+// InsertBatch so the dashboard never has to scan log_entries. Each row is one
+// (resolution, dimension, bucket, host, value); the "status" dimension covers
+// every request, so it doubles as the source for totals.
+const rollupSchema = `
+CREATE TABLE IF NOT EXISTS rollups (
+	resolution INTEGER NOT NULL, -- bucket length in seconds
+	dim TEXT NOT NULL,
+	bucket INTEGER NOT NULL,     -- bucket start, epoch seconds
+	host TEXT NOT NULL,
+	value TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	PRIMARY KEY (resolution, dim, bucket, host, value)
+) WITHOUT ROWID;
+
+-- Distinct client addresses per day and host, for unique IP counts over
+-- long ranges.
+CREATE TABLE IF NOT EXISTS rollup_ips (
+	day INTEGER NOT NULL,
+	host TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	PRIMARY KEY (day, host, ip)
+) WITHOUT ROWID;
+
+-- The same per hour, kept as long as minute rollups, for short ranges.
+CREATE TABLE IF NOT EXISTS rollup_hour_ips (
+	hour INTEGER NOT NULL,
+	host TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	PRIMARY KEY (hour, host, ip)
+) WITHOUT ROWID;
+`
+
+const (
+	resMinute = 60
+	resHour   = 3600
+	resDay    = 86400
+
+	// minuteRollupAge is how long minute rollups are kept; older minutes
+	// are only needed at hour resolution.
+	minuteRollupAge = 48 * time.Hour
+
+	// pathRollupLimit is how many paths each hour or day bucket of a host
+	// keeps. A bucket is trimmed back to it once it holds twice as many,
+	// and the requests of the paths dropped are counted under otherPaths.
+	pathRollupLimit = 200
+	otherPaths      = "\x00other"
+)
+
+var rollupResolutions = []int64{resMinute, resHour, resDay}
+
+// rollupDims maps each dimension to its SQL expression over log_entries and
+// the condition a row must meet to be counted in it. rollupValues is the Go
+// equivalent used by InsertBatch; the two must agree. A dimension with a
+// limit keeps only its busiest values per bucket and host, and only at hour
+// and day resolution: scanners alone would otherwise add a row per probed
+// path.
+var rollupDims = []rollupDim{
+	{name: "status", expr: "CAST(COALESCE(status, 0) AS TEXT)"},
+	{name: "country", expr: "COALESCE(country, '')"},
+	{name: "path", expr: "COALESCE(path, '')", limit: pathRollupLimit},
+	{name: "route", expr: "COALESCE(" + routeExpr + ", '')"},
+	{name: "bot", expr: "CAST(is_bot AS TEXT)"},
+	{name: "browser", expr: "browser", cond: "is_bot = 0 AND browser <> ''"},
+	{name: "asn", expr: "CAST(asn AS TEXT) || char(9) || as_org", cond: "asn > 0"},
+}
+
+type rollupDim struct {
+	name, expr, cond string
+	limit            int // values kept per bucket and host; 0 = all
+}
+
+func findRollupDim(name string) rollupDim {
+	for _, d := range rollupDims {
+		if d.name == name {
+			return d
+		}
+	}
+	return rollupDim{}
+}
+
+func rollupLimit(dim string) int {
+	return findRollupDim(dim).limit
+}
+
+func rollupValues(e models.LogEntry) map[string]string {
+	route := e.Route
+	if route == "" {
+		route = e.Path
+	}
+	bot := "0"
+	if e.IsBot {
+		bot = "1"
+	}
+	v := map[string]string{
+		"status":  strconv.Itoa(e.Status),
+		"country": e.Country,
+		"path":    e.Path,
+		"route":   route,
+		"bot":     bot,
+	}
+	if !e.IsBot && e.Browser != "" {
+		v["browser"] = e.Browser
+	}
+	if e.ASN > 0 {
+		v["asn"] = strconv.FormatInt(e.ASN, 10) + "\t" + e.ASOrg
+	}
+	return v
+}
+
+type rollupKey struct {
+	resolution, bucket int64
+	dim, host, value   string
+}
+
+type rollupSum struct {
+	requests, bytes int64
+}
+
+// rollupBatch accumulates the rollup changes of one InsertBatch.
+type rollupBatch struct {
+	sums    map[rollupKey]*rollupSum
+	ips     map[[3]string]struct{}
+	hourIPs map[[3]string]struct{}
+	limited map[rollupKey]struct{} // buckets of limited dimensions touched, value unset
+}
+
+func newRollupBatch() *rollupBatch {
+	return &rollupBatch{
+		sums:    make(map[rollupKey]*rollupSum),
+		ips:     make(map[[3]string]struct{}),
+		hourIPs: make(map[[3]string]struct{}),
+		limited: make(map[rollupKey]struct{}),
+	}
+}
+
+func (b *rollupBatch) add(e models.LogEntry) {
+	weight := int64(sampleWeight(e))
+	ts := int64(e.Time)
+	minuteHorizon := time.Now().Add(-minuteRollupAge).Unix() / resMinute * resMinute
+	for dim, value := range rollupValues(e) {
+		limited := rollupLimit(dim) > 0
+		for _, res := range rollupResolutions {
+			if res == resMinute && (limited || ts/res*res < minuteHorizon) {
+				continue
+			}
+			k := rollupKey{res, ts / res * res, dim, e.Host, value}
+			if limited {
+				b.limited[rollupKey{res, k.bucket, dim, e.Host, ""}] = struct{}{}
+			}
+			s := b.sums[k]
+			if s == nil {
+				s = &rollupSum{}
+				b.sums[k] = s
+			}
+			s.requests += weight
+			s.bytes += e.Bytes * weight
+		}
+	}
+	b.ips[[3]string{strconv.FormatInt(ts/resDay*resDay, 10), e.Host, e.RemoteAddr}] = struct{}{}
+	if ts/resMinute*resMinute >= minuteHorizon {
+		b.hourIPs[[3]string{strconv.FormatInt(ts/resHour*resHour, 10), e.Host, e.RemoteAddr}] = struct{}{}
+	}
+}
+
+func (b *rollupBatch) write(tx *sql.Tx) error {
+	if len(b.sums) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(`INSERT INTO rollups (resolution, dim, bucket, host, value, requests, bytes)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO UPDATE SET requests = requests + excluded.requests, bytes = bytes + excluded.bytes`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for k, s := range b.sums {
+		if _, err := stmt.Exec(k.resolution, k.dim, k.bucket, k.host, k.value, s.requests, s.bytes); err != nil {
+			return err
+		}
+	}
+	for k := range b.limited {
+		limit := rollupLimit(k.dim)
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM rollups WHERE resolution = ? AND dim = ? AND bucket = ? AND host = ?",
+			k.resolution, k.dim, k.bucket, k.host).Scan(&n); err != nil {
+			return err
+		}
+		if n <= 2*limit {
+			continue
+		}
+		if err := trimRollups(tx, k.dim, limit, "resolution = ? AND bucket = ? AND host = ?", k.resolution, k.bucket, k.host); err != nil {
+			return err
+		}
+	}
+	ipStmt, err := tx.Prepare("INSERT OR IGNORE INTO rollup_ips (day, host, ip) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ipStmt.Close()
+	for k := range b.ips {
+		if _, err := ipStmt.Exec(k[0], k[1], k[2]); err != nil {
+			return err
+		}
+	}
+	hourStmt, err := tx.Prepare("INSERT OR IGNORE INTO rollup_hour_ips (hour, host, ip) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer hourStmt.Close()
+	for k := range b.hourIPs {
+		if _, err := hourStmt.Exec(k[0], k[1], k[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createRollupTables creates the rollup tables and fills them from stored
+// rows if they did not exist before.
+func createRollupTables(db *sql.DB) error {
+	var exists, hourIPs int
+	err := db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'rollups'),
+		(SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'rollup_hour_ips')`).Scan(&exists, &hourIPs)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(rollupSchema); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return rebuildRollups(db)
+	}
+	if hourIPs == 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fillHourIPs(tx, math.MaxInt64); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return limitPathRollups(db)
+}
+
+// fillHourIPs replaces the hourly address lists of hours before end with
+// those of the raw rows since the minute rollup horizon.
+func fillHourIPs(tx *sql.Tx, end int64) error {
+	if _, err := tx.Exec("DELETE FROM rollup_hour_ips WHERE hour < ?", end); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT OR IGNORE INTO rollup_hour_ips (hour, host, ip)
+		SELECT CAST(time AS INTEGER) / 3600 * 3600, COALESCE(host, ''), COALESCE(remote_addr, '') FROM log_entries
+		WHERE time >= ? AND time < ?`, time.Now().Add(-minuteRollupAge).Unix()/resMinute*resMinute, end)
+	return err
+}
+
+// limitPathRollups brings the path rollups of earlier versions, which kept
+// every path at every resolution, within pathRollupLimit, and fills them
+// from the stored rows for versions that kept none.
+func limitPathRollups(db *sql.DB) error {
+	var minutes, any int
+	err := db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM (SELECT 1 FROM rollups WHERE resolution = ? AND dim = 'path' LIMIT 1)),
+		(SELECT COUNT(*) FROM (SELECT 1 FROM rollups WHERE dim = 'path' LIMIT 1))`, resMinute).Scan(&minutes, &any)
+	if err != nil {
+		return err
+	}
+	if any > 0 && minutes == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if any == 0 {
+		var oldest sql.NullFloat64
+		if err := tx.QueryRow("SELECT MIN(time) FROM log_entries").Scan(&oldest); err != nil {
+			return err
+		}
+		if oldest.Valid {
+			for _, res := range []int64{resHour, resDay} {
+				if err := fillRollupDim(tx, findRollupDim("path"), res, int64(oldest.Float64)/res*res, math.MaxInt64); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Commit()
+	}
+	if _, err := tx.Exec("DELETE FROM rollups WHERE resolution = ? AND dim = 'path'", resMinute); err != nil {
+		return err
+	}
+	if err := trimRollups(tx, "path", pathRollupLimit, "1"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// trimRollups keeps the limit busiest values of dim in each bucket and host
+// matched by where, and adds the rest to their bucket's otherPaths row.
+func trimRollups(tx *sql.Tx, dim string, limit int, where string, args ...interface{}) error {
+	ranked := `WITH ranked AS (
+		SELECT resolution, bucket, host, value, requests, bytes,
+			ROW_NUMBER() OVER (PARTITION BY resolution, bucket, host ORDER BY requests DESC, value) AS rn
+		FROM rollups WHERE dim = ? AND value <> ? AND ` + where + `) `
+	rankedArgs := append([]interface{}{dim, otherPaths}, args...)
+	_, err := tx.Exec(ranked+`
+		INSERT INTO rollups (resolution, dim, bucket, host, value, requests, bytes)
+		SELECT resolution, ?, bucket, host, ?, SUM(requests), SUM(bytes) FROM ranked WHERE rn > ?
+		GROUP BY resolution, bucket, host
+		ON CONFLICT DO UPDATE SET requests = requests + excluded.requests, bytes = bytes + excluded.bytes`,
+		append(rankedArgs, dim, otherPaths, limit)...)
+	if err != nil {
+		return fmt.Errorf("trim %s rollups: %w", dim, err)
+	}
+	_, err = tx.Exec(ranked+`
+		DELETE FROM rollups WHERE dim = ? AND (resolution, bucket, host, value) IN
+			(SELECT resolution, bucket, host, value FROM ranked WHERE rn > ?)`,
+		append(rankedArgs, dim, limit)...)
+	if err != nil {
+		return fmt.Errorf("trim %s rollups: %w", dim, err)
+	}
+	return nil
+}
+
+// RebuildRollups recomputes all rollups from log_entries, e.g. after rows
+// were changed outside the analyzer. Rollups for periods whose raw rows were
+// already deleted are kept.
+func (r *SQLiteRepository) RebuildRollups() error {
+	return rebuildRollups(r.db)
+}
+
+func rebuildRollups(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var oldest sql.NullFloat64
+	if err := tx.QueryRow("SELECT MIN(time) FROM log_entries").Scan(&oldest); err != nil {
+		return err
+	}
+	if !oldest.Valid {
+		return tx.Commit()
+	}
+	minuteHorizon := time.Now().Add(-minuteRollupAge).Unix()
+	for _, res := range rollupResolutions {
+		// The oldest bucket may have lost rows to retention already; keep
+		// its rollup if there is one.
+		from := int64(oldest.Float64) / res * res
+		var kept int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM rollups WHERE resolution = ? AND bucket = ?", res, from).Scan(&kept); err != nil {
+			return err
+		}
+		if kept > 0 {
+			from += res
+		}
+		if res == resMinute && from < minuteHorizon {
+			from = minuteHorizon / res * res
+		}
+		if err := fillRollups(tx, res, from, math.MaxInt64); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM rollup_ips"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO rollup_ips (day, host, ip)
+		SELECT CAST(time AS INTEGER) / 86400 * 86400, COALESCE(host, ''), COALESCE(remote_addr, '') FROM log_entries`); err != nil {
+		return err
+	}
+	if err := fillHourIPs(tx, math.MaxInt64); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fillRollups replaces the rollups of one resolution for buckets in
+// [from, to) with totals computed from log_entries.
+func fillRollups(tx *sql.Tx, res, from, to int64) error {
+	if _, err := tx.Exec("DELETE FROM rollups WHERE resolution = ? AND bucket >= ? AND bucket < ?", res, from, to); err != nil {
+		return err
+	}
+	for _, d := range rollupDims {
+		if d.limit > 0 && res == resMinute {
+			continue
+		}
+		if err := fillRollupDim(tx, d, res, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillRollupDim adds the rollups of one dimension and resolution for
+// buckets in [from, to), which must have none yet.
+func fillRollupDim(tx *sql.Tx, d rollupDim, res, from, to int64) error {
+	where := " WHERE time >= ? AND time < ?"
+	if d.cond != "" {
+		where += " AND " + d.cond
+	}
+	_, err := tx.Exec(`
+		INSERT INTO rollups (resolution, dim, bucket, host, value, requests, bytes)
+		SELECT ?, ?, CAST(time AS INTEGER) / ? * ? as b, COALESCE(host, '') as h, `+d.expr+` as v, SUM(sample_rate), SUM(COALESCE(bytes, 0) * sample_rate)
+		FROM log_entries`+where+`
+		GROUP BY b, h, v`, res, d.name, res, res, from, to)
+	if err != nil {
+		return fmt.Errorf("rebuild %s rollups: %w", d.name, err)
+	}
+	if d.limit > 0 {
+		return trimRollups(tx, d.name, d.limit, "resolution = ? AND bucket >= ? AND bucket < ?", res, from, to)
+	}
+	return nil
+}
+
+// refreshRollupIPs rebuilds the address lists of the days up to and
+// including t's from the (now anonymized) raw rows.
+func refreshRollupIPs(db *sql.DB, t time.Time) error {
+	end := t.Unix()/resDay*resDay + resDay
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM rollup_ips WHERE day < ?", end); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO rollup_ips (day, host, ip)
+		SELECT CAST(time AS INTEGER) / 86400 * 86400, COALESCE(host, ''), COALESCE(remote_addr, '') FROM log_entries WHERE time < ?`, end); err != nil {
+		return err
+	}
+	if err := fillHourIPs(tx, end); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rollupScope selects rollup rows of one resolution overlapping [from, to],
+// limited by the filters' host list.
+type rollupScope struct {
+	res      int64
+	where    string
+	args     []interface{}
+	from, to int64
+}
+
+func newRollupScope(res int64, filters QueryFilters) rollupScope {
+	from, to := int64(0), time.Now().Unix()
+	if filters.TimeFrom != nil {
+		from = filters.TimeFrom.Unix()
+	}
+	if filters.TimeTo != nil {
+		to = filters.TimeTo.Unix()
+	}
+	s := rollupScope{res: res, from: from, to: to}
+	s.where = " WHERE resolution = ? AND dim = ? AND bucket >= ? AND bucket <= ?"
+	s.args = []interface{}{res, nil, from / res * res, to}
+	if filters.Host != "" {
+		includes, excludes := parseTextFilter(filters.Host)
+		if clause, vals := buildTextMatchClause("host", includes, excludes, false); clause != "" {
+			s.where += " AND " + clause
+			s.args = append(s.args, vals...)
+		}
+	}
+	return s
+}
+
+// endingBy limits s to buckets that end by t, so it does not overlap a
+// scope whose first bucket starts at t.
+func (s rollupScope) endingBy(t int64) rollupScope {
+	s.args = append([]interface{}{}, s.args...)
+	s.args[3] = t - s.res
+	return s
+}
+
+// on returns the WHERE clause and arguments for one dimension.
+func (s rollupScope) on(dim string) (string, []interface{}) {
+	args := append([]interface{}{}, s.args...)
+	args[1] = dim
+	return s.where, args
+}
+
+// pickResolution returns the finest resolution whose rollups reach back to
+// from, switching to days once hourly rows would outnumber daily ones by
+// far. Retention prunes each resolution on its own schedule, so this is read
+// from the table rather than assumed.
+func (r *SQLiteRepository) pickResolution(from, to time.Time) (int64, error) {
+	oldest := make(map[int64]int64, len(rollupResolutions))
+	for _, res := range rollupResolutions {
+		var b sql.NullInt64
+		if err := r.db.QueryRow("SELECT MIN(bucket) FROM rollups WHERE resolution = ? AND dim = 'status'", res).Scan(&b); err != nil {
+			return 0, err
+		}
+		oldest[res] = math.MaxInt64
+		if b.Valid {
+			oldest[res] = b.Int64
+		}
+	}
+	// A resolution whose oldest bucket is later than from still covers the
+	// window if nothing was recorded before that bucket: no earlier day of
+	// the window has a daily rollup, and the bucket's own day adds up to the
+	// same total at both resolutions.
+	covers := func(res int64) (bool, error) {
+		start := from.Unix()
+		if oldest[res] <= start/res*res {
+			return true, nil
+		}
+		if oldest[res] == math.MaxInt64 {
+			return false, nil
+		}
+		day := oldest[res] / resDay * resDay
+		var earlier, missing int64
+		err := r.db.QueryRow(`SELECT
+			COALESCE(SUM(CASE WHEN resolution = ? AND bucket < ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN resolution = ? AND bucket = ? THEN requests WHEN resolution = ? THEN -requests ELSE 0 END), 0)
+			FROM rollups WHERE dim = 'status' AND resolution IN (?, ?) AND bucket >= ? AND bucket < ?`,
+			resDay, day, resDay, day, res, resDay, res, start/resDay*resDay, day+resDay).Scan(&earlier, &missing)
+		if err != nil {
+			return false, err
+		}
+		return earlier == 0 && missing <= 0, nil
+	}
+	if to.Sub(from) <= minuteRollupAge {
+		if ok, err := covers(resMinute); err != nil || ok {
+			return resMinute, err
+		}
+	}
+	if to.Sub(from) <= 90*24*time.Hour {
+		if ok, err := covers(resHour); err != nil || ok {
+			return resHour, err
+		}
+	}
+	return resDay, nil
+}
+
+// rollupTop returns the busiest values of dim. The requests of paths trimmed
+// from their buckets are left out.
+func (r *SQLiteRepository) rollupTop(s rollupScope, dim string, limit int) ([]LabelCount, error) {
+	where, args := s.on(dim)
+	if rollupLimit(dim) > 0 {
+		where += " AND value <> ?"
+		args = append(args, otherPaths)
+	}
+	rows, err := r.db.Query("SELECT value, SUM(requests) as cnt FROM rollups"+where+
+		" GROUP BY value ORDER BY cnt DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LabelCount
+	for rows.Next() {
+		var lc LabelCount
+		if err := rows.Scan(&lc.Label, &lc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, lc)
+	}
+	return out, rows.Err()
+}
+
+// GetDashboardStats answers entirely from rollups. Totals and top lists use
+// the finest resolution that suits the window, so the first bucket may
+// reach up to one bucket before the window start.
+func (r *SQLiteRepository) GetDashboardStats(filters QueryFilters, bucket time.Duration) (*DashboardStats, error) {
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	if filters.TimeFrom != nil {
+		from = *filters.TimeFrom
+	}
+	if filters.TimeTo != nil {
+		to = *filters.TimeTo
+	}
+	filters.TimeFrom, filters.TimeTo = &from, &to
+	res, err := r.pickResolution(from, to)
+	if err != nil {
+		return nil, err
+	}
+	scope := newRollupScope(res, filters)
+	stats := &DashboardStats{}
+
+	// Total requests and errors (4xx + 5xx)
+	where, args := scope.on("status")
+	var errors int64
+	err = r.db.QueryRow(`
+		SELECT COALESCE(SUM(requests), 0),
+			COALESCE(SUM(CASE WHEN CAST(value AS INTEGER) >= 400 THEN requests ELSE 0 END), 0)
+		FROM rollups`+where, args...).Scan(&stats.TotalRequests, &errors)
+	if err != nil {
+		return nil, err
+	}
+	if stats.TotalRequests > 0 {
+		stats.ErrorRate = float64(errors) / float64(stats.TotalRequests) * 100
+	}
+
+	// Total requests in the window of the same length just before, up to
+	// the first bucket counted above
+	prevFrom, prevTo := from.Add(-to.Sub(from)), from
+	prev := filters
+	prev.TimeFrom, prev.TimeTo = &prevFrom, &prevTo
+	prevRes, err := r.pickResolution(prevFrom, prevTo)
+	if err != nil {
+		return nil, err
+	}
+	where, args = newRollupScope(prevRes, prev).endingBy(from.Unix() / res * res).on("status")
+	if err := r.db.QueryRow("SELECT COALESCE(SUM(requests), 0) FROM rollups"+where, args...).Scan(&stats.PrevRequests); err != nil {
+		return nil, err
+	}
+
+	// Unique IPs from the per-hour address lists while they reach back to
+	// the window start, otherwise from the per-day ones. Either way the
+	// first hour or day is counted whole.
+	ipTable, ipCol, ipRes := "rollup_ips", "day", int64(resDay)
+	if from.Unix()/resHour*resHour >= now.Add(-minuteRollupAge).Unix()/resMinute*resMinute {
+		ipTable, ipCol, ipRes = "rollup_hour_ips", "hour", resHour
+	}
+	ipWhere := " WHERE " + ipCol + " >= ? AND " + ipCol + " <= ?"
+	ipArgs := []interface{}{from.Unix() / ipRes * ipRes, to.Unix()}
+	if filters.Host != "" {
+		includes, excludes := parseTextFilter(filters.Host)
+		if clause, vals := buildTextMatchClause("host", includes, excludes, false); clause != "" {
+			ipWhere += " AND " + clause
+			ipArgs = append(ipArgs, vals...)
+		}
+	}
+	if err := r.db.QueryRow("SELECT COUNT(DISTINCT ip) FROM "+ipTable+ipWhere, ipArgs...).Scan(&stats.UniqueIPs); err != nil {
+		return nil, err
+	}
+
+	// Requests over time, from minute rollups for sub-hour buckets and hour
+	// rollups otherwise. Buckets are aligned to local time.
+	chartRes := res
+	if chartRes == resMinute && bucket >= time.Hour {
+		chartRes = resHour
+	}
+	size := int64(bucket / time.Second)
+	if size < chartRes {
+		size = chartRes
+	}
+	where, args = newRollupScope(chartRes, filters).on("status")
+	rows, err := r.db.Query("SELECT bucket, SUM(requests) FROM rollups"+where+" GROUP BY bucket ORDER BY bucket", args...)
+	if err != nil {
+		return nil, err
+	}
+	layout := "2006-01-02 15:04"
+	if size >= resDay {
+		layout = "2006-01-02"
+	}
+	// Each rollup bucket is shifted by its own UTC offset, so buckets keep
+	// to the local clock on both sides of a DST change. The hour repeated
+	// when clocks go back lands in one bucket.
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var b, cnt int64
+		if err := rows.Scan(&b, &cnt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		_, offset := time.Unix(b, 0).Zone()
+		counts[(b+int64(offset))/size*size] += cnt
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	starts := make([]int64, 0, len(counts))
+	for start := range counts {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		// start is local wall-clock time counted as if it were UTC.
+		stats.RequestsByHour = append(stats.RequestsByHour, HourCount{Hour: time.Unix(start, 0).UTC().Format(layout), Count: counts[start]})
+	}
+
+	// Status distribution
+	statuses, err := r.rollupTop(scope, "status", 100)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range statuses {
+		code, _ := strconv.Atoi(lc.Label)
+		stats.StatusDistribution = append(stats.StatusDistribution, StatusCount{Status: code, Count: lc.Count})
+	}
+	sort.Slice(stats.StatusDistribution, func(i, j int) bool {
+		return stats.StatusDistribution[i].Status < stats.StatusDistribution[j].Status
+	})
+
+	// Top countries, paths and routes
+	countries, err := r.rollupTop(scope, "country", 10)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range countries {
+		stats.TopCountries = append(stats.TopCountries, CountryCount{Country: lc.Label, Count: lc.Count})
+	}
+	// Paths are not kept per minute; short windows read them by the hour.
+	pathScope := scope
+	if res == resMinute {
+		pathScope = newRollupScope(resHour, filters)
+	}
+	paths, err := r.rollupTop(pathScope, "path", 10)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range paths {
+		stats.TopPaths = append(stats.TopPaths, PathCount{Path: lc.Label, Count: lc.Count})
+	}
+	routes, err := r.rollupTop(scope, "route", 10)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range routes {
+		stats.TopRoutes = append(stats.TopRoutes, PathCount{Path: lc.Label, Count: lc.Count})
+	}
+
+	// Humans vs bots
+	bots, err := r.rollupTop(scope, "bot", 2)
+	if err != nil {
+		return nil, err
+	}
+	stats.HumansVsBots = []LabelCount{{Label: "Humans"}, {Label: "Bots"}}
+	for _, lc := range bots {
+		if lc.Label == "1" {
+			stats.HumansVsBots[1].Count = lc.Count
+		} else {
+			stats.HumansVsBots[0].Count = lc.Count
+		}
+	}
+
+	// Top browsers (humans only)
+	if stats.TopBrowsers, err = r.rollupTop(scope, "browser", 10); err != nil {
+		return nil, err
+	}
+
+	// Top networks
+	asns, err := r.rollupTop(scope, "asn", 10)
+	if err != nil {
+		return nil, err
+	}
+	for _, lc := range asns {
+		num, org, _ := strings.Cut(lc.Label, "\t")
+		asn, _ := strconv.ParseInt(num, 10, 64)
+		stats.TopASNs = append(stats.TopASNs, ASNCount{ASN: asn, Org: org, Count: lc.Count})
+	}
+
+	// Hosts seen in the window regardless of the host filter, for the picker
+	hostless := filters
+	hostless.Host = ""
+	where, args = newRollupScope(scope.res, hostless).on("status")
+	rows, err = r.db.Query("SELECT host, SUM(requests) as cnt FROM rollups"+where+
+		" GROUP BY host ORDER BY cnt DESC LIMIT 50", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lc LabelCount
+		if err := rows.Scan(&lc.Label, &lc.Count); err != nil {
+			return nil, err
+		}
+		stats.Hosts = append(stats.Hosts, lc)
+	}
+	return stats, rows.Err()
+}
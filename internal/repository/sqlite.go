@@ -3,6 +3,9 @@ package repository
 import (
 	"database/sql"
 	"fmt"
+	"math"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -37,16 +40,163 @@ CREATE INDEX IF NOT EXISTS idx_log_entries_host ON log_entries(host);
 CREATE INDEX IF NOT EXISTS idx_log_entries_created_at ON log_entries(created_at);
 `
 
+// columnMigrations lists columns added after the original schema. They are
+// added with ALTER TABLE when missing so existing databases keep working.
+var columnMigrations = []struct {
+	table, column, def string
+}{
+	{"log_entries", "sample_rate", "INTEGER NOT NULL DEFAULT 1"},
+	{"log_entries", "anonymized", "INTEGER NOT NULL DEFAULT 0"},
+	{"log_entries", "route", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "referer", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "ref_domain", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "search_engine", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "search_terms", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "utm_source", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "utm_medium", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "utm_campaign", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "browser", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "browser_version", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "os", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "device", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "is_bot", "INTEGER NOT NULL DEFAULT 0"},
+	{"log_entries", "bot_name", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "asn", "INTEGER NOT NULL DEFAULT 0"},
+	{"log_entries", "as_org", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "session_id", "TEXT NOT NULL DEFAULT ''"},
+	{"log_entries", "request_time", "REAL"},                   // NULL when not logged
+	{"log_entries", "archived", "INTEGER NOT NULL DEFAULT 0"}, // when it was restored from an archive, 0 = never
+	{"log_entries", "threats", "TEXT NOT NULL DEFAULT ''"},
+	{"incidents", "anonymized", "INTEGER NOT NULL DEFAULT 0"},
+	{"alert_events", "anonymized", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// indexes on migrated columns, created once the columns exist.
+const migratedIndexes = `
+CREATE INDEX IF NOT EXISTS idx_log_entries_route ON log_entries(route);
+CREATE INDEX IF NOT EXISTS idx_log_entries_ref_domain ON log_entries(ref_domain);
+CREATE INDEX IF NOT EXISTS idx_log_entries_utm_campaign ON log_entries(utm_campaign);
+CREATE INDEX IF NOT EXISTS idx_log_entries_asn ON log_entries(asn);
+CREATE INDEX IF NOT EXISTS idx_log_entries_browser ON log_entries(browser);
+CREATE INDEX IF NOT EXISTS idx_log_entries_is_bot ON log_entries(is_bot);
+CREATE INDEX IF NOT EXISTS idx_log_entries_session ON log_entries(session_id, time);
+CREATE INDEX IF NOT EXISTS idx_log_entries_threats ON log_entries(time) WHERE threats <> '';
+CREATE INDEX IF NOT EXISTS idx_log_entries_archived ON log_entries(archived) WHERE archived > 0;
+`
+
+// insertColumns are the columns InsertBatch writes; insertArgs returns the
+// values in the same order.
+var insertColumns = []string{
+	"time",
+	"remote_addr",
+	"host",
+	"method",
+	"path",
+	"route",
+	"query",
+	"protocol",
+	"status",
+	"bytes",
+	"city",
+	"country",
+	"user_agent",
+	"referer",
+	"ref_domain",
+	"search_engine",
+	"search_terms",
+	"utm_source",
+	"utm_medium",
+	"utm_campaign",
+	"browser",
+	"browser_version",
+	"os",
+	"device",
+	"is_bot",
+	"bot_name",
+	"asn",
+	"as_org",
+	"session_id",
+	"request_time",
+	"threats",
+	"sample_rate",
+	"anonymized",
+}
+
+var insertSQL = "INSERT OR IGNORE INTO log_entries (" + strings.Join(insertColumns, ", ") +
+	") VALUES (" + strings.TrimSuffix(strings.Repeat("?, ", len(insertColumns)), ", ") + ")"
+
+func insertArgs(e models.LogEntry) []interface{} {
+	return []interface{}{
+		e.Time,
+		e.RemoteAddr,
+		e.Host,
+		e.Method,
+		e.Path,
+		e.Route,
+		e.Query,
+		e.Protocol,
+		e.Status,
+		e.Bytes,
+		e.City,
+		e.Country,
+		e.UserAgent,
+		e.Referer,
+		e.RefDomain,
+		e.SearchEngine,
+		e.SearchTerms,
+		e.UTMSource,
+		e.UTMMedium,
+		e.UTMCampaign,
+		e.Browser,
+		e.BrowserVer,
+		e.OS,
+		e.Device,
+		e.IsBot,
+		e.BotName,
+		e.ASN,
+		e.ASOrg,
+		e.SessionID,
+		requestTime(e),
+		e.Threats,
+		sampleWeight(e),
+		e.Anonymized,
+	}
+}
+
+// routeExpr is the route of a row, falling back to the raw path for rows
+// stored before routes were recorded.
+const routeExpr = "COALESCE(NULLIF(route, ''), path)"
+
+// entryColumns is the column list every full-row SELECT uses; scanEntry
+// reads them back in the same order.
+const entryColumns = "id, time, remote_addr, host, method, path, route, query, protocol, status, bytes, city, country, user_agent, referer, ref_domain, search_engine, search_terms, utm_source, utm_medium, utm_campaign, browser, browser_version, os, device, is_bot, bot_name, asn, as_org, session_id, request_time, threats, sample_rate, anonymized, created_at"
+
 type SQLiteRepository struct {
 	db *sql.DB
 }
 
 func NewSQLite(dbPath string) (*SQLiteRepository, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Several goroutines write (tailing, uploads, background jobs), so wait
+	// for locks instead of failing with SQLITE_BUSY.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(schema); err != nil {
+	if _, err := db.Exec(schema + alertsSchema + incidentsSchema + bansSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(migratedIndexes); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// archived used to be a 0/1 flag; date earlier restores by when the
+	// row was stored.
+	if _, err := db.Exec(`UPDATE log_entries SET archived = CAST(strftime('%s', created_at) AS INTEGER) WHERE archived = 1`); err != nil {
 		db.Close()
 		return nil, err
 	}
@@ -57,10 +207,59 @@ func NewSQLite(dbPath string) (*SQLiteRepository, error) {
 	)`)
 	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_log_entries_unique
 		ON log_entries(time, remote_addr, host, method, path, query, status)`)
+	if err := createParamsTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createRollupTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go backfillParams(db)
 	return &SQLiteRepository{db: db}, nil
 }
 
+func migrateColumns(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?)", m.table)
+		if err != nil {
+			return err
+		}
+		exists := false
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			if name == m.column {
+				exists = true
+			}
+		}
+		rows.Close()
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.def)); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	return nil
+}
+
 func (r *SQLiteRepository) InsertBatch(entries []models.LogEntry) error {
+	return r.insertBatch(entries, false)
+}
+
+// RestoreBatch stores rows read back from an archive. They were counted in
+// the rollups when first ingested, so rollups are left alone. archived is
+// set to the time of the restore: retention counts from it and does not
+// archive the rows a second time.
+func (r *SQLiteRepository) RestoreBatch(entries []models.LogEntry) error {
+	return r.insertBatch(entries, true)
+}
+
+func (r *SQLiteRepository) insertBatch(entries []models.LogEntry, restored bool) error {
 	if len(entries) == 0 {
 		return nil
 	}
@@ -69,112 +268,62 @@ func (r *SQLiteRepository) InsertBatch(entries []models.LogEntry) error {
 		return err
 	}
 	defer tx.Rollback()
-	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO log_entries (time, remote_addr, host, method, path, query, protocol, status, bytes, city, country, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	stmt, err := tx.Prepare(insertSQL)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	for _, e := range entries {
-		_, err := stmt.Exec(e.Time, e.RemoteAddr, e.Host, e.Method, e.Path, e.Query, e.Protocol, e.Status, e.Bytes, e.City, e.Country, e.UserAgent)
+	paramStmt, err := tx.Prepare(insertParamSQL)
+	if err != nil {
+		return err
+	}
+	defer paramStmt.Close()
+	ids := make([]int64, len(entries))
+	rollups := newRollupBatch()
+	now := time.Now().Unix()
+	for i, e := range entries {
+		res, err := stmt.Exec(insertArgs(e)...)
 		if err != nil {
 			return err
 		}
-	}
-	return tx.Commit()
-}
-
-func (r *SQLiteRepository) Query(filters QueryFilters, limit, offset int) ([]models.LogEntry, int, error) {
-	var args []interface{}
-	var where []string
-
-	if filters.TimeFrom != nil {
-		where = append(where, "time >= ?")
-		args = append(args, float64(filters.TimeFrom.UnixNano())/1e9)
-	}
-	if filters.TimeTo != nil {
-		where = append(where, "time <= ?")
-		args = append(args, float64(filters.TimeTo.UnixNano())/1e9)
-	}
-	if filters.Status != "" {
-		includes, excludes := parseIntFilter(filters.Status)
-		if len(includes) > 0 {
-			placeholders := make([]string, len(includes))
-			for i, v := range includes {
-				placeholders[i] = "?"
-				args = append(args, v)
-			}
-			where = append(where, "status IN ("+strings.Join(placeholders, ",")+")")
-		}
-		if len(excludes) > 0 {
-			placeholders := make([]string, len(excludes))
-			for i, v := range excludes {
-				placeholders[i] = "?"
-				args = append(args, v)
-			}
-			where = append(where, "status NOT IN ("+strings.Join(placeholders, ",")+")")
+		// Duplicates are ignored; only new rows get an id and parameters.
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
 		}
-	}
-	if filters.Country != "" {
-		includes, excludes := parseTextFilter(filters.Country)
-		clause, vals := buildTextMatchClause("country", includes, excludes, false)
-		if clause != "" {
-			where = append(where, clause)
-			for _, v := range vals {
-				args = append(args, v)
-			}
+		if ids[i], err = res.LastInsertId(); err != nil {
+			return err
 		}
-	}
-	if filters.PathContains != "" {
-		includes, excludes := parseTextFilter(filters.PathContains)
-		clause, vals := buildTextMatchClause("path", includes, excludes, true)
-		if clause != "" {
-			where = append(where, clause)
-			for _, v := range vals {
-				args = append(args, v)
-			}
+		if err := insertParams(paramStmt, ids[i], e.Query); err != nil {
+			return err
 		}
-	}
-	if filters.Method != "" {
-		includes, excludes := parseTextFilter(filters.Method)
-		clause, vals := buildTextMatchClause("method", includes, excludes, false)
-		if clause != "" {
-			where = append(where, clause)
-			for _, v := range vals {
-				args = append(args, v)
+		if restored {
+			if _, err := tx.Exec("UPDATE log_entries SET archived = ? WHERE id = ?", now, ids[i]); err != nil {
+				return err
 			}
+			continue
 		}
+		rollups.add(e)
 	}
-	if filters.Host != "" {
-		includes, excludes := parseTextFilter(filters.Host)
-		clause, vals := buildTextMatchClause("host", includes, excludes, false)
-		if clause != "" {
-			where = append(where, clause)
-			for _, v := range vals {
-				args = append(args, v)
-			}
-		}
+	if err := rollups.write(tx); err != nil {
+		return err
 	}
-	if filters.UserAgentContains != "" {
-		includes, excludes := parseTextFilter(filters.UserAgentContains)
-		clause, vals := buildTextMatchClause("user_agent", includes, excludes, true)
-		if clause != "" {
-			where = append(where, clause)
-			for _, v := range vals {
-				args = append(args, v)
-			}
-		}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-
-	whereClause := ""
-	if len(where) > 0 {
-		whereClause = " WHERE " + strings.Join(where, " AND ")
+	for i := range entries {
+		entries[i].ID = ids[i]
 	}
+	return nil
+}
 
+// orderClause returns the ORDER BY clause for the filters' sort settings.
+func orderClause(filters QueryFilters) string {
 	orderBy := "time"
 	if filters.SortBy != "" {
 		allowed := map[string]bool{
 			"time": true, "status": true, "path": true, "host": true, "remote_addr": true, "bytes": true,
 			"method": true, "query": true, "protocol": true, "city": true, "country": true, "user_agent": true,
+			"asn": true, "browser": true, "os": true, "device": true, "route": true, "id": true,
 		}
 		if allowed[filters.SortBy] {
 			orderBy = filters.SortBy
@@ -184,126 +333,708 @@ func (r *SQLiteRepository) Query(filters QueryFilters, limit, offset int) ([]mod
 	if filters.SortDesc {
 		dir = "DESC"
 	}
+	return " ORDER BY " + orderBy + " " + dir
+}
 
-	// Count total
+func (r *SQLiteRepository) Query(filters QueryFilters, limit, offset int) ([]models.LogEntry, int, int64, error) {
+	whereClause, args := buildWhere(filters)
+
+	// Count total rows and the requests they stand for
 	var total int
-	countSQL := "SELECT COUNT(*) FROM log_entries" + whereClause
-	if err := r.db.QueryRow(countSQL, args...).Scan(&total); err != nil {
-		return nil, 0, err
+	var requests int64
+	countSQL := "SELECT COUNT(*), COALESCE(SUM(sample_rate), 0) FROM log_entries" + whereClause
+	if err := r.db.QueryRow(countSQL, args...).Scan(&total, &requests); err != nil {
+		return nil, 0, 0, err
 	}
 
 	// Query rows
 	args = append(args, limit, offset)
 	rows, err := r.db.Query(
-		"SELECT id, time, remote_addr, host, method, path, query, protocol, status, bytes, city, country, user_agent, created_at FROM log_entries"+whereClause+
-			" ORDER BY "+orderBy+" "+dir+" LIMIT ? OFFSET ?",
+		"SELECT "+entryColumns+" FROM log_entries"+whereClause+
+			orderClause(filters)+" LIMIT ? OFFSET ?",
 		args...,
 	)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	defer rows.Close()
 
 	var entries []models.LogEntry
 	for rows.Next() {
-		var e models.LogEntry
-		var createdAt sql.NullTime
-		err := rows.Scan(&e.ID, &e.Time, &e.RemoteAddr, &e.Host, &e.Method, &e.Path, &e.Query, &e.Protocol, &e.Status, &e.Bytes, &e.City, &e.Country, &e.UserAgent, &createdAt)
+		e, err := scanEntry(rows)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, 0, err
 		}
-		if createdAt.Valid {
-			e.CreatedAt = createdAt.Time
+		entries = append(entries, e)
+	}
+	return entries, total, requests, rows.Err()
+}
+
+// QueryAfter returns up to limit matching rows in (time, id) order, newest
+// first if filters.SortDesc, starting after the row at cursor (nil starts
+// at the beginning). Unlike offsets, cursors stay stable while rows arrive.
+func (r *SQLiteRepository) QueryAfter(filters QueryFilters, cursor *EntryCursor, limit int) ([]models.LogEntry, error) {
+	whereClause, args := buildWhere(filters)
+	cmp, dir := ">", "ASC"
+	if filters.SortDesc {
+		cmp, dir = "<", "DESC"
+	}
+	if cursor != nil {
+		whereClause = andWhere(whereClause, "(time "+cmp+" ? OR (time = ? AND id "+cmp+" ?))")
+		args = append(args, cursor.Time, cursor.Time, cursor.ID)
+	}
+	rows, err := r.db.Query("SELECT "+entryColumns+" FROM log_entries"+whereClause+
+		" ORDER BY time "+dir+", id "+dir+" LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []models.LogEntry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
 		}
 		entries = append(entries, e)
 	}
-	return entries, total, rows.Err()
+	return entries, rows.Err()
 }
 
-func (r *SQLiteRepository) GetDashboardStats(since time.Time) (*DashboardStats, error) {
-	sinceEpoch := float64(since.UnixNano()) / 1e9
-	stats := &DashboardStats{}
+// groupExprs are the columns Aggregate can group by.
+var groupExprs = map[string]string{
+	"status":        "CAST(status AS TEXT)",
+	"country":       "COALESCE(country, '')",
+	"city":          "COALESCE(city, '')",
+	"host":          "host",
+	"method":        "method",
+	"path":          "path",
+	"route":         routeExpr,
+	"remote_addr":   "remote_addr",
+	"asn":           "CAST(asn AS TEXT)",
+	"browser":       "browser",
+	"os":            "os",
+	"device":        "device",
+	"bot_name":      "bot_name",
+	"ref_domain":    "ref_domain",
+	"search_engine": "search_engine",
+	"utm_source":    "utm_source",
+	"utm_medium":    "utm_medium",
+	"utm_campaign":  "utm_campaign",
+	"session_id":    "session_id",
+	"hour":          "strftime('%Y-%m-%dT%H:00:00Z', time, 'unixepoch')",
+	"day":           "strftime('%Y-%m-%d', time, 'unixepoch')",
+}
 
-	// Total requests 24h
-	r.db.QueryRow("SELECT COUNT(*) FROM log_entries WHERE time >= ?", sinceEpoch).Scan(&stats.TotalRequests24h)
+// GroupFields lists the fields Aggregate accepts, sorted.
+func GroupFields() []string {
+	fields := make([]string, 0, len(groupExprs))
+	for f := range groupExprs {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
 
-	// Total requests 7d
-	sevenDaysAgo := since.Add(-6 * 24 * time.Hour)
-	sevenDaysEpoch := float64(sevenDaysAgo.UnixNano()) / 1e9
-	r.db.QueryRow("SELECT COUNT(*) FROM log_entries WHERE time >= ?", sevenDaysEpoch).Scan(&stats.TotalRequests7d)
+func (r *SQLiteRepository) Aggregate(filters QueryFilters, by string, limit int) ([]GroupStat, error) {
+	expr, ok := groupExprs[by]
+	if !ok {
+		return nil, fmt.Errorf("cannot group by %q", by)
+	}
+	order := "requests DESC, key"
+	if by == "hour" || by == "day" {
+		order = "key"
+	}
+	whereClause, args := buildWhere(filters)
+	rows, err := r.db.Query("SELECT "+expr+" as key, COUNT(*), SUM(sample_rate) as requests, SUM(bytes * sample_rate) FROM log_entries"+whereClause+
+		" GROUP BY key ORDER BY "+order+" LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []GroupStat
+	for rows.Next() {
+		var g GroupStat
+		var key sql.NullString
+		var bytes sql.NullInt64
+		if err := rows.Scan(&key, &g.Rows, &g.Requests, &bytes); err != nil {
+			return nil, err
+		}
+		g.Key, g.Bytes = key.String, bytes.Int64
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
 
-	// Error rate 24h (4xx + 5xx)
-	var errors int64
-	r.db.QueryRow("SELECT COUNT(*) FROM log_entries WHERE time >= ? AND status >= 400", sinceEpoch).Scan(&errors)
-	if stats.TotalRequests24h > 0 {
-		stats.ErrorRate24h = float64(errors) / float64(stats.TotalRequests24h) * 100
+// Iterate calls fn for every matching row in sort order, reading them from
+// one cursor so the result set is never held in memory. An error from fn
+// stops the iteration and is returned.
+func (r *SQLiteRepository) Iterate(filters QueryFilters, fn func(models.LogEntry) error) error {
+	whereClause, args := buildWhere(filters)
+	rows, err := r.db.Query("SELECT "+entryColumns+" FROM log_entries"+whereClause+orderClause(filters), args...)
+	if err != nil {
+		return err
 	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *SQLiteRepository) MaxID() (int64, error) {
+	var id int64
+	err := r.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM log_entries").Scan(&id)
+	return id, err
+}
 
-	// Unique IPs 24h
-	r.db.QueryRow("SELECT COUNT(DISTINCT remote_addr) FROM log_entries WHERE time >= ?", sinceEpoch).Scan(&stats.UniqueIPs24h)
+func scanEntry(rows *sql.Rows) (models.LogEntry, error) {
+	var e models.LogEntry
+	var createdAt sql.NullTime
+	var requestTime sql.NullFloat64
+	err := rows.Scan(&e.ID, &e.Time, &e.RemoteAddr, &e.Host, &e.Method, &e.Path, &e.Route, &e.Query, &e.Protocol, &e.Status, &e.Bytes, &e.City, &e.Country, &e.UserAgent, &e.Referer, &e.RefDomain, &e.SearchEngine, &e.SearchTerms, &e.UTMSource, &e.UTMMedium, &e.UTMCampaign, &e.Browser, &e.BrowserVer, &e.OS, &e.Device, &e.IsBot, &e.BotName, &e.ASN, &e.ASOrg, &e.SessionID, &requestTime, &e.Threats, &e.SampleRate, &e.Anonymized, &createdAt)
+	if err != nil {
+		return e, err
+	}
+	if createdAt.Valid {
+		e.CreatedAt = createdAt.Time
+	}
+	e.RequestTime = -1
+	if requestTime.Valid {
+		e.RequestTime = requestTime.Float64
+	}
+	return e, nil
+}
 
-	// Requests by hour (last 24h)
+// sampleWeight is the number of real requests a stored row stands for.
+func sampleWeight(e models.LogEntry) int {
+	if e.SampleRate < 1 {
+		return 1
+	}
+	return e.SampleRate
+}
+
+// requestTime maps the "not logged" marker to NULL so percentiles skip it.
+func requestTime(e models.LogEntry) interface{} {
+	if e.RequestTime < 0 {
+		return nil
+	}
+	return e.RequestTime
+}
+
+func (r *SQLiteRepository) RouteStats(filters QueryFilters, limit int) ([]RouteStat, error) {
+	whereClause, args := buildWhere(filters)
+	args = append(args, limit)
 	rows, err := r.db.Query(`
-		SELECT strftime('%Y-%m-%d %H:00', datetime(time, 'unixepoch', 'localtime')) as hour, COUNT(*) as cnt
-		FROM log_entries WHERE time >= ?
-		GROUP BY hour ORDER BY hour
-	`, sevenDaysEpoch)
+		SELECT `+routeExpr+` as rt,
+			SUM(sample_rate) as cnt,
+			SUM(CASE WHEN status >= 400 THEN sample_rate ELSE 0 END),
+			SUM(CASE WHEN status >= 500 THEN sample_rate ELSE 0 END),
+			SUM(bytes * sample_rate),
+			COUNT(DISTINCT remote_addr),
+			COUNT(DISTINCT path)
+		FROM log_entries`+whereClause+`
+		GROUP BY rt ORDER BY cnt DESC LIMIT ?`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	var out []RouteStat
+	for rows.Next() {
+		var rs RouteStat
+		if err := rows.Scan(&rs.Route, &rs.Requests, &rs.Errors, &rs.ServerErrors, &rs.Bytes, &rs.UniqueIPs, &rs.DistinctPaths); err != nil {
+			return nil, err
+		}
+		if rs.Requests > 0 {
+			rs.ErrorRate = float64(rs.Errors) / float64(rs.Requests) * 100
+		}
+		out = append(out, rs)
+	}
+	return out, rows.Err()
+}
+
+func (r *SQLiteRepository) IPProfile(addr string, limit int) (*IPProfile, error) {
+	p := &IPProfile{Addr: addr}
+	where, args := " WHERE remote_addr = ?", []interface{}{addr}
+	err := r.db.QueryRow(`
+		SELECT COALESCE(MIN(time), 0), COALESCE(MAX(time), 0),
+			COALESCE(SUM(sample_rate), 0),
+			COALESCE(SUM(bytes * sample_rate), 0),
+			COALESCE(SUM(CASE WHEN status >= 400 THEN sample_rate ELSE 0 END), 0),
+			COUNT(DISTINCT NULLIF(session_id, ''))
+		FROM log_entries`+where, args...).Scan(&p.FirstSeen, &p.LastSeen, &p.Requests, &p.Bytes, &p.Errors, &p.Sessions)
+	if err != nil || p.Requests == 0 {
+		return p, err
+	}
+	err = r.db.QueryRow("SELECT country, city, asn, as_org FROM log_entries"+where+" ORDER BY time DESC LIMIT 1", args...).
+		Scan(&p.Country, &p.City, &p.ASN, &p.ASOrg)
+	if err != nil {
+		return nil, err
+	}
+	if p.Statuses, err = r.topLabels("CAST(status AS TEXT)", where, args, limit); err != nil {
+		return nil, err
+	}
+	if p.Hosts, err = r.topLabels("host", where, args, limit); err != nil {
+		return nil, err
+	}
+	if p.Paths, err = r.topLabels("path", where, args, limit); err != nil {
+		return nil, err
+	}
+	if p.UserAgents, err = r.topLabels("user_agent", where, args, limit); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(`
+		SELECT CAST(strftime('%w', time, 'unixepoch', 'localtime') AS INTEGER) as wd,
+			CAST(strftime('%H', time, 'unixepoch', 'localtime') AS INTEGER) as hr,
+			SUM(sample_rate)
+		FROM log_entries`+where+` GROUP BY wd, hr`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var wd, hr int
+		var cnt int64
+		if err := rows.Scan(&wd, &hr, &cnt); err != nil {
+			return nil, err
+		}
+		if wd >= 0 && wd < 7 && hr >= 0 && hr < 24 {
+			p.Heatmap[wd][hr] = cnt
+		}
+	}
+	return p, rows.Err()
+}
+
+// bucketFormats are the strftime formats Breakdown groups volume by.
+var bucketFormats = map[string]string{
+	"hour": "%Y-%m-%d %H:00",
+	"day":  "%Y-%m-%d",
+}
+
+func (r *SQLiteRepository) Breakdown(filters QueryFilters, bucket string, limit int) (*Breakdown, error) {
+	whereClause, args := buildWhere(filters)
+	b := &Breakdown{}
+	err := r.db.QueryRow(`
+		SELECT COALESCE(SUM(sample_rate), 0),
+			COALESCE(SUM(CASE WHEN status >= 400 THEN sample_rate ELSE 0 END), 0),
+			COALESCE(SUM(bytes * sample_rate), 0),
+			COUNT(DISTINCT remote_addr)
+		FROM log_entries`+whereClause, args...).Scan(&b.Requests, &b.Errors, &b.Bytes, &b.UniqueIPs)
+	if err != nil || b.Requests == 0 {
+		return b, err
+	}
+
+	format, ok := bucketFormats[bucket]
+	if !ok {
+		format = bucketFormats["hour"]
+	}
+	rows, err := r.db.Query(`
+		SELECT strftime('`+format+`', datetime(time, 'unixepoch', 'localtime')) as bucket, SUM(sample_rate)
+		FROM log_entries`+whereClause+` GROUP BY bucket ORDER BY bucket`, args...)
+	if err != nil {
+		return nil, err
+	}
 	for rows.Next() {
 		var hc HourCount
-		rows.Scan(&hc.Hour, &hc.Count)
-		stats.RequestsByHour = append(stats.RequestsByHour, hc)
+		if err := rows.Scan(&hc.Hour, &hc.Count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.Volume = append(b.Volume, hc)
 	}
+	rows.Close()
 
-	// Status distribution
-	rows2, err := r.db.Query("SELECT status, COUNT(*) FROM log_entries WHERE time >= ? GROUP BY status ORDER BY status", sinceEpoch)
+	rows, err = r.db.Query("SELECT status, SUM(sample_rate) FROM log_entries"+whereClause+" GROUP BY status ORDER BY status", args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows2.Close()
-	for rows2.Next() {
+	for rows.Next() {
 		var sc StatusCount
-		rows2.Scan(&sc.Status, &sc.Count)
-		stats.StatusDistribution = append(stats.StatusDistribution, sc)
+		if err := rows.Scan(&sc.Status, &sc.Count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		b.Statuses = append(b.Statuses, sc)
+	}
+	rows.Close()
+
+	if b.TopIPs, err = r.topLabels("remote_addr", whereClause, args, limit); err != nil {
+		return nil, err
+	}
+	if b.TopReferrers, err = r.topLabels("ref_domain", andWhere(whereClause, "ref_domain <> ''"), args, limit); err != nil {
+		return nil, err
+	}
+	if b.TopUserAgents, err = r.topLabels("user_agent", whereClause, args, limit); err != nil {
+		return nil, err
+	}
+	if b.TopPaths, err = r.topLabels("path", whereClause, args, limit); err != nil {
+		return nil, err
+	}
+	if b.TopHosts, err = r.topLabels("host", whereClause, args, limit); err != nil {
+		return nil, err
+	}
+	if b.Latency, err = r.latency(whereClause, args); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// latency computes nearest-rank request time percentiles. Each stored row
+// counts once, so sampled rows are not weighted here.
+func (r *SQLiteRepository) latency(whereClause string, args []interface{}) (*LatencyStats, error) {
+	whereClause = andWhere(whereClause, "request_time IS NOT NULL")
+	var ls LatencyStats
+	err := r.db.QueryRow("SELECT COUNT(*), COALESCE(MAX(request_time), 0) FROM log_entries"+whereClause, args...).Scan(&ls.Samples, &ls.Max)
+	if err != nil || ls.Samples == 0 {
+		return nil, err
+	}
+	for _, p := range []struct {
+		pct float64
+		dst *float64
+	}{{0.50, &ls.P50}, {0.90, &ls.P90}, {0.95, &ls.P95}, {0.99, &ls.P99}} {
+		offset := int64(math.Ceil(p.pct*float64(ls.Samples))) - 1
+		if offset < 0 {
+			offset = 0
+		}
+		err := r.db.QueryRow("SELECT request_time FROM log_entries"+whereClause+" ORDER BY request_time LIMIT 1 OFFSET ?",
+			append(append([]interface{}{}, args...), offset)...).Scan(p.dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ls, nil
+}
+
+// sessionOrders are the orderings Sessions accepts; the default is "recent".
+var sessionOrders = map[string]string{
+	"recent":   "started DESC",
+	"duration": "(ended - started) DESC",
+	"requests": "cnt DESC",
+}
+
+func (r *SQLiteRepository) Sessions(filters QueryFilters, orderBy string, limit int) ([]SessionSummary, error) {
+	whereClause, args := buildWhere(filters)
+	order, ok := sessionOrders[orderBy]
+	if !ok {
+		order = sessionOrders["recent"]
+	}
+	args = append(args, limit)
+	rows, err := r.db.Query(`
+		SELECT s.*,
+			(SELECT path FROM log_entries x WHERE x.session_id = s.session_id ORDER BY time LIMIT 1),
+			(SELECT path FROM log_entries x WHERE x.session_id = s.session_id ORDER BY time DESC LIMIT 1)
+		FROM (
+			SELECT session_id, MIN(time) as started, MAX(time) as ended,
+				SUM(sample_rate) as cnt,
+				SUM(CASE WHEN status >= 400 THEN sample_rate ELSE 0 END),
+				COUNT(DISTINCT path),
+				MAX(remote_addr), MAX(user_agent), MAX(country),
+				MAX(browser), MAX(os), MAX(device), MAX(is_bot), MAX(bot_name)
+			FROM log_entries`+andWhere(whereClause, "session_id <> ''")+`
+			GROUP BY session_id ORDER BY `+order+` LIMIT ?
+		) s`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SessionSummary
+	for rows.Next() {
+		var s SessionSummary
+		if err := rows.Scan(&s.ID, &s.Start, &s.End, &s.Requests, &s.Errors, &s.DistinctPaths,
+			&s.RemoteAddr, &s.UserAgent, &s.Country, &s.Browser, &s.OS, &s.Device, &s.IsBot, &s.BotName,
+			&s.EntryPath, &s.ExitPath); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func (r *SQLiteRepository) TrafficSources(filters QueryFilters, limit int) (*TrafficSources, error) {
+	whereClause, args := buildWhere(filters)
+	ts := &TrafficSources{}
+
+	err := r.db.QueryRow(`
+		SELECT COALESCE(SUM(sample_rate), 0),
+			COALESCE(SUM(CASE WHEN ref_domain <> '' THEN sample_rate ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN search_engine <> '' THEN sample_rate ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN utm_source <> '' OR utm_campaign <> '' THEN sample_rate ELSE 0 END), 0)
+		FROM log_entries`+whereClause, args...).Scan(&ts.TotalRequests, &ts.Referred, &ts.Search, &ts.Campaign)
+	if err != nil {
+		return nil, err
+	}
+
+	if ts.TopReferrers, err = r.topLabels("ref_domain", andWhere(whereClause, "ref_domain <> ''"), args, limit); err != nil {
+		return nil, err
+	}
+	if ts.SearchEngines, err = r.topLabels("search_engine", andWhere(whereClause, "search_engine <> ''"), args, limit); err != nil {
+		return nil, err
+	}
+	if ts.SearchTerms, err = r.topLabels("search_terms", andWhere(whereClause, "search_terms <> ''"), args, limit); err != nil {
+		return nil, err
 	}
 
-	// Top countries
-	rows3, err := r.db.Query(`
-		SELECT COALESCE(country, '') as c, COUNT(*) FROM log_entries WHERE time >= ? GROUP BY c ORDER BY COUNT(*) DESC LIMIT 10
-	`, sinceEpoch)
+	rows, err := r.db.Query(`
+		SELECT utm_source, utm_medium, utm_campaign, SUM(sample_rate) as cnt
+		FROM log_entries`+andWhere(whereClause, "(utm_source <> '' OR utm_campaign <> '')")+`
+		GROUP BY utm_source, utm_medium, utm_campaign ORDER BY cnt DESC LIMIT ?`, append(append([]interface{}{}, args...), limit)...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows3.Close()
-	for rows3.Next() {
-		var cc CountryCount
-		rows3.Scan(&cc.Country, &cc.Count)
-		stats.TopCountries = append(stats.TopCountries, cc)
+	defer rows.Close()
+	for rows.Next() {
+		var cc CampaignCount
+		if err := rows.Scan(&cc.Source, &cc.Medium, &cc.Campaign, &cc.Count); err != nil {
+			return nil, err
+		}
+		ts.Campaigns = append(ts.Campaigns, cc)
 	}
 
-	// Top paths
-	rows4, err := r.db.Query(`
-		SELECT path, COUNT(*) FROM log_entries WHERE time >= ? GROUP BY path ORDER BY COUNT(*) DESC LIMIT 10
-	`, sinceEpoch)
+	// Landing paths: where visitors arriving from elsewhere first hit the site.
+	landing, err := r.topLabels("path", andWhere(whereClause, "(ref_domain <> '' OR utm_source <> '')"), args, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer rows4.Close()
-	for rows4.Next() {
-		var pc PathCount
-		rows4.Scan(&pc.Path, &pc.Count)
-		stats.TopPaths = append(stats.TopPaths, pc)
+	for _, l := range landing {
+		ts.LandingPaths = append(ts.LandingPaths, PathCount{Path: l.Label, Count: l.Count})
 	}
+	return ts, nil
+}
 
-	return stats, nil
+// topLabels returns the busiest values of expr among rows matching
+// whereClause, weighted by sample rate.
+func (r *SQLiteRepository) topLabels(expr, whereClause string, args []interface{}, limit int) ([]LabelCount, error) {
+	rows, err := r.db.Query("SELECT "+expr+" as label, SUM(sample_rate) as cnt FROM log_entries"+whereClause+
+		" GROUP BY label ORDER BY cnt DESC LIMIT ?", append(append([]interface{}{}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []LabelCount
+	for rows.Next() {
+		var lc LabelCount
+		if err := rows.Scan(&lc.Label, &lc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, lc)
+	}
+	return out, rows.Err()
 }
 
-func (r *SQLiteRepository) DeleteOlderThan(t time.Time) error {
+func (r *SQLiteRepository) AnonymizeOlderThan(t time.Time, anonymize func(e *models.LogEntry)) (int, error) {
 	epoch := float64(t.UnixNano()) / 1e9
-	_, err := r.db.Exec("DELETE FROM log_entries WHERE time < ?", epoch)
+	total := 0
+	var lastID int64
+	for {
+		rows, err := r.db.Query(`SELECT id, time, remote_addr, host, method, path, query, status, referer, search_terms, session_id, sample_rate
+			FROM log_entries WHERE time < ? AND anonymized = 0 AND id > ? ORDER BY id LIMIT 1000`, epoch, lastID)
+		if err != nil {
+			return total, err
+		}
+		var batch []models.LogEntry
+		for rows.Next() {
+			var e models.LogEntry
+			if err := rows.Scan(&e.ID, &e.Time, &e.RemoteAddr, &e.Host, &e.Method, &e.Path, &e.Query, &e.Status, &e.Referer, &e.SearchTerms, &e.SessionID, &e.SampleRate); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			if err := r.anonymizeIncidents(epoch, anonymize); err != nil {
+				return total, err
+			}
+			if err := r.anonymizeAlertEvents(epoch, anonymize); err != nil {
+				return total, err
+			}
+			if total > 0 {
+				// Unique IP counts must not keep the raw addresses.
+				return total, refreshRollupIPs(r.db, t)
+			}
+			return total, nil
+		}
+		lastID = batch[len(batch)-1].ID
+
+		tx, err := r.db.Begin()
+		if err != nil {
+			return total, err
+		}
+		if err := anonymizeBatch(tx, batch, anonymize); err != nil {
+			tx.Rollback()
+			return total, err
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+		total += len(batch)
+	}
+}
+
+// anonymizeIncidents rewrites the client addresses of incidents last seen
+// before epoch.
+func (r *SQLiteRepository) anonymizeIncidents(epoch float64, anonymize func(e *models.LogEntry)) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, remote_addr FROM incidents WHERE last_seen < ? AND anonymized = 0", epoch)
+	if err != nil {
+		return err
+	}
+	var incs []Incident
+	for rows.Next() {
+		var inc Incident
+		if err := rows.Scan(&inc.ID, &inc.RemoteAddr); err != nil {
+			rows.Close()
+			return err
+		}
+		incs = append(incs, inc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, inc := range incs {
+		if _, err := tx.Exec("UPDATE incidents SET remote_addr = ?, anonymized = 1 WHERE id = ?", anonymizeAddr(inc.RemoteAddr, anonymize), inc.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// anonymizeAlertEvents rewrites the client addresses of alert events that
+// resolved before epoch. Only per-address rules have them, in the subject,
+// the summary and the link's ip filter. Events still firing are left until
+// they resolve, since the alert manager rewrites their summary and link
+// then.
+func (r *SQLiteRepository) anonymizeAlertEvents(epoch float64, anonymize func(e *models.LogEntry)) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, subject, summary, query FROM alert_events WHERE resolved_at > 0 AND resolved_at < ? AND anonymized = 0", epoch)
+	if err != nil {
+		return err
+	}
+	var events []AlertEvent
+	for rows.Next() {
+		var e AlertEvent
+		if err := rows.Scan(&e.ID, &e.Subject, &e.Summary, &e.Query); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range events {
+		if e.Subject != "" {
+			anon := anonymizeAddr(e.Subject, anonymize)
+			e.Summary = strings.ReplaceAll(e.Summary, e.Subject, anon)
+			if u, err := url.Parse(e.Query); err == nil {
+				q := u.Query()
+				q.Set("ip", anon)
+				u.RawQuery = q.Encode()
+				e.Query = u.String()
+			}
+			e.Subject = anon
+		}
+		if _, err := tx.Exec("UPDATE alert_events SET subject = ?, summary = ?, query = ?, anonymized = 1 WHERE id = ?", e.Subject, e.Summary, e.Query, e.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// anonymizeAddr returns what anonymize makes of a client address.
+func anonymizeAddr(addr string, anonymize func(e *models.LogEntry)) string {
+	e := models.LogEntry{RemoteAddr: addr}
+	anonymize(&e)
+	return e.RemoteAddr
+}
+
+// anonymizeBatch rewrites the rows of batch in place. A row whose scrubbed
+// form duplicates another one (two requests that only differed in the
+// scrubbed parts) is merged into it: its weight is added to the other row
+// and its evidence links are moved there, so totals and rollups still add up.
+func anonymizeBatch(tx *sql.Tx, batch []models.LogEntry, anonymize func(e *models.LogEntry)) error {
+	update, err := tx.Prepare("UPDATE log_entries SET remote_addr = ?, query = ?, referer = ?, search_terms = ?, session_id = ?, anonymized = 1 WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	twin, err := tx.Prepare(`SELECT id FROM log_entries WHERE time = ? AND remote_addr = ? AND host = ? AND method = ?
+		AND path = ? AND query = ? AND status = ? AND id <> ?`)
+	if err != nil {
+		return err
+	}
+	defer twin.Close()
+	paramStmt, err := tx.Prepare(insertParamSQL)
+	if err != nil {
+		return err
+	}
+	defer paramStmt.Close()
+
+	for i := range batch {
+		e := &batch[i]
+		before := e.Query
+		anonymize(e)
+		var into int64
+		err := twin.QueryRow(e.Time, e.RemoteAddr, e.Host, e.Method, e.Path, e.Query, e.Status, e.ID).Scan(&into)
+		switch {
+		case err == nil:
+			if err := mergeEntry(tx, e.ID, into, e.SampleRate); err != nil {
+				return err
+			}
+			continue
+		case err != sql.ErrNoRows:
+			return err
+		}
+		if _, err := update.Exec(e.RemoteAddr, e.Query, e.Referer, e.SearchTerms, e.SessionID, e.ID); err != nil {
+			return err
+		}
+		if e.Query != before {
+			// Re-derive the parameters so scrubbed values go too.
+			if _, err := tx.Exec("DELETE FROM query_params WHERE entry_id = ?", e.ID); err != nil {
+				return err
+			}
+			if err := insertParams(paramStmt, e.ID, e.Query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeEntry folds the row id into the row into and deletes it.
+func mergeEntry(tx *sql.Tx, id, into int64, weight int) error {
+	if _, err := tx.Exec("UPDATE log_entries SET sample_rate = sample_rate + ? WHERE id = ?", max(weight, 1), into); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE OR IGNORE incident_evidence SET entry_id = ? WHERE entry_id = ?", into, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM incident_evidence WHERE entry_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM query_params WHERE entry_id = ?", id); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM log_entries WHERE id = ?", id)
 	return err
 }
 
@@ -311,6 +1042,173 @@ func (r *SQLiteRepository) Close() error {
 	return r.db.Close()
 }
 
+// buildWhere turns filters into a WHERE clause (with leading space, or empty)
+// and its positional arguments.
+func buildWhere(filters QueryFilters) (string, []interface{}) {
+	var args []interface{}
+	var where []string
+
+	if filters.TimeFrom != nil {
+		where = append(where, "time >= ?")
+		args = append(args, float64(filters.TimeFrom.UnixNano())/1e9)
+	}
+	if filters.TimeTo != nil {
+		where = append(where, "time <= ?")
+		args = append(args, float64(filters.TimeTo.UnixNano())/1e9)
+	}
+	if filters.Status != "" {
+		if clause, vals := buildStatusClause(filters.Status); clause != "" {
+			where = append(where, clause)
+			args = append(args, vals...)
+		}
+	}
+	if filters.Country != "" {
+		includes, excludes := parseTextFilter(filters.Country)
+		clause, vals := buildTextMatchClause("country", includes, excludes, false)
+		if clause != "" {
+			where = append(where, clause)
+			for _, v := range vals {
+				args = append(args, v)
+			}
+		}
+	}
+	if filters.ASN != "" {
+		includes, excludes := parseIntFilter(filters.ASN)
+		if len(excludes) > 0 {
+			placeholders := make([]string, len(excludes))
+			for i, v := range excludes {
+				placeholders[i] = "?"
+				args = append(args, v)
+			}
+			where = append(where, "asn NOT IN ("+strings.Join(placeholders, ",")+")")
+		}
+		if len(includes) > 0 {
+			placeholders := make([]string, len(includes))
+			for i, v := range includes {
+				placeholders[i] = "?"
+				args = append(args, v)
+			}
+			where = append(where, "asn IN ("+strings.Join(placeholders, ",")+")")
+		}
+	}
+	if filters.PathContains != "" {
+		includes, excludes := parseTextFilter(filters.PathContains)
+		clause, vals := buildTextMatchClause("path", includes, excludes, true)
+		if clause != "" {
+			where = append(where, clause)
+			for _, v := range vals {
+				args = append(args, v)
+			}
+		}
+	}
+	if filters.Method != "" {
+		includes, excludes := parseTextFilter(filters.Method)
+		clause, vals := buildTextMatchClause("method", includes, excludes, false)
+		if clause != "" {
+			where = append(where, clause)
+			for _, v := range vals {
+				args = append(args, v)
+			}
+		}
+	}
+	if filters.Host != "" {
+		includes, excludes := parseTextFilter(filters.Host)
+		clause, vals := buildTextMatchClause("host", includes, excludes, false)
+		if clause != "" {
+			where = append(where, clause)
+			for _, v := range vals {
+				args = append(args, v)
+			}
+		}
+	}
+	for _, f := range []struct{ column, raw string }{
+		{"remote_addr", filters.RemoteAddr},
+		{routeExpr, filters.Route},
+		{"browser", filters.Browser},
+		{"os", filters.OS},
+		{"device", filters.Device},
+		{"ref_domain", filters.RefDomain},
+		{"search_engine", filters.SearchEngine},
+		{"utm_source", filters.UTMSource},
+		{"utm_medium", filters.UTMMedium},
+		{"utm_campaign", filters.UTMCampaign},
+	} {
+		if f.raw == "" {
+			continue
+		}
+		includes, excludes := parseTextFilter(f.raw)
+		clause, vals := buildTextMatchClause(f.column, includes, excludes, false)
+		if clause != "" {
+			where = append(where, clause)
+			args = append(args, vals...)
+		}
+	}
+	switch filters.Bot {
+	case "yes":
+		where = append(where, "is_bot = 1")
+	case "no":
+		where = append(where, "is_bot = 0")
+	}
+	if filters.SinceID > 0 {
+		where = append(where, "id > ?")
+		args = append(args, filters.SinceID)
+	}
+	if filters.UntilID > 0 {
+		where = append(where, "id <= ?")
+		args = append(args, filters.UntilID)
+	}
+	if filters.Path != "" {
+		where = append(where, "path = ?")
+		args = append(args, filters.Path)
+	}
+	if filters.UserAgent != "" {
+		where = append(where, "user_agent = ?")
+		args = append(args, filters.UserAgent)
+	}
+	if filters.Session != "" {
+		where = append(where, "session_id = ?")
+		args = append(args, filters.Session)
+	}
+	if filters.Incident > 0 {
+		where = append(where, "id IN (SELECT entry_id FROM incident_evidence WHERE incident_id = ?)")
+		args = append(args, filters.Incident)
+	}
+	if filters.Threat != "" {
+		if clause, vals := buildThreatClause(filters.Threat); clause != "" {
+			where = append(where, clause)
+			args = append(args, vals...)
+		}
+	}
+	if filters.Params != "" {
+		clauses, vals := buildParamClauses(filters.Params)
+		where = append(where, clauses...)
+		args = append(args, vals...)
+	}
+	if filters.UserAgentContains != "" {
+		includes, excludes := parseTextFilter(filters.UserAgentContains)
+		clause, vals := buildTextMatchClause("user_agent", includes, excludes, true)
+		if clause != "" {
+			where = append(where, clause)
+			for _, v := range vals {
+				args = append(args, v)
+			}
+		}
+	}
+
+	if len(where) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+// andWhere adds cond to a clause produced by buildWhere.
+func andWhere(whereClause, cond string) string {
+	if whereClause == "" {
+		return " WHERE " + cond
+	}
+	return whereClause + " AND " + cond
+}
+
 func parseTextFilter(raw string) (includes []string, excludes []string) {
 	for _, token := range strings.Split(raw, ",") {
 		t := strings.TrimSpace(token)
@@ -329,6 +1227,85 @@ func parseTextFilter(raw string) (includes []string, excludes []string) {
 	return includes, excludes
 }
 
+// buildStatusClause matches codes ("404") and classes ("5xx"), each of
+// which may be negated with "-".
+func buildStatusClause(raw string) (string, []interface{}) {
+	var includes, excludes []string
+	var includeArgs, excludeArgs []interface{}
+	for _, token := range strings.Split(raw, ",") {
+		t := strings.ToLower(strings.TrimSpace(token))
+		negate := strings.HasPrefix(t, "-")
+		t = strings.TrimSpace(strings.TrimPrefix(t, "-"))
+		var cond string
+		var vals []interface{}
+		if len(t) == 3 && strings.HasSuffix(t, "xx") && t[0] >= '1' && t[0] <= '5' {
+			lo := int(t[0]-'0') * 100
+			cond, vals = "status BETWEEN ? AND ?", []interface{}{lo, lo + 99}
+		} else if n, err := strconv.Atoi(t); err == nil {
+			cond, vals = "status = ?", []interface{}{n}
+		} else {
+			continue
+		}
+		if negate {
+			excludes = append(excludes, "NOT "+cond)
+			excludeArgs = append(excludeArgs, vals...)
+		} else {
+			includes = append(includes, cond)
+			includeArgs = append(includeArgs, vals...)
+		}
+	}
+	var parts []string
+	if len(includes) > 0 {
+		parts = append(parts, "("+strings.Join(includes, " OR ")+")")
+	}
+	parts = append(parts, excludes...)
+	return strings.Join(parts, " AND "), append(includeArgs, excludeArgs...)
+}
+
+// buildThreatClause matches rows flagged by attack rules. Each token is a
+// rule id or category ("sqli" covers every "sqli-" rule), "any" or "none",
+// and may be negated with "-".
+func buildThreatClause(raw string) (string, []interface{}) {
+	var includes, excludes []string
+	var includeArgs, excludeArgs []interface{}
+	flaggedOnly := true // lets SQLite use the partial index on flagged rows
+	for _, token := range strings.Split(raw, ",") {
+		t := strings.TrimSpace(token)
+		negate := strings.HasPrefix(t, "-")
+		t = strings.TrimSpace(strings.TrimPrefix(t, "-"))
+		var cond string
+		var vals []interface{}
+		switch t {
+		case "":
+			continue
+		case "any":
+			cond = "threats <> ''"
+		case "none":
+			cond = "threats = ''"
+		default:
+			cond = "(instr(',' || threats || ',', ?) > 0 OR instr(',' || threats, ?) > 0)"
+			vals = []interface{}{"," + t + ",", "," + t + "-"}
+		}
+		if negate {
+			excludes = append(excludes, "NOT "+cond)
+			excludeArgs = append(excludeArgs, vals...)
+		} else {
+			includes = append(includes, cond)
+			includeArgs = append(includeArgs, vals...)
+			flaggedOnly = flaggedOnly && t != "none"
+		}
+	}
+	var parts []string
+	if len(includes) > 0 {
+		if flaggedOnly {
+			parts = append(parts, "threats <> ''")
+		}
+		parts = append(parts, "("+strings.Join(includes, " OR ")+")")
+	}
+	parts = append(parts, excludes...)
+	return strings.Join(parts, " AND "), append(includeArgs, excludeArgs...)
+}
+
 func parseIntFilter(raw string) (includes []int, excludes []int) {
 	for _, token := range strings.Split(raw, ",") {
 		t := strings.TrimSpace(token)
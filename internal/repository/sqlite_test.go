@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+func newTestRepo(t *testing.T) *SQLiteRepository {
+	t.Helper()
+	r, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// truncateAndStrip drops the last IPv4 octet and the query string.
+func truncateAndStrip(e *models.LogEntry) {
+	if i := strings.LastIndex(e.RemoteAddr, "."); i >= 0 {
+		e.RemoteAddr = e.RemoteAddr[:i] + ".0"
+	}
+	e.Query = ""
+	e.Referer = ""
+}
+
+func TestAnonymizeOlderThanMergesTwins(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cutoff := base.Add(time.Hour)
+	entry := func(offset time.Duration, addr, path, query string, rate int) models.LogEntry {
+		return models.LogEntry{
+			Time: float64(base.Add(offset).Unix()), RemoteAddr: addr, Host: "example.com",
+			Method: "GET", Path: path, Query: query, Status: 200, SampleRate: rate,
+		}
+	}
+	tests := []struct {
+		name      string
+		entries   []models.LogEntry
+		wantRows  int
+		wantRates []int // sample rates of the remaining rows
+	}{
+		{
+			name: "queries differ only in stripped parts",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/", "token=a", 1),
+				entry(0, "192.0.2.10", "/", "token=b", 1),
+			},
+			wantRows: 1, wantRates: []int{2},
+		},
+		{
+			name: "addresses in one /24",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/", "", 1),
+				entry(0, "192.0.2.11", "/", "", 1),
+				entry(0, "192.0.2.12", "/", "", 1),
+			},
+			wantRows: 1, wantRates: []int{3},
+		},
+		{
+			name: "sample rates add up",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/", "", 10),
+				entry(0, "192.0.2.11", "/", "", 1),
+			},
+			wantRows: 1, wantRates: []int{11},
+		},
+		{
+			name: "different paths stay apart",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/a", "", 1),
+				entry(0, "192.0.2.11", "/b", "", 1),
+			},
+			wantRows: 2, wantRates: []int{1, 1},
+		},
+		{
+			name: "different seconds stay apart",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/", "", 1),
+				entry(time.Second, "192.0.2.11", "/", "", 1),
+			},
+			wantRows: 2, wantRates: []int{1, 1},
+		},
+		{
+			name: "rows after the cutoff are left alone",
+			entries: []models.LogEntry{
+				entry(0, "192.0.2.10", "/", "", 1),
+				entry(2*time.Hour, "192.0.2.11", "/", "", 1),
+			},
+			wantRows: 2, wantRates: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepo(t)
+			if err := r.InsertBatch(tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			var want int64
+			for _, e := range tt.entries {
+				want += int64(e.SampleRate)
+			}
+			if _, err := r.AnonymizeOlderThan(cutoff, truncateAndStrip); err != nil {
+				t.Fatal(err)
+			}
+			rows, total, requests, err := r.Query(QueryFilters{}, 100, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.wantRows {
+				t.Fatalf("%d rows left, want %d", total, tt.wantRows)
+			}
+			if requests != want {
+				t.Errorf("rows stand for %d requests, want %d", requests, want)
+			}
+			for i, e := range rows {
+				if e.SampleRate != tt.wantRates[i] {
+					t.Errorf("row %d: sample rate %d, want %d", i, e.SampleRate, tt.wantRates[i])
+				}
+				old := e.Time < float64(cutoff.Unix())
+				if e.Anonymized != old {
+					t.Errorf("row %d: anonymized = %v, want %v", i, e.Anonymized, old)
+				}
+				if old && (e.Query != "" || !strings.HasSuffix(e.RemoteAddr, ".0")) {
+					t.Errorf("row %d not scrubbed: %s ?%s", i, e.RemoteAddr, e.Query)
+				}
+			}
+		})
+	}
+}
+
+func TestAnonymizeOlderThanMovesEvidence(t *testing.T) {
+	r := newTestRepo(t)
+	at := float64(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix())
+	if err := r.InsertBatch([]models.LogEntry{
+		{Time: at, RemoteAddr: "192.0.2.10", Host: "example.com", Method: "GET", Path: "/", Status: 404, SampleRate: 1},
+		{Time: at, RemoteAddr: "192.0.2.11", Host: "example.com", Method: "GET", Path: "/", Status: 404, SampleRate: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rows, _, _, err := r.Query(QueryFilters{}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc := Incident{Kind: "not_found", RemoteAddr: "192.0.2.11", StartedAt: at, LastSeen: at}
+	if err := r.SaveIncident(&inc, []int64{rows[1].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AnonymizeOlderThan(time.Unix(int64(at)+3600, 0), truncateAndStrip); err != nil {
+		t.Fatal(err)
+	}
+	evidence, total, _, err := r.Query(QueryFilters{Incident: inc.ID}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || evidence[0].SampleRate != 2 {
+		t.Fatalf("incident evidence = %+v, want the merged row", evidence)
+	}
+	got, err := r.LatestIncident("192.0.2.0", "not_found")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.ID != inc.ID {
+		t.Errorf("incident address not anonymized: %+v", got)
+	}
+}
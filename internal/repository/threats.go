@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// SecuritySummary counts the requests flagged by attack rules.
+type SecuritySummary struct {
+	Requests  int64 // flagged requests
+	UniqueIPs int64
+	Rules     []ThreatCount  // every rule with hits, busiest first
+	TopIPs    []ThreatSource // busiest first
+	Hosts     []LabelCount
+}
+
+// ThreatCount is how often one rule matched.
+type ThreatCount struct {
+	Rule     string
+	Requests int64
+	LastSeen float64 // epoch seconds
+}
+
+// ThreatSource is a client address that sent flagged requests.
+type ThreatSource struct {
+	Addr     string
+	Country  string
+	Requests int64
+	Rules    []string // distinct rules matched
+	LastSeen float64
+}
+
+func (r *SQLiteRepository) SecuritySummary(filters QueryFilters, limit int) (*SecuritySummary, error) {
+	whereClause, args := buildWhere(filters)
+	whereClause = andWhere(whereClause, "threats <> ''")
+	s := &SecuritySummary{}
+	err := r.db.QueryRow("SELECT COALESCE(SUM(sample_rate), 0), COUNT(DISTINCT remote_addr) FROM log_entries"+whereClause, args...).
+		Scan(&s.Requests, &s.UniqueIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows matching several rules list them all, so count per combination
+	// and split the combinations here; there are only a handful of them.
+	rows, err := r.db.Query("SELECT threats, SUM(sample_rate), MAX(time) FROM log_entries"+whereClause+" GROUP BY threats", args...)
+	if err != nil {
+		return nil, err
+	}
+	byRule := make(map[string]*ThreatCount)
+	for rows.Next() {
+		var ids string
+		var n int64
+		var last float64
+		if err := rows.Scan(&ids, &n, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		for _, id := range strings.Split(ids, ",") {
+			tc := byRule[id]
+			if tc == nil {
+				tc = &ThreatCount{Rule: id}
+				byRule[id] = tc
+			}
+			tc.Requests += n
+			tc.LastSeen = max(tc.LastSeen, last)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, tc := range byRule {
+		s.Rules = append(s.Rules, *tc)
+	}
+	sort.Slice(s.Rules, func(i, j int) bool {
+		if s.Rules[i].Requests != s.Rules[j].Requests {
+			return s.Rules[i].Requests > s.Rules[j].Requests
+		}
+		return s.Rules[i].Rule < s.Rules[j].Rule
+	})
+
+	rows, err = r.db.Query(`SELECT remote_addr, MAX(COALESCE(country, '')), SUM(sample_rate) as cnt, MAX(time), GROUP_CONCAT(DISTINCT threats)
+		FROM log_entries`+whereClause+` GROUP BY remote_addr ORDER BY cnt DESC, remote_addr LIMIT ?`, append(append([]interface{}{}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts ThreatSource
+		var ids string
+		if err := rows.Scan(&ts.Addr, &ts.Country, &ts.Requests, &ts.LastSeen, &ids); err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, id := range strings.Split(ids, ",") {
+			if !seen[id] {
+				seen[id] = true
+				ts.Rules = append(ts.Rules, id)
+			}
+		}
+		sort.Strings(ts.Rules)
+		s.TopIPs = append(s.TopIPs, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.Hosts, err = r.topLabels("host", whereClause, args, limit); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RescanThreats runs match over every stored row and saves the rule ids it
+// returns where they changed, e.g. after the rule set was updated. It
+// returns how many rows changed. Anonymized rows no longer hold the query
+// and referer they were matched on, so they only gain ids, never lose them.
+func (r *SQLiteRepository) RescanThreats(match func(e *models.LogEntry) string) (int, error) {
+	changed := 0
+	var lastID int64
+	for {
+		rows, err := r.db.Query("SELECT id, path, query, user_agent, referer, threats, anonymized FROM log_entries WHERE id > ? ORDER BY id LIMIT 1000", lastID)
+		if err != nil {
+			return changed, err
+		}
+		var batch []models.LogEntry
+		for rows.Next() {
+			var e models.LogEntry
+			if err := rows.Scan(&e.ID, &e.Path, &e.Query, &e.UserAgent, &e.Referer, &e.Threats, &e.Anonymized); err != nil {
+				rows.Close()
+				return changed, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return changed, err
+		}
+		if len(batch) == 0 {
+			return changed, nil
+		}
+		lastID = batch[len(batch)-1].ID
+
+		tx, err := r.db.Begin()
+		if err != nil {
+			return changed, err
+		}
+		for i := range batch {
+			ids := match(&batch[i])
+			if batch[i].Anonymized {
+				ids = mergeThreatIDs(batch[i].Threats, ids)
+			}
+			if ids == batch[i].Threats {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE log_entries SET threats = ? WHERE id = ?", ids, batch[i].ID); err != nil {
+				tx.Rollback()
+				return changed, err
+			}
+			changed++
+		}
+		if err := tx.Commit(); err != nil {
+			return changed, err
+		}
+	}
+}
+
+// mergeThreatIDs returns the comma-separated ids of old followed by those of
+// added it does not already have.
+func mergeThreatIDs(old, added string) string {
+	if old == "" || added == "" {
+		return old + added
+	}
+	ids := strings.Split(old, ",")
+	for _, id := range strings.Split(added, ",") {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,164 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Normalizer maps request paths to route templates so that e.g. /users/123
+// and /users/124 are counted together as /users/:id.
+type Normalizer struct {
+	templates [][]string
+	auto      bool
+}
+
+// New builds a Normalizer from templates such as "/users/:id" or
+// "/static/*". In a template, a segment starting with ":" matches any single
+// segment and a final "*" matches the rest of the path. Templates are tried
+// in order; when none matches and auto is set, ID-like segments are replaced
+// with ":id".
+func New(templates []string, auto bool) (*Normalizer, error) {
+	n := &Normalizer{auto: auto}
+	for _, t := range templates {
+		t = strings.TrimSpace(t)
+		if !strings.HasPrefix(t, "/") {
+			return nil, fmt.Errorf("route template %q must start with /", t)
+		}
+		segs := split(t)
+		for i, s := range segs {
+			if s == "*" && i != len(segs)-1 {
+				return nil, fmt.Errorf("route template %q: * is only allowed at the end", t)
+			}
+		}
+		n.templates = append(n.templates, segs)
+	}
+	return n, nil
+}
+
+// Route returns the template path matches, or path itself if nothing applies.
+func (n *Normalizer) Route(path string) string {
+	if path == "" {
+		return path
+	}
+	segs := split(path)
+	for _, t := range n.templates {
+		if match(t, segs) {
+			return "/" + strings.Join(t, "/")
+		}
+	}
+	if !n.auto {
+		return path
+	}
+	changed := false
+	for i, s := range segs {
+		if isIDLike(s) {
+			segs[i] = ":id"
+			changed = true
+		}
+	}
+	if !changed {
+		return path
+	}
+	route := "/" + strings.Join(segs, "/")
+	if strings.HasSuffix(path, "/") && len(segs) > 0 {
+		route += "/"
+	}
+	return route
+}
+
+func split(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func match(template, segs []string) bool {
+	for i, t := range template {
+		if t == "*" {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		if strings.HasPrefix(t, ":") {
+			continue
+		}
+		if t != segs[i] {
+			return false
+		}
+	}
+	return len(template) == len(segs)
+}
+
+// isIDLike reports whether a path segment looks like an identifier rather
+// than a fixed part of the route: numbers, UUIDs, hex hashes, dates, and long
+// mixed letter/digit tokens.
+func isIDLike(s string) bool {
+	if s == "" {
+		return false
+	}
+	if isAll(s, isDigit) {
+		return true
+	}
+	if isUUID(s) || isDate(s) {
+		return true
+	}
+	if len(s) >= 16 && isAll(s, isHex) {
+		return true
+	}
+	if len(s) >= 20 && !strings.Contains(s, ".") && hasDigit(s) && hasLetter(s) && isAll(s, isTokenChar) {
+		return true
+	}
+	return false
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isDate matches YYYY-MM-DD; compact dates are already caught as numbers.
+func isDate(s string) bool {
+	return len(s) == 10 && s[4] == '-' && s[7] == '-' && isAll(s[:4]+s[5:7]+s[8:], isDigit)
+}
+
+func isAll(s string, f func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !f(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasDigit(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r >= '0' && r <= '9' }) >= 0
+}
+
+func hasLetter(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' }) >= 0
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHex(c byte) bool { return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' }
+
+func isTokenChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_'
+}
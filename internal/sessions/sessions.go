@@ -0,0 +1,115 @@
+package sessions
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+// sweepEvery is how many assignments pass between purges of idle visitors.
+const sweepEvery = 10000
+
+type visitor struct {
+	id    string
+	start float64
+	last  float64
+}
+
+// Tracker groups entries into visits by (remote_addr, user_agent): a request
+// more than the timeout after the visitor's previous one starts a new
+// session. It is safe for concurrent use. A nil Tracker assigns nothing.
+type Tracker struct {
+	mu       sync.Mutex
+	key      []byte  // random, never stored: IDs cannot be traced back to an address
+	timeout  float64 // seconds; 0 disables sessionization
+	visitors map[string]*visitor
+	newest   float64
+	calls    int
+}
+
+func New(timeout time.Duration) *Tracker {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &Tracker{key: key, timeout: timeout.Seconds(), visitors: make(map[string]*visitor)}
+}
+
+// SetTimeout changes the inactivity timeout for entries assigned from now on.
+func (t *Tracker) SetTimeout(timeout time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.timeout = timeout.Seconds()
+	t.mu.Unlock()
+}
+
+// Fork returns an empty Tracker with the same timeout, for input that should
+// not interleave with this one's state (e.g. an uploaded historical file).
+func (t *Tracker) Fork() *Tracker {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &Tracker{key: t.key, timeout: t.timeout, visitors: make(map[string]*visitor)}
+}
+
+// Assign sets e.SessionID. Entries should arrive roughly in time order;
+// anything within the timeout of the visitor's last request joins the
+// current session. IDs are keyed hashes of the visitor and the session
+// start, so re-reading the same log while the process runs yields the same
+// IDs.
+func (t *Tracker) Assign(e *models.LogEntry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timeout <= 0 {
+		return
+	}
+	key := e.RemoteAddr + "\x00" + e.UserAgent
+	v := t.visitors[key]
+	if v == nil || e.Time-v.last > t.timeout || v.start-e.Time > t.timeout {
+		v = &visitor{id: t.hash(key + "\x00" + strconv.FormatFloat(e.Time, 'f', 3, 64)), start: e.Time, last: e.Time}
+		t.visitors[key] = v
+	}
+	if e.Time > v.last {
+		v.last = e.Time
+	}
+	if e.Time > t.newest {
+		t.newest = e.Time
+	}
+	e.SessionID = v.id
+
+	t.calls++
+	if t.calls%sweepEvery == 0 {
+		for k, v := range t.visitors {
+			if t.newest-v.last > t.timeout {
+				delete(t.visitors, k)
+			}
+		}
+	}
+}
+
+// Rekey returns another ID for the stored session id, the same for every
+// row of the session. The anonymization job uses it so that IDs made before
+// they were keyed cannot be matched against guessed addresses either.
+func (t *Tracker) Rekey(id string) string {
+	if t == nil || id == "" {
+		return id
+	}
+	return t.hash("rekey\x00" + id)
+}
+
+func (t *Tracker) hash(s string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,207 @@
+package threats
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed rules.yaml
+var bundledRules []byte
+
+// Fields a rule can inspect.
+var knownFields = map[string]bool{"path": true, "query": true, "user_agent": true, "referer": true}
+
+// Rule flags requests whose fields match Pattern.
+type Rule struct {
+	ID          string   `yaml:"id"`
+	Category    string   `yaml:"category"` // sqli, xss, traversal, lfi, rfi, cmdi, scanner, log4shell
+	Description string   `yaml:"description"`
+	Pattern     string   `yaml:"pattern"`
+	Fields      []string `yaml:"fields"` // default path and query
+
+	re *regexp.Regexp
+}
+
+// Detector matches requests against a rule set. A nil Detector matches
+// nothing.
+type Detector struct {
+	rules []*Rule
+}
+
+// Load builds a Detector from the bundled rules plus those in path, if set.
+// A rule in path with the id of a bundled rule replaces it; the others are
+// added after the bundled ones. Rules whose id is in disabled are dropped.
+func Load(path string, disabled []string) (*Detector, error) {
+	rules, err := parse(bundledRules, "bundled rules")
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		extra, err := parse(data, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range extra {
+			replaced := false
+			for i, r := range rules {
+				if r.ID == x.ID {
+					rules[i], replaced = x, true
+				}
+			}
+			if !replaced {
+				rules = append(rules, x)
+			}
+		}
+	}
+	off := make(map[string]bool, len(disabled))
+	for _, id := range disabled {
+		off[strings.TrimSpace(id)] = true
+	}
+	d := &Detector{}
+	for _, r := range rules {
+		if !off[r.ID] {
+			d.rules = append(d.rules, r)
+		}
+	}
+	return d, nil
+}
+
+func parse(data []byte, source string) ([]*Rule, error) {
+	var rules []*Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	seen := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		if r.ID == "" || strings.Contains(r.ID, ",") || seen[r.ID] {
+			return nil, fmt.Errorf("%s: rule %d: id must be set, unique and free of commas", source, i)
+		}
+		seen[r.ID] = true
+		if r.Category == "" {
+			r.Category, _, _ = strings.Cut(r.ID, "-")
+		}
+		if len(r.Fields) == 0 {
+			r.Fields = []string{"path", "query"}
+		}
+		for _, f := range r.Fields {
+			if !knownFields[f] {
+				return nil, fmt.Errorf("%s: rule %s: unknown field %q", source, r.ID, f)
+			}
+		}
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("%s: rule %s: pattern must be set", source, r.ID)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", source, r.ID, err)
+		}
+		r.re = re
+	}
+	return rules, nil
+}
+
+// Rules returns the active rules in match order.
+func (d *Detector) Rules() []Rule {
+	if d == nil {
+		return nil
+	}
+	out := make([]Rule, len(d.rules))
+	for i, r := range d.rules {
+		out[i] = *r
+	}
+	return out
+}
+
+// Match returns the comma-separated ids of the rules e matches, or "".
+// Each field is checked as logged and, when different, URL-decoded up to
+// twice, so encoded payloads are caught as well as encoding tricks.
+func (d *Detector) Match(e *models.LogEntry) string {
+	if d == nil {
+		return ""
+	}
+	values := map[string][]string{
+		"path":       variants(e.Path, false),
+		"query":      variants(e.Query, true),
+		"user_agent": {e.UserAgent},
+		"referer":    variants(e.Referer, true),
+	}
+	var ids []string
+	for _, r := range d.rules {
+		if r.matches(values) {
+			ids = append(ids, r.ID)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func (r *Rule) matches(values map[string][]string) bool {
+	for _, f := range r.Fields {
+		for _, v := range values[f] {
+			if v != "" && r.re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// variants returns s and its decoded forms.
+func variants(s string, plus bool) []string {
+	out := []string{s}
+	for i := 0; i < 2; i++ {
+		d := unescape(s, plus)
+		if d == s {
+			break
+		}
+		out = append(out, d)
+		s = d
+	}
+	return out
+}
+
+// unescape decodes %XX sequences, and "+" as a space if plus is set. Unlike
+// url.QueryUnescape it keeps malformed escapes as they are instead of
+// giving up, since attack payloads are often not valid URLs.
+func unescape(s string, plus bool) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && plus:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
